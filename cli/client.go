@@ -7,6 +7,7 @@ import (
 
 	"github.com/chzyer/readline"
 	"github.com/kennylevinsen/g9ptools/convenience"
+	"github.com/kennylevinsen/g9ptools/fileserver"
 )
 
 func main() {
@@ -20,8 +21,14 @@ func main() {
 	user := os.Args[2]
 	service := os.Args[3]
 
+	network, address, err := fileserver.ParseAddr(addr)
+	if err != nil {
+		fmt.Printf("Bad address: %v\n", err)
+		return
+	}
+
 	c := &convenience.Client{}
-	err := c.Dial("tcp", addr, user, service)
+	err = c.Dial(network, address, user, service)
 	if err != nil {
 		fmt.Printf("Connect failed: %v\n", err)
 		return
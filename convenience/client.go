@@ -2,6 +2,7 @@ package convenience
 
 import (
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/kennylevinsen/g9p"
 	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
 )
 
 const (
@@ -20,10 +22,24 @@ const (
 var (
 	ErrUnknownProtocol  = errors.New("unknown protocol")
 	ErrClientNotStarted = errors.New("client not started")
-	ErrNoSuchFile       = errors.New("no such file")
-	ErrNotADirectory    = errors.New("not a directory")
+	ErrNoSuchFile       = fileserver.ErrNotExist
+	ErrNotADirectory    = fileserver.ErrNotDir
 )
 
+// remoteError turns an error reported by the server into the matching typed
+// error from the fileserver package, so that callers can tell them apart
+// with errors.Is.
+func remoteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *fileserver.Error
+	if x := fileserver.ParseError(err.Error()); errors.As(x, &e) {
+		return e
+	}
+	return err
+}
+
 type Client struct {
 	c       *g9p.Client
 	maxSize uint32
@@ -59,7 +75,7 @@ func (c *Client) setup(username, servicename string) error {
 	if err != nil {
 		c.c.Stop()
 		c.c = nil
-		return err
+		return remoteError(err)
 	}
 
 	if vresp.Version != "9P2000" {
@@ -79,7 +95,7 @@ func (c *Client) setup(username, servicename string) error {
 	if err != nil {
 		c.c.Stop()
 		c.c = nil
-		return err
+		return remoteError(err)
 	}
 
 	return nil
@@ -98,7 +114,7 @@ func (c *Client) readAll(fid protocol.Fid) ([]byte, error) {
 
 		rresp, err := c.c.Read(rreq)
 		if err != nil {
-			return nil, err
+			return nil, remoteError(err)
 		}
 		if len(rresp.Data) == 0 {
 			break
@@ -109,10 +125,17 @@ func (c *Client) readAll(fid protocol.Fid) ([]byte, error) {
 	return b, nil
 }
 
-func (c *Client) writeAll(fid protocol.Fid, data []byte) error {
+// writeAll writes data to fid in chunks of at most iounit bytes, as returned
+// by the open of fid. Where the server gave none, the chunks are as large as
+// fit in a message.
+func (c *Client) writeAll(fid protocol.Fid, iounit uint32, data []byte) error {
+	if iounit == 0 || iounit > c.maxSize-fileserver.IOHeaderSize {
+		iounit = c.maxSize - fileserver.IOHeaderSize
+	}
+
 	var offset uint64
-	for {
-		count := int(c.maxSize - 20)
+	for offset < uint64(len(data)) {
+		count := int(iounit)
 		if len(data[offset:]) < count {
 			count = len(data[offset:])
 		}
@@ -125,7 +148,7 @@ func (c *Client) writeAll(fid protocol.Fid, data []byte) error {
 
 		wresp, err := c.c.Write(wreq)
 		if err != nil {
-			return err
+			return remoteError(err)
 		}
 		offset += uint64(wresp.Count)
 	}
@@ -152,7 +175,7 @@ func (c *Client) walkTo(file string) (protocol.Fid, protocol.Qid, error) {
 	}
 	wresp, err := c.c.Walk(wreq)
 	if err != nil {
-		return protocol.NOFID, protocol.Qid{}, err
+		return protocol.NOFID, protocol.Qid{}, remoteError(err)
 	}
 
 	if len(wresp.Qids) != len(wreq.Names) {
@@ -198,7 +221,7 @@ func (c *Client) Read(file string) ([]byte, error) {
 	}
 	_, err = c.c.Open(oreq)
 	if err != nil {
-		return nil, err
+		return nil, remoteError(err)
 	}
 
 	return c.readAll(fid)
@@ -216,12 +239,12 @@ func (c *Client) Write(content []byte, file string) error {
 		Fid:  fid,
 		Mode: protocol.OWRITE,
 	}
-	_, err = c.c.Open(oreq)
+	oresp, err := c.c.Open(oreq)
 	if err != nil {
-		return err
+		return remoteError(err)
 	}
 
-	return c.writeAll(fid, content)
+	return c.writeAll(fid, oresp.IOUnit, content)
 }
 
 func (c *Client) List(file string) ([]string, error) {
@@ -238,7 +261,7 @@ func (c *Client) List(file string) ([]string, error) {
 	}
 	_, err = c.c.Open(oreq)
 	if err != nil {
-		return nil, err
+		return nil, remoteError(err)
 	}
 
 	b, err := c.readAll(fid)
@@ -287,7 +310,7 @@ func (c *Client) Create(name string, directory bool) error {
 	}
 	_, err = c.c.Create(creq)
 	if err != nil {
-		return err
+		return remoteError(err)
 	}
 
 	return nil
@@ -305,7 +328,7 @@ func (c *Client) Remove(name string) error {
 	}
 	_, err = c.c.Remove(rreq)
 	if err != nil {
-		return err
+		return remoteError(err)
 	}
 
 	return nil
@@ -327,6 +350,49 @@ func (c *Client) Dial(network, address, username, servicename string) error {
 	return nil
 }
 
+// DialTLS is like Dial, but talks TLS to the server, as configured by
+// config. With mutual TLS, the server may attach as the user named in the
+// client certificate rather than username.
+func (c *Client) DialTLS(network, address string, config *tls.Config, username, servicename string) error {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return err
+	}
+
+	c.c = g9p.NewClient(conn)
+	go c.c.Start()
+
+	err = c.setup(username, servicename)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// TLSConfig returns a client TLS configuration that trusts the server only
+// if its certificate is signed by one of the authorities in the PEM file
+// caFile, rather than by those the system trusts. If certFile and keyFile
+// are not empty, the certificate in them is presented to servers that ask
+// for one.
+func TLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	pool, err := fileserver.LoadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
 func (c *Client) Connect(rw io.ReadWriter, username, servicename string) error {
 	c.c = g9p.NewClient(rw)
 	go c.c.Start()
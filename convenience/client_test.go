@@ -0,0 +1,46 @@
+package convenience
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// TestWriteLarge writes more than fits in one message, checking that the
+// chunks are no larger than the server allows.
+func TestWriteLarge(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	root := ramtree.NewRAMTree("/", 0777, "glenda", "glenda")
+	go fileserver.ServeListener(l, func() *fileserver.FileServer {
+		return fileserver.NewFileServer(root, nil, DefaultMaxSize, fileserver.Quiet)
+	})
+
+	var c Client
+	if err := c.Dial("tcp", l.Addr().String(), "glenda", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("file", false); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 3*DefaultMaxSize+1)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := c.Write(content, "file"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.Read("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("read back %d bytes, expected the %d written", len(got), len(content))
+	}
+}
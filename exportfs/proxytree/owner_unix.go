@@ -0,0 +1,18 @@
+//go:build unix
+
+package proxytree
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the ids of the user and group owning the file described
+// by fi.
+func fileOwner(fi os.FileInfo) (uid, gid uint32, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return st.Uid, st.Gid, true
+}
@@ -0,0 +1,57 @@
+//go:build linux && !386 && !arm
+
+package proxytree
+
+import (
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const canDropPrivileges = true
+
+// asUser runs fn on a thread whose file system credentials, and groups, are
+// those of h, and then gives the thread back those of self. These are all
+// credentials of the thread, not of the process, so other operations go on
+// as the server meanwhile. A thread that cannot be given back its
+// credentials is never used again.
+func asUser(h, self hostUser, fn func() error) error {
+	runtime.LockOSThread()
+	if err := setCreds(h); err != nil {
+		if setCreds(self) == nil {
+			runtime.UnlockOSThread()
+		}
+		return err
+	}
+	err := fn()
+	if setCreds(self) == nil {
+		runtime.UnlockOSThread()
+	}
+	return err
+}
+
+// setCreds gives the calling thread the groups of h, and its uid and gid for
+// file system access.
+func setCreds(h hostUser) error {
+	// syscall.Setgroups would change the groups of every thread.
+	var gids *uint32
+	if len(h.gids) > 0 {
+		gids = &h.gids[0]
+	}
+	if _, _, e := syscall.RawSyscall(syscall.SYS_SETGROUPS, uintptr(len(h.gids)), uintptr(unsafe.Pointer(gids)), 0); e != 0 {
+		return e
+	}
+	if !setfs(syscall.SYS_SETFSGID, h.gid) || !setfs(syscall.SYS_SETFSUID, h.uid) {
+		return syscall.EPERM
+	}
+	return nil
+}
+
+// setfs sets the file system uid or gid of the calling thread to id with
+// trap, reporting whether it took. Neither call reports errors, but one made
+// with an invalid id returns the current value.
+func setfs(trap uintptr, id uint32) bool {
+	syscall.RawSyscall(trap, uintptr(id), 0, 0)
+	cur, _, _ := syscall.RawSyscall(trap, ^uintptr(0), 0, 0)
+	return uint32(cur) == id
+}
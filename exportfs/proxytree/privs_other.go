@@ -0,0 +1,10 @@
+//go:build !linux || 386 || arm
+
+package proxytree
+
+const canDropPrivileges = false
+
+// asUser runs fn, as privileges cannot be dropped on this system.
+func asUser(h, self hostUser, fn func() error) error {
+	return fn()
+}
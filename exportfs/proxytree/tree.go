@@ -5,16 +5,19 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/kennylevinsen/g9p/protocol"
 	"github.com/kennylevinsen/g9ptools/fileserver"
 )
 
-func permCheck(permissions protocol.FileMode, mode protocol.OpenMode) bool {
-	var offset uint = 6
+// permCheck reports whether permissions grant mode to the class at offset: 6
+// for the owner, 3 for the group and 0 for others.
+func permCheck(offset uint, permissions protocol.FileMode, mode protocol.OpenMode) bool {
 	switch mode & 3 {
 	case protocol.OREAD:
 		return permissions&(1<<(2+offset)) != 0
@@ -32,7 +35,7 @@ func permCheck(permissions protocol.FileMode, mode protocol.OpenMode) bool {
 func openMode2Flag(fm protocol.OpenMode) int {
 	var nfm int
 
-	switch fm & 0xF {
+	switch fm & 3 {
 	case protocol.OREAD:
 		nfm = os.O_RDONLY
 	case protocol.OWRITE:
@@ -44,8 +47,7 @@ func openMode2Flag(fm protocol.OpenMode) int {
 		nfm = os.O_RDONLY
 	}
 
-	switch fm & 0xF0 {
-	case protocol.OTRUNC:
+	if fm&protocol.OTRUNC != 0 {
 		nfm |= os.O_TRUNC
 	}
 
@@ -74,8 +76,10 @@ func (ot *ProxyOpenTree) update() error {
 
 	for _, f := range dir {
 		pf := &ProxyFile{
-			path: f.Name(),
-			info: f,
+			root:  ot.t.root,
+			path:  filepath.Join(ot.t.path, f.Name()),
+			info:  f,
+			users: ot.t.users,
 		}
 
 		// We gave it a stat, we just need the encoding
@@ -92,7 +96,7 @@ func (ot *ProxyOpenTree) update() error {
 
 func (ot *ProxyOpenTree) Seek(offset int64, whence int) (int64, error) {
 	if ot.t == nil {
-		return 0, errors.New("file not open")
+		return 0, fileserver.ErrNotOpen
 	}
 	length := int64(len(ot.buffer))
 	switch whence {
@@ -120,7 +124,7 @@ func (ot *ProxyOpenTree) Seek(offset int64, whence int) (int64, error) {
 
 func (ot *ProxyOpenTree) Read(p []byte) (int, error) {
 	if ot.t == nil {
-		return 0, errors.New("file not open")
+		return 0, fileserver.ErrNotOpen
 	}
 	rlen := int64(len(p))
 	if rlen > int64(len(ot.buffer))-ot.offset {
@@ -132,7 +136,7 @@ func (ot *ProxyOpenTree) Read(p []byte) (int, error) {
 }
 
 func (ot *ProxyOpenTree) Write(p []byte) (int, error) {
-	return 0, errors.New("cannot write to directory")
+	return 0, fileserver.ErrIsDir
 }
 
 func (ot *ProxyOpenTree) Close() error {
@@ -146,8 +150,7 @@ type ProxyFile struct {
 	path    string
 	info    os.FileInfo
 	caching int
-	user    string
-	group   string
+	users   *Users
 }
 
 func (pf *ProxyFile) updateInfo() error {
@@ -196,16 +199,67 @@ func (pf *ProxyFile) Name() (string, error) {
 	return filepath.Base(pf.path), nil
 }
 
+// WriteStat applies s with the credentials of the server.
 func (pf *ProxyFile) WriteStat(s protocol.Stat) error {
-	n := filepath.Base(pf.path)
-	if s.Name != "" && s.Name != n {
-		d := filepath.Dir(pf.path)
-		pf.path = filepath.Join(d, s.Name)
+	return pf.writeStatAs(func(fn func() error) error { return fn() }, s)
+}
+
+// WriteStatAs applies s with the credentials of the host user that user acts
+// as, should privileges be dropped.
+func (pf *ProxyFile) WriteStatAs(user string, s protocol.Stat) error {
+	h := pf.users.host(user)
+	return pf.writeStatAs(func(fn func() error) error { return pf.users.as(h, fn) }, s)
+}
+
+func (pf *ProxyFile) writeStatAs(as func(func() error) error, s protocol.Stat) error {
+	// The actual rename has already ocurred by the time we get here, so the
+	// file is looked up by its new name. Should we fail, the rename is rolled
+	// back, so the old one is restored.
+	op := pf.path
+	if s.Name != "" && s.Name != filepath.Base(pf.path) {
+		pf.path = filepath.Join(filepath.Dir(pf.path), s.Name)
+	}
+	if err := pf.writeStat(as, s); err != nil {
+		pf.path = op
+		return err
 	}
+	return nil
+}
 
-	// NOTE(kl): We ignore everything else. This is incorrect, but most things
-	// don't make sense to touch, and the actual rename has already ocurred
-	// anyway.
+func (pf *ProxyFile) writeStat(as func(func() error) error, s protocol.Stat) error {
+	if err := pf.updateInfo(); err != nil {
+		return err
+	}
+	fp := filepath.Join(pf.root, pf.path)
+
+	// The mode is restored if anything after it fails. Truncating moves the
+	// mtime, so it has to happen before the mtime is set.
+	omode := pf.info.Mode() & 0777
+	chmod := s.Mode != ^protocol.FileMode(0) && os.FileMode(s.Mode&0777) != omode
+	if chmod {
+		if err := as(func() error { return os.Chmod(fp, os.FileMode(s.Mode&0777)) }); err != nil {
+			return err
+		}
+	}
+	undo := func(err error) error {
+		if chmod {
+			as(func() error { return os.Chmod(fp, omode) })
+		}
+		return err
+	}
+	if !pf.info.IsDir() && s.Length != ^uint64(0) && int64(s.Length) != pf.info.Size() {
+		if err := as(func() error { return os.Truncate(fp, int64(s.Length)) }); err != nil {
+			return undo(err)
+		}
+	}
+	if s.Mtime != ^uint32(0) && int64(s.Mtime) != pf.info.ModTime().Unix() {
+		mtime := time.Unix(int64(s.Mtime), 0)
+		if err := as(func() error { return os.Chtimes(fp, mtime, mtime) }); err != nil {
+			return undo(err)
+		}
+	}
+
+	// NOTE(kl): Ownership is left alone, as we cannot map it to the host.
 	return nil
 }
 
@@ -228,33 +282,52 @@ func (pf *ProxyFile) Stat() (protocol.Stat, error) {
 		st.Mode |= protocol.DMDIR
 	}
 	st.Atime = uint32(pf.info.ModTime().Unix())
-	st.Mtime = st.Mtime
+	st.Mtime = st.Atime
 	st.Length = uint64(pf.info.Size())
-	st.Name = filepath.Base(pf.path)
-	st.UID = pf.user
-	st.GID = pf.user
-	st.MUID = pf.user
+	st.Name, _ = pf.Name()
+	// The host does not record who last modified a file, so the owner
+	// stands in.
+	st.UID, st.GID = pf.users.Owner(pf.info)
+	st.MUID = st.UID
 
 	return st, nil
 }
 
-func (pf *ProxyFile) Open(_ string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+func (pf *ProxyFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
 	if err := pf.updateInfo(); err != nil {
 		return nil, err
 	}
 	pf.cache(true)
 	defer pf.cache(false)
 
-	f, err := os.OpenFile(filepath.Join(pf.root, pf.path), openMode2Flag(mode), 0)
+	h := pf.users.host(user)
+	if !h.may(pf.info, mode) || (mode&protocol.OTRUNC != 0 && !h.may(pf.info, protocol.OWRITE)) {
+		return nil, fileserver.ErrPermission
+	}
+
+	fp := filepath.Join(pf.root, pf.path)
+	flag := openMode2Flag(mode)
+	var f *os.File
+	var err error
+	if pf.info.IsDir() && mode&3 == protocol.OEXEC {
+		// Searching was allowed above, while the host would want read
+		// permission to open the directory.
+		f, err = os.OpenFile(fp, flag, 0)
+	} else {
+		err = pf.users.as(h, func() error {
+			f, err = os.OpenFile(fp, flag, 0)
+			return err
+		})
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if p, _ := pf.IsDir(); p {
+	if pf.info.IsDir() {
 		return &ProxyOpenTree{
 			t:    pf,
 			f:    f,
-			path: filepath.Join(pf.root, pf.path),
+			path: fp,
 		}, nil
 	}
 
@@ -262,54 +335,166 @@ func (pf *ProxyFile) Open(_ string, mode protocol.OpenMode) (fileserver.OpenFile
 }
 
 func (pf *ProxyFile) CanRemove() (bool, error) {
-	return true, nil
+	isdir, err := pf.IsDir()
+	if err != nil {
+		return false, err
+	}
+	if !isdir {
+		return true, nil
+	}
+
+	f, err := os.Open(filepath.Join(pf.root, pf.path))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// A single entry is enough to know that the directory is not empty.
+	_, err = f.Readdirnames(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
 }
 
-func (pf *ProxyFile) Walk(_, name string) (fileserver.File, error) {
+// search returns the host user that user acts as, if it may search the
+// directory pf.
+func (pf *ProxyFile) search(user string) (hostUser, error) {
+	if err := pf.updateInfo(); err != nil {
+		return hostUser{}, err
+	}
+	h := pf.users.host(user)
+	if !h.may(pf.info, protocol.OEXEC) {
+		return hostUser{}, fileserver.ErrPermission
+	}
+	return h, nil
+}
+
+// change returns the host user that user acts as, if it may change the
+// directory pf.
+func (pf *ProxyFile) change(user string) (hostUser, error) {
+	h, err := pf.search(user)
+	if err != nil {
+		return hostUser{}, err
+	}
+	if !h.may(pf.info, protocol.OWRITE) {
+		return hostUser{}, fileserver.ErrPermission
+	}
+	return h, nil
+}
+
+// unlink returns the host user that user acts as, if it may remove or rename
+// the entry name in the directory pf. In a sticky directory, that is only
+// allowed to the owners of the entry and the directory.
+func (pf *ProxyFile) unlink(user, name string) (hostUser, error) {
+	h, err := pf.change(user)
+	if err != nil {
+		return hostUser{}, err
+	}
+	if pf.info.Mode()&os.ModeSticky == 0 || h.owns(pf.info) {
+		return h, nil
+	}
+	fi, err := os.Lstat(filepath.Join(pf.root, pf.path, name))
+	if err != nil {
+		return hostUser{}, err
+	}
+	if !h.owns(fi) {
+		return hostUser{}, fileserver.ErrPermission
+	}
+	return h, nil
+}
+
+func (pf *ProxyFile) Walk(user, name string) (fileserver.File, error) {
+	h, err := pf.search(user)
+	if err != nil {
+		return nil, err
+	}
 	p := filepath.Join(pf.path, name)
 
-	if _, err := os.Stat(filepath.Join(pf.root, p)); os.IsNotExist(err) {
+	err = pf.users.as(h, func() error {
+		_, err := os.Stat(filepath.Join(pf.root, p))
+		return err
+	})
+	if os.IsNotExist(err) {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
 
 	return &ProxyFile{
-		root: pf.root,
-		path: p,
+		root:  pf.root,
+		path:  p,
+		users: pf.users,
 	}, nil
 }
 
-func (pf *ProxyFile) Create(_, name string, perms protocol.FileMode) (fileserver.File, error) {
+func (pf *ProxyFile) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	h, err := pf.change(user)
+	if err != nil {
+		return nil, err
+	}
 	p := filepath.Join(pf.path, name)
-	if perms&protocol.DMDIR != 0 {
-		err := os.Mkdir(filepath.Join(pf.root, p), os.FileMode(perms&0777))
-		if err != nil {
-			return nil, err
+	fp := filepath.Join(pf.root, p)
+	err = pf.users.as(h, func() error {
+		if perms&protocol.DMDIR != 0 {
+			if err := os.Mkdir(fp, os.FileMode(perms&0777)); err != nil {
+				return err
+			}
+		} else {
+			f, err := os.OpenFile(fp, os.O_CREATE|os.O_EXCL, os.FileMode(perms&0777))
+			if err != nil {
+				return err
+			}
+			f.Close()
 		}
-	} else {
-		f, err := os.OpenFile(filepath.Join(pf.root, p), os.O_CREATE|os.O_EXCL, os.FileMode(perms&0777))
-		if err != nil {
-			return nil, err
+
+		// The permissions we were asked for are final, so the umask of the
+		// process must not get to trim them.
+		if err := os.Chmod(fp, os.FileMode(perms&0777)); err != nil {
+			os.Remove(fp)
+			return err
 		}
-		f.Close()
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return &ProxyFile{
-		root: pf.root,
-		path: p,
+		root:  pf.root,
+		path:  p,
+		users: pf.users,
 	}, nil
 }
 
-func (pf *ProxyFile) Remove(_, name string) error {
+func (pf *ProxyFile) Remove(user, name string) error {
+	h, err := pf.unlink(user, name)
+	if err != nil {
+		return err
+	}
 	p := filepath.Join(pf.path, name)
-	return os.Remove(filepath.Join(pf.root, p))
+	return pf.users.as(h, func() error {
+		return os.Remove(filepath.Join(pf.root, p))
+	})
 }
 
-func (pf *ProxyFile) Rename(_, oldname, newname string) error {
+func (pf *ProxyFile) Rename(user, oldname, newname string) error {
+	h, err := pf.unlink(user, oldname)
+	if err != nil {
+		return err
+	}
 	op := filepath.Join(pf.root, filepath.Join(pf.path, oldname))
 	np := filepath.Join(pf.root, filepath.Join(pf.path, newname))
-	return os.Rename(op, np)
+
+	return pf.users.as(h, func() error {
+		// os.Rename would quietly replace an existing file.
+		if _, err := os.Lstat(np); err == nil {
+			return fileserver.ErrExist
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return os.Rename(op, np)
+	})
 }
 
 func (pf *ProxyFile) IsDir() (bool, error) {
@@ -319,11 +504,12 @@ func (pf *ProxyFile) IsDir() (bool, error) {
 	return pf.info.IsDir(), nil
 }
 
-func NewProxyTree(root, path, user, group string) fileserver.Dir {
+// NewProxyTree returns a tree serving the host directory path under root,
+// with owners named through users.
+func NewProxyTree(root, path string, users *Users) fileserver.Dir {
 	return &ProxyFile{
 		root:  root,
 		path:  path,
-		user:  user,
-		group: group,
+		users: users,
 	}
 }
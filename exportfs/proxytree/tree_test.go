@@ -0,0 +1,198 @@
+package proxytree
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/fstest"
+)
+
+// ownedBy returns a Users in which the owner of dir goes by name. The owner
+// is mapped as the users file would, as the tests may run as root.
+func ownedBy(t *testing.T, dir, name string) *Users {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := NewUsers()
+	if uid, _, ok := fileOwner(fi); ok {
+		u.SetUser(uid, name)
+	}
+	if err := u.SetOwner(fi, name, name); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestConformance(t *testing.T) {
+	s := &fstest.Suite{
+		NewRoot: func(t *testing.T) fileserver.Dir {
+			dir := t.TempDir()
+			if err := os.Chmod(dir, 0777); err != nil {
+				t.Fatal(err)
+			}
+			return NewProxyTree(dir, "", ownedBy(t, dir, "glenda"))
+		},
+		User:  "glenda",
+		Other: "nobody",
+	}
+	s.Run(t)
+}
+
+func TestRename(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := NewProxyTree(dir, "", ownedBy(t, dir, "glenda"))
+	f, err := root.Walk("glenda", "a")
+	if err != nil || f == nil {
+		t.Fatalf("walk to a: %v", err)
+	}
+
+	// The entry is renamed in its directory before the file is given its
+	// new name in a wstat that changes nothing else.
+	if err := root.Rename("glenda", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	st := protocol.Stat{
+		Type:   ^uint16(0),
+		Dev:    ^uint32(0),
+		Mode:   ^protocol.FileMode(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+		Name:   "b",
+	}
+	if err := f.WriteStat(st); err != nil {
+		t.Fatalf("wstat after rename: %v", err)
+	}
+	if name, _ := f.Name(); name != "b" {
+		t.Fatalf("file is named %s after rename, expected b", name)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := f.Stat(); err != nil || got.Length != 5 {
+		t.Fatalf("stat after rename: %d bytes, %v", got.Length, err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	dir := t.TempDir()
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		t.Skip("file owners are not known on this system")
+	}
+
+	// other is unknown to the host, but in the group of the files, while
+	// stranger is neither and acts as nobody.
+	users := NewUsers()
+	users.SetUser(uid, "glenda")
+	users.SetUser(4242, "other")
+	users.SetGroup(gid, "other")
+	root := NewProxyTree(dir, "", users)
+	os.Chmod(dir, 0775)
+
+	if _, err := root.Create("stranger", "f", 0644); err != fileserver.ErrPermission {
+		t.Fatalf("create without permission: %v", err)
+	}
+	f, err := root.Create("glenda", "f", 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	of, err := f.Open("other", protocol.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	of.Close()
+	for _, tc := range []struct {
+		user string
+		mode protocol.OpenMode
+	}{
+		{"other", protocol.OWRITE},
+		{"other", protocol.OREAD | protocol.OTRUNC},
+		{"stranger", protocol.OREAD},
+	} {
+		if _, err := f.Open(tc.user, tc.mode); err != fileserver.ErrPermission {
+			t.Errorf("%s opened with mode %d without permission: %v", tc.user, tc.mode, err)
+		}
+	}
+
+	os.Chmod(dir, 0770)
+	if _, err := root.Walk("stranger", "f"); err != fileserver.ErrPermission {
+		t.Fatalf("walk without permission: %v", err)
+	}
+	if g, err := root.Walk("other", "f"); err != nil || g == nil {
+		t.Fatalf("walk by group member: %v", err)
+	}
+
+	// In a sticky directory, only the owners get to remove entries.
+	os.Chmod(dir, 0777|os.ModeSticky)
+	if err := root.Rename("other", "f", "g"); err != fileserver.ErrPermission {
+		t.Fatalf("rename in sticky directory: %v", err)
+	}
+	if err := root.Remove("other", "f"); err != fileserver.ErrPermission {
+		t.Fatalf("remove in sticky directory: %v", err)
+	}
+	if err := root.Remove("glenda", "f"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDropPrivileges(t *testing.T) {
+	users := NewUsers()
+	if err := users.SetDropPrivileges(true); err != nil {
+		t.Skip(err)
+	}
+	// other must be able to reach the directory on the host.
+	dir := t.TempDir()
+	os.Chmod(filepath.Dir(dir), 0755)
+	os.Chmod(dir, 0777)
+	users.SetUser(4242, "other")
+	users.SetGroup(4242, "other")
+	root := NewProxyTree(dir, "", users)
+
+	f, err := root.Create("other", "f", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid, gid, _ := fileOwner(fi); uid != 4242 || gid != 4242 {
+		t.Fatalf("file created by other owned by %d:%d, expected 4242:4242", uid, gid)
+	}
+	if st, _ := f.Stat(); st.UID != "other" {
+		t.Fatalf("file created by other owned by %s", st.UID)
+	}
+
+	// Only the owner on the host may change the mode, whatever 9P says.
+	g, err := root.Create("glenda", "g", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := protocol.Stat{Mode: 0644, Length: ^uint64(0), Mtime: ^uint32(0)}
+	if err := g.(*ProxyFile).WriteStatAs("other", st); err == nil {
+		t.Fatal("other changed the mode of a file it does not own")
+	}
+	if err := g.(*ProxyFile).WriteStatAs("glenda", st); err != nil {
+		t.Fatal(err)
+	}
+
+	// Owning a file is not enough to remove it.
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Remove("other", "f"); err != fileserver.ErrPermission {
+		t.Fatalf("remove without permission: %v", err)
+	}
+}
@@ -0,0 +1,427 @@
+package proxytree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// Users translates the ids of host users and groups to the names they go by
+// in 9P. An id is looked up in the mapping table first, and then in the user
+// database of the host. Ids that are in neither are given the fallback name
+// if one is set, or the id itself as a name.
+//
+// The other way around, Users tells which host user a 9P user acts as when
+// permissions are checked, and with SetDropPrivileges, when the host is
+// accessed.
+type Users struct {
+	mu     sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+
+	// hostUsers and hostGroups cache lookups in the user database, with ""
+	// for ids it does not know.
+	hostUsers  map[uint32]string
+	hostGroups map[uint32]string
+
+	// acting caches the host users that 9P users act as.
+	acting map[string]hostUser
+
+	unknownUser  string
+	unknownGroup string
+
+	// self is who the server runs as, for when privileges are dropped.
+	self *hostUser
+}
+
+// hostUser is a host user, with the groups it belongs to.
+type hostUser struct {
+	uid  uint32
+	gid  uint32
+	gids []uint32
+}
+
+// nobody is the host user that 9P users unknown to the host act as, should
+// the host have no user by that name.
+var nobody = hostUser{uid: 65534, gid: 65534, gids: []uint32{65534}}
+
+var errNoDrop = errors.New("dropping privileges needs a Linux host and the server to run as root")
+
+// NewUsers returns a Users with an empty mapping table.
+func NewUsers() *Users {
+	return &Users{
+		users:      make(map[uint32]string),
+		groups:     make(map[uint32]string),
+		hostUsers:  make(map[uint32]string),
+		hostGroups: make(map[uint32]string),
+		acting:     make(map[string]hostUser),
+	}
+}
+
+// SetUser makes the host user uid go by name.
+func (u *Users) SetUser(uid uint32, name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.users[uid] = name
+	u.acting = make(map[string]hostUser)
+}
+
+// SetGroup makes the host group gid go by name.
+func (u *Users) SetGroup(gid uint32, name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.groups[gid] = name
+	u.acting = make(map[string]hostUser)
+}
+
+// SetUnknown sets the names given to users and groups that are neither in
+// the table nor known to the host. Empty names leave the id as the name.
+func (u *Users) SetUnknown(user, group string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.unknownUser = user
+	u.unknownGroup = group
+}
+
+// SetOwner makes the user and group owning the file described by fi go by
+// user and group. Where the owner of a file cannot be told, they become the
+// fallback names instead. A file owned by root is refused unless the table
+// already maps root to user, as the name would otherwise act as root.
+func (u *Users) SetOwner(fi os.FileInfo, user, group string) error {
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		u.SetUnknown(user, group)
+		return nil
+	}
+	if uid == 0 {
+		u.mu.Lock()
+		name, mapped := u.users[0]
+		u.mu.Unlock()
+		if !mapped || name != user {
+			return fmt.Errorf("%s is owned by root, which the users file must map to %s", fi.Name(), user)
+		}
+	}
+	u.SetUser(uid, user)
+	u.SetGroup(gid, group)
+	return nil
+}
+
+// SetDropPrivileges sets whether the host is accessed with the file system
+// credentials of the host user that the 9P user acts as, rather than those of
+// the server, for every operation. This needs the server to run as root on
+// Linux.
+func (u *Users) SetDropPrivileges(drop bool) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !drop {
+		u.self = nil
+		return nil
+	}
+	if !canDropPrivileges || os.Geteuid() != 0 {
+		return errNoDrop
+	}
+	gids, err := os.Getgroups()
+	if err != nil {
+		return err
+	}
+	self := &hostUser{uid: uint32(os.Geteuid()), gid: uint32(os.Getegid())}
+	for _, gid := range gids {
+		self.gids = append(self.gids, uint32(gid))
+	}
+	u.self = self
+	return nil
+}
+
+// Load adds the mappings in the file at path to the table. Every line maps a
+// host user or group, by id or by name, to a 9P name:
+//
+//	user 1000 glenda
+//	group wheel sys
+//
+// A host id of * sets the fallback name instead. Text after a # is ignored.
+func (u *Users) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("%s:%d: expected user or group, host id and name", path, n)
+		}
+		kind, host, name := fields[0], fields[1], fields[2]
+
+		var lookup func(string) (uint32, error)
+		switch kind {
+		case "user":
+			lookup = lookupUser
+		case "group":
+			lookup = lookupGroup
+		default:
+			return fmt.Errorf("%s:%d: unknown mapping %q", path, n, kind)
+		}
+
+		if host == "*" {
+			u.mu.Lock()
+			if kind == "user" {
+				u.unknownUser = name
+			} else {
+				u.unknownGroup = name
+			}
+			u.mu.Unlock()
+			continue
+		}
+		id, err := lookup(host)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+		if kind == "user" {
+			u.SetUser(id, name)
+		} else {
+			u.SetGroup(id, name)
+		}
+	}
+	return s.Err()
+}
+
+// User returns the name of the host user uid.
+func (u *Users) User(uid uint32) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if name, ok := u.users[uid]; ok {
+		return name
+	}
+	name, ok := u.hostUsers[uid]
+	if !ok {
+		if hu, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+			name = hu.Username
+		}
+		u.hostUsers[uid] = name
+	}
+	return fallback(name, u.unknownUser, uid)
+}
+
+// Group returns the name of the host group gid.
+func (u *Users) Group(gid uint32) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if name, ok := u.groups[gid]; ok {
+		return name
+	}
+	name, ok := u.hostGroups[gid]
+	if !ok {
+		if hg, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+			name = hg.Name
+		}
+		u.hostGroups[gid] = name
+	}
+	return fallback(name, u.unknownGroup, gid)
+}
+
+// Owner returns the names of the user and group owning the file described by
+// fi.
+func (u *Users) Owner(fi os.FileInfo) (string, string) {
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		return fallback("", u.unknownUser, 0), fallback("", u.unknownGroup, 0)
+	}
+	return u.User(uid), u.Group(gid)
+}
+
+// host returns the host user that the 9P user name acts as: the user mapped
+// to name in the table, or failing that the host user by that name. Names
+// that are neither act as nobody, as do names of host users with uid 0 that
+// the table does not map, so that root cannot be had by just claiming its
+// name.
+func (u *Users) host(name string) hostUser {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if h, ok := u.acting[name]; ok {
+		return h
+	}
+
+	h, ok := u.lookupHost(name)
+	if !ok {
+		if h, ok = u.lookupHost("nobody"); !ok {
+			h = nobody
+		}
+	}
+	u.acting[name] = h
+	return h
+}
+
+// lookupHost returns the host user that name is mapped to in the table, or
+// the host user by that name. Users only in the table belong to the groups
+// mapped to the same name.
+func (u *Users) lookupHost(name string) (hostUser, bool) {
+	var h hostUser
+	mapped := false
+	for uid, n := range u.users {
+		// Of several ids mapped to one name, the lowest is used, so
+		// that the choice is always the same.
+		if n == name && (!mapped || uid < h.uid) {
+			h.uid = uid
+			mapped = true
+		}
+	}
+
+	var hu *user.User
+	var err error
+	if mapped {
+		hu, err = user.LookupId(strconv.FormatUint(uint64(h.uid), 10))
+	} else {
+		hu, err = user.Lookup(name)
+	}
+	if err != nil {
+		if !mapped {
+			return hostUser{}, false
+		}
+		for gid, n := range u.groups {
+			if n == name {
+				h.gids = append(h.gids, gid)
+			}
+		}
+		if len(h.gids) > 0 {
+			sort.Slice(h.gids, func(i, j int) bool { return h.gids[i] < h.gids[j] })
+			h.gid = h.gids[0]
+		} else {
+			h.gid, h.gids = nobody.gid, []uint32{nobody.gid}
+		}
+		return h, true
+	}
+
+	uid, err := strconv.ParseUint(hu.Uid, 10, 32)
+	if err != nil {
+		return hostUser{}, false
+	}
+	gid, err := strconv.ParseUint(hu.Gid, 10, 32)
+	if err != nil {
+		return hostUser{}, false
+	}
+	if uid == 0 && !mapped {
+		return hostUser{}, false
+	}
+	h.uid, h.gid = uint32(uid), uint32(gid)
+	h.gids = []uint32{h.gid}
+	if ids, err := hu.GroupIds(); err == nil {
+		for _, id := range ids {
+			if gid, err := strconv.ParseUint(id, 10, 32); err == nil && uint32(gid) != h.gid {
+				h.gids = append(h.gids, uint32(gid))
+			}
+		}
+	}
+	return h, true
+}
+
+// as runs fn, with the file system credentials of h if privileges are
+// dropped.
+func (u *Users) as(h hostUser, fn func() error) error {
+	u.mu.Lock()
+	self := u.self
+	u.mu.Unlock()
+	if self == nil {
+		return fn()
+	}
+	return asUser(h, *self, fn)
+}
+
+// may reports whether h is granted the access requested by mode to the file
+// described by fi, by the Unix rules: root may do anything but execute files
+// that nobody may execute, and everyone else gets the permissions of the one
+// class, owner, group or others, it is in. Where the owner of a file cannot
+// be told, everyone is taken to own it.
+func (h hostUser) may(fi os.FileInfo, mode protocol.OpenMode) bool {
+	perms := protocol.FileMode(fi.Mode() & 0777)
+	if h.uid == 0 {
+		if mode&3 == protocol.OEXEC && !fi.IsDir() {
+			return perms&0111 != 0
+		}
+		return true
+	}
+
+	uid, gid, ok := fileOwner(fi)
+	switch {
+	case !ok || uid == h.uid:
+		return permCheck(6, perms, mode)
+	case h.member(gid):
+		return permCheck(3, perms, mode)
+	default:
+		return permCheck(0, perms, mode)
+	}
+}
+
+// member reports whether h belongs to the group gid.
+func (h hostUser) member(gid uint32) bool {
+	for _, g := range h.gids {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// owns reports whether h owns the file described by fi, or may act as if it
+// did.
+func (h hostUser) owns(fi os.FileInfo) bool {
+	uid, _, ok := fileOwner(fi)
+	return h.uid == 0 || !ok || uid == h.uid
+}
+
+// fallback returns name, or the name of unknown ids if it is empty, or
+// failing that the id itself.
+func fallback(name, unknown string, id uint32) string {
+	switch {
+	case name != "":
+		return name
+	case unknown != "":
+		return unknown
+	default:
+		return strconv.FormatUint(uint64(id), 10)
+	}
+}
+
+// lookupUser returns the uid of the host user s, given by id or by name.
+func lookupUser(s string) (uint32, error) {
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	hu, err := user.Lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(hu.Uid, 10, 32)
+	return uint32(id), err
+}
+
+// lookupGroup returns the gid of the host group s, given by id or by name.
+func lookupGroup(s string) (uint32, error) {
+	if id, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	hg, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(hg.Gid, 10, 32)
+	return uint32(id), err
+}
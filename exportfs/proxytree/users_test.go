@@ -0,0 +1,104 @@
+package proxytree
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestUsers(t *testing.T) {
+	dir := t.TempDir()
+	table := filepath.Join(dir, "users")
+	os.WriteFile(table, []byte("# host 9p\nuser 4242 glenda\ngroup 4242 sys # comment\ngroup * none\n"), 0600)
+
+	u := NewUsers()
+	if err := u.Load(table); err != nil {
+		t.Fatal(err)
+	}
+	if name := u.User(4242); name != "glenda" {
+		t.Errorf("user 4242 is %q, expected glenda", name)
+	}
+	if name := u.Group(4242); name != "sys" {
+		t.Errorf("group 4242 is %q, expected sys", name)
+	}
+	// Ids that no host should know fall back.
+	if name := u.User(4243424); name != "4243424" {
+		t.Errorf("unknown user is %q, expected its id", name)
+	}
+	if name := u.Group(4243424); name != "none" {
+		t.Errorf("unknown group is %q, expected none", name)
+	}
+
+	for _, bad := range []string{"user 1000\n", "owner 1000 glenda\n", "user no-such-user-here glenda\n"} {
+		os.WriteFile(table, []byte(bad), 0600)
+		if err := NewUsers().Load(table); err == nil {
+			t.Errorf("%q loaded", bad)
+		}
+	}
+}
+
+func TestStatOwner(t *testing.T) {
+	dir := t.TempDir()
+	fi, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		t.Skip("file owners are not known on this system")
+	}
+
+	u := NewUsers()
+	u.SetUser(uid, "glenda")
+	u.SetGroup(gid, "sys")
+	root := NewProxyTree(dir, "", u)
+	f, err := root.Create("glenda", "file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.UID != "glenda" || st.GID != "sys" || st.MUID != "glenda" {
+		t.Fatalf("file owned by %s, %s, %s, expected glenda, sys, glenda", st.UID, st.GID, st.MUID)
+	}
+}
+
+func TestHostRoot(t *testing.T) {
+	if hu, err := user.LookupId("0"); err != nil {
+		t.Skip(err)
+	} else if h := NewUsers().host(hu.Username); h.uid == 0 {
+		t.Fatalf("%s acts as root without being mapped", hu.Username)
+	}
+
+	u := NewUsers()
+	u.SetUser(0, "glenda")
+	if h := u.host("glenda"); h.uid != 0 {
+		t.Fatalf("glenda mapped to root acts as uid %d", h.uid)
+	}
+}
+
+func TestRootOwner(t *testing.T) {
+	fi, err := os.Stat("/")
+	if err != nil {
+		t.Skip(err)
+	}
+	if uid, _, ok := fileOwner(fi); !ok || uid != 0 {
+		t.Skip("/ is not owned by root")
+	}
+
+	u := NewUsers()
+	if err := u.SetOwner(fi, "glenda", "sys"); err == nil {
+		t.Fatal("root mapped to glenda without the users file")
+	}
+	if h := u.host("glenda"); h.uid == 0 {
+		t.Fatal("glenda acts as root without being mapped")
+	}
+
+	u.SetUser(0, "glenda")
+	if err := u.SetOwner(fi, "glenda", "sys"); err != nil {
+		t.Fatal(err)
+	}
+}
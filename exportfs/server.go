@@ -1,42 +1,111 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 
-	"github.com/kennylevinsen/g9p"
 	"github.com/kennylevinsen/g9ptools/exportfs/proxytree"
 	"github.com/kennylevinsen/g9ptools/fileserver"
 )
 
+var (
+	usersFile = flag.String("users", "", "file mapping host users and groups to 9P names, as lines such as \"user 1000 glenda\" or \"group * none\"")
+	dropPrivs = flag.Bool("drop-privileges", false, "access the host as the host user that the attaching user acts as, which needs the server to run as root on Linux, and -peercred or -tls-client-ca")
+	peerCred  = flag.Bool("peercred", false, "attach as the user on the other end of a Unix domain socket, whatever the client claims")
+
+	tlsCert     = flag.String("tls-cert", "", "PEM file with the certificate to serve a TCP address over TLS with")
+	tlsKey      = flag.String("tls-key", "", "PEM file with the key of the -tls-cert certificate")
+	tlsClientCA = flag.String("tls-client-ca", "", "PEM file with the authorities that must sign client certificates, whose common name is then the user attached as")
+)
+
 func main() {
-	if len(os.Args) < 6 {
+	flag.Usage = func() {
+		fmt.Printf("%s [options] path service UID GID address\n", os.Args[0])
+		fmt.Printf("UID and GID are the names of the user/group that owns /\n")
+		fmt.Printf("Other files are owned by the names of their host users and groups\n")
+		fmt.Printf("Attaching users get the host permissions of the host users of their names\n")
+		fmt.Printf("address is such as tcp!*!564, unix!/tmp/exportfs or ns!exportfs\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 5 {
 		fmt.Printf("Too few arguments\n")
-		fmt.Printf("%s path service UID GID address\n", os.Args[0])
-		fmt.Printf("UID and GID are the user/group that owns /\n")
+		flag.Usage()
 		return
 	}
 
-	path := os.Args[1]
-	service := os.Args[2]
-	user := os.Args[3]
-	group := os.Args[4]
-	addr := os.Args[5]
+	// Without authenticated names, anyone could attach as whoever they
+	// liked, and be given that user's host credentials.
+	if *dropPrivs && !*peerCred && *tlsClientCA == "" {
+		log.Fatalf("-drop-privileges needs -peercred or -tls-client-ca")
+	}
+
+	path := flag.Arg(0)
+	service := flag.Arg(1)
+	user := flag.Arg(2)
+	group := flag.Arg(3)
+	addr := flag.Arg(4)
 
-	root := proxytree.NewProxyTree(path, "", user, group)
-	l, err := net.Listen("tcp", addr)
+	users := proxytree.NewUsers()
+	if *usersFile != "" {
+		if err := users.Load(*usersFile); err != nil {
+			log.Fatalf("Unable to load users: %v", err)
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Fatalf("Unable to export %s: %v", path, err)
+	}
+	if err := users.SetOwner(fi, user, group); err != nil {
+		log.Fatalf("Unable to export %s: %v", path, err)
+	}
+	if err := users.SetDropPrivileges(*dropPrivs); err != nil {
+		log.Fatalf("Unable to drop privileges: %v", err)
+	}
+
+	root := proxytree.NewProxyTree(path, "", users)
+	l, err := fileserver.Listen(addr)
 	if err != nil {
 		log.Fatalf("Unable to listen: %v", err)
 	}
 
-	h := func() g9p.Handler {
+	h := func() *fileserver.FileServer {
 		m := make(map[string]fileserver.Dir)
 		m[service] = root
 		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Obnoxious)
 	}
 
+	serve := fileserver.ServeListener
+	if *peerCred {
+		if _, ok := l.(*net.UnixListener); !ok {
+			log.Fatalf("-peercred needs a Unix domain socket")
+		}
+		serve = fileserver.ServePeerCred
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		if _, ok := l.(*net.TCPListener); !ok {
+			log.Fatalf("TLS needs a TCP address")
+		}
+		config, err := fileserver.TLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			log.Fatalf("Unable to set up TLS: %v", err)
+		}
+		l = tls.NewListener(l, config)
+		if *tlsClientCA != "" {
+			serve = fileserver.ServePeerCred
+		}
+	} else if *tlsClientCA != "" {
+		log.Fatalf("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+
 	log.Printf("Starting proxy at %s", addr)
-	g9p.ServeListener(l, h)
+	if err := serve(l, h); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Fatalf("Unable to serve: %v", err)
+	}
 }
@@ -0,0 +1,180 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// Error is an error with a well-known meaning. It is sent to clients as the
+// canonical Plan 9 error string, and carries the Linux errno used for it by
+// the 9P2000.u and 9P2000.L dialects.
+type Error struct {
+	msg   string
+	errno uint32
+	is    error
+}
+
+func (e *Error) Error() string {
+	return e.msg
+}
+
+// Errno returns the errno value for the error.
+func (e *Error) Errno() uint32 {
+	return e.errno
+}
+
+// Is makes the errors that have an equivalent in io/fs match it, so that
+// errors.Is(err, fs.ErrNotExist) works as expected.
+func (e *Error) Is(target error) bool {
+	return e.is != nil && e.is == target
+}
+
+// Linux errno values, as used on the wire by 9P2000.u and 9P2000.L.
+const (
+	eperm     = 1
+	enoent    = 2
+	eio       = 5
+	ebadf     = 9
+	eagain    = 11
+	eacces    = 13
+	ebusy     = 16
+	eexist    = 17
+	enotdir   = 20
+	eisdir    = 21
+	einval    = 22
+	efbig     = 27
+	enospc    = 28
+	erofs     = 30
+	enotempty = 39
+	enotsup   = 95
+	edquot    = 122
+)
+
+var (
+	ErrNotExist     = &Error{"file does not exist", enoent, fs.ErrNotExist}
+	ErrExist        = &Error{"file already exists", eexist, fs.ErrExist}
+	ErrPermission   = &Error{"permission denied", eacces, fs.ErrPermission}
+	ErrNotDir       = &Error{"not a directory", enotdir, nil}
+	ErrIsDir        = &Error{"is a directory", eisdir, nil}
+	ErrNotEmpty     = &Error{"directory not empty", enotempty, nil}
+	ErrBadName      = &Error{"file name syntax", einval, nil}
+	ErrInvalid      = &Error{"bad arg in system call", einval, fs.ErrInvalid}
+	ErrUnknownFid   = &Error{"unknown fid", ebadf, nil}
+	ErrFidInUse     = &Error{"fid already in use", ebadf, nil}
+	ErrOpen         = &Error{"file already open", ebusy, nil}
+	ErrNotOpen      = &Error{"file not open", ebadf, fs.ErrClosed}
+	ErrBadUse       = &Error{"inappropriate use of fid", ebadf, nil}
+	ErrIllegal      = &Error{"illegal wstat", eperm, nil}
+	ErrTooLarge     = &Error{"file too large", efbig, nil}
+	ErrNoSpace      = &Error{"file system full", enospc, nil}
+	ErrQuota        = &Error{"quota exceeded", edquot, nil}
+	ErrReadOnly     = &Error{"read-only file system", erofs, nil}
+	ErrNotSupported = &Error{"operation not supported", enotsup, nil}
+	ErrLocked       = &Error{"file is locked", eagain, nil}
+	ErrNoService    = &Error{"no such service", enoent, nil}
+	ErrTagInUse     = &Error{"tag already in use", ebusy, nil}
+)
+
+// knownErrors lists the typed errors. Where several share an errno, the
+// first one is what the errno maps back to.
+var knownErrors = []*Error{
+	ErrNotExist,
+	ErrExist,
+	ErrPermission,
+	ErrNotDir,
+	ErrIsDir,
+	ErrNotEmpty,
+	ErrInvalid,
+	ErrBadName,
+	ErrUnknownFid,
+	ErrFidInUse,
+	ErrOpen,
+	ErrNotOpen,
+	ErrBadUse,
+	ErrIllegal,
+	ErrTooLarge,
+	ErrNoSpace,
+	ErrQuota,
+	ErrReadOnly,
+	ErrNotSupported,
+	ErrLocked,
+	ErrNoService,
+	ErrTagInUse,
+}
+
+// hostErrors maps errors from the host operating system to our own. The
+// errnos come first, as some of them also match the io/fs errors, such as
+// ENOTEMPTY matching fs.ErrExist.
+var hostErrors = []struct {
+	host error
+	err  *Error
+}{
+	{syscall.ENOTDIR, ErrNotDir},
+	{syscall.EISDIR, ErrIsDir},
+	{syscall.ENOTEMPTY, ErrNotEmpty},
+	{syscall.EINVAL, ErrInvalid},
+	{syscall.EFBIG, ErrTooLarge},
+	{syscall.ENOSPC, ErrNoSpace},
+	{syscall.EDQUOT, ErrQuota},
+	{syscall.EROFS, ErrReadOnly},
+	{fs.ErrNotExist, ErrNotExist},
+	{fs.ErrExist, ErrExist},
+	{fs.ErrPermission, ErrPermission},
+}
+
+// Canonical returns the typed error matching err, so that errors from the
+// host, such as those returned by the os package, are reported to clients
+// with the canonical error string. Errors that cannot be recognised are
+// returned unchanged.
+func Canonical(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	for _, h := range hostErrors {
+		if errors.Is(err, h.host) {
+			return h.err
+		}
+	}
+
+	return err
+}
+
+// Errno returns the errno value that represents err in the 9P2000.u and
+// 9P2000.L dialects. Errors that cannot be recognised map to EIO.
+func Errno(err error) uint32 {
+	var e *Error
+	if errors.As(Canonical(err), &e) {
+		return e.errno
+	}
+	return eio
+}
+
+// ErrorFromErrno returns the typed error for an errno value received from a
+// 9P2000.u or 9P2000.L server.
+func ErrorFromErrno(errno uint32) error {
+	for _, e := range knownErrors {
+		if e.errno == errno {
+			return e
+		}
+	}
+	return fmt.Errorf("unknown errno %d", errno)
+}
+
+// ParseError returns the typed error for an error string received in an
+// error response, or a plain error carrying the string if it is unknown.
+func ParseError(s string) error {
+	for _, e := range knownErrors {
+		if e.msg == s {
+			return e
+		}
+	}
+	return errors.New(s)
+}
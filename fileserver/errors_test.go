@@ -0,0 +1,99 @@
+package fileserver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	_, err := os.Open(filepath.Join(t.TempDir(), "missing"))
+	for _, tc := range []struct {
+		err      error
+		expected error
+	}{
+		{nil, nil},
+		{ErrLocked, ErrLocked},
+		{fmt.Errorf("walk: %w", ErrNotDir), ErrNotDir},
+		{err, ErrNotExist},
+		{&fs.PathError{Op: "mkdir", Path: "x", Err: syscall.ENOTEMPTY}, ErrNotEmpty},
+		{syscall.EROFS, ErrReadOnly},
+	} {
+		if got := Canonical(tc.err); got != tc.expected {
+			t.Errorf("Canonical(%v) = %v, expected %v", tc.err, got, tc.expected)
+		}
+	}
+
+	// What is not recognised is passed on as it is.
+	unknown := errors.New("out of paper")
+	if got := Canonical(unknown); got != unknown {
+		t.Errorf("Canonical(%v) = %v", unknown, got)
+	}
+}
+
+func TestParseError(t *testing.T) {
+	for _, e := range knownErrors {
+		if got := ParseError(e.Error()); got != e {
+			t.Errorf("ParseError(%q) = %v", e.Error(), got)
+		}
+	}
+	if err := ParseError("out of paper"); err.Error() != "out of paper" || errors.As(err, new(*Error)) {
+		t.Errorf("ParseError of an unknown string = %#v", err)
+	}
+}
+
+func TestErrorIs(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		target error
+		is     bool
+	}{
+		{ErrNotExist, fs.ErrNotExist, true},
+		{ErrPermission, fs.ErrPermission, true},
+		{fmt.Errorf("open: %w", ErrExist), fs.ErrExist, true},
+		{ErrNotOpen, fs.ErrClosed, true},
+		{ErrNotExist, fs.ErrExist, false},
+		{ErrQuota, fs.ErrPermission, false},
+		{ErrBadName, ErrInvalid, false},
+	} {
+		if got := errors.Is(tc.err, tc.target); got != tc.is {
+			t.Errorf("errors.Is(%v, %v) = %v", tc.err, tc.target, got)
+		}
+	}
+}
+
+func TestErrno(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		errno uint32
+	}{
+		{ErrNotExist, enoent},
+		{fmt.Errorf("create: %w", ErrExist), eexist},
+		{&fs.PathError{Op: "rmdir", Path: "x", Err: syscall.ENOTEMPTY}, enotempty},
+		{ErrNoService, enoent},
+		{errors.New("out of paper"), eio},
+	} {
+		if got := Errno(tc.err); got != tc.errno {
+			t.Errorf("Errno(%v) = %d, expected %d", tc.err, got, tc.errno)
+		}
+	}
+
+	// Every errno maps back to an error carrying it, and to the first one
+	// listed where it is shared.
+	for _, e := range knownErrors {
+		got := ErrorFromErrno(e.Errno())
+		if ge, ok := got.(*Error); !ok || ge.Errno() != e.Errno() {
+			t.Errorf("ErrorFromErrno(%d) = %v, expected an error with that errno", e.Errno(), got)
+		}
+	}
+	if got := ErrorFromErrno(enoent); got != ErrNotExist {
+		t.Errorf("ErrorFromErrno(ENOENT) = %v", got)
+	}
+	if got := ErrorFromErrno(4242); errors.As(got, new(*Error)) {
+		t.Errorf("ErrorFromErrno of an unknown errno = %#v", got)
+	}
+}
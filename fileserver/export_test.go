@@ -0,0 +1,66 @@
+package fileserver
+
+import (
+	"fmt"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// CheckInvariants verifies the internal state of the FileServer between
+// requests.
+func CheckInvariants(fs *FileServer) error {
+	fs.tagLock.Lock()
+	tags, cancels := len(fs.tags), len(fs.cancels)
+	fs.tagLock.Unlock()
+	if tags != 0 {
+		return fmt.Errorf("%d tags registered with no request in flight", tags)
+	}
+	if cancels != 0 {
+		return fmt.Errorf("%d blocking requests left with none in flight", cancels)
+	}
+
+	fs.fidLock.RLock()
+	defer fs.fidLock.RUnlock()
+	for fid, s := range fs.Fids {
+		if err := checkState(fs, fid, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkState(fs *FileServer, fid protocol.Fid, s *State) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if len(s.location) == 0 {
+		return fmt.Errorf("fid %d: empty location", fid)
+	}
+	root := s.location[0]
+	if root != File(fs.Root) {
+		found := false
+		for _, r := range fs.Roots {
+			if root == File(r) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("fid %d: location does not start at a root", fid)
+		}
+	}
+	for i, f := range s.location {
+		if f == nil {
+			return fmt.Errorf("fid %d: nil element %d in location", fid, i)
+		}
+	}
+	if s.open == nil && (s.dir || s.dirOffset != 0 || len(s.dirBuf) != 0) {
+		return fmt.Errorf("fid %d: directory read state on a fid that is not open", fid)
+	}
+	if s.open != nil {
+		isdir, err := s.location.Current().IsDir()
+		if err == nil && isdir != s.dir {
+			return fmt.Errorf("fid %d: open with dir %v, but IsDir is %v", fid, s.dir, isdir)
+		}
+	}
+	return nil
+}
@@ -1,8 +1,8 @@
 package fileserver
 
 import (
-	"errors"
-	"fmt"
+	"context"
+	"encoding/binary"
 	"io"
 	"log"
 	"sync"
@@ -24,6 +24,14 @@ const (
 
 const (
 	DefaultMaxSize = (1024 * 1024 * 1024)
+
+	// MaxWalkElements is the maximum number of names in a single walk
+	// request, as given by MAXWELEM in the protocol.
+	MaxWalkElements = 16
+
+	// IOHeaderSize is the space reserved for the message header in reads
+	// and writes, as given by IOHDRSZ in the protocol.
+	IOHeaderSize = 24
 )
 
 type State struct {
@@ -34,6 +42,22 @@ type State struct {
 	mode     protocol.OpenMode
 	service  string
 	username string
+
+	// Directory reads must return whole entries, so what did not fit in the
+	// previous read is kept until the next.
+	dir       bool
+	dirOffset uint64
+	dirBuf    []byte
+
+	// Reads that may block are cancelled when the fid is clunked, which
+	// must not wait for the lock of the state to do so.
+	pendingLock sync.Mutex
+	pending     map[protocol.Tag]context.CancelFunc
+	closing     bool
+
+	// clunked is set once the fid is gone, for the requests that found the
+	// state before then and were waiting for its lock.
+	clunked bool
 }
 
 type FileServer struct {
@@ -42,11 +66,20 @@ type FileServer struct {
 	Root   Dir
 	Chatty Verbosity
 
+	// User, if not empty, is the user every attach is made as, whatever the
+	// client claims.
+	User string
+
 	MaxSize uint32
+
+	// maxSize is the largest message size agreed to, as configured.
+	maxSize uint32
+
 	fidLock sync.RWMutex
 	Fids    map[protocol.Fid]*State
 	tagLock sync.Mutex
 	tags    map[protocol.Tag]bool
+	cancels map[protocol.Tag]context.CancelFunc
 }
 
 func (fs *FileServer) logreq(d protocol.Message) {
@@ -81,7 +114,7 @@ func (fs *FileServer) register(d protocol.Message) error {
 
 	t := d.GetTag()
 	if _, ok := fs.tags[t]; ok {
-		return fmt.Errorf("tag already in use")
+		return ErrTagInUse
 	}
 
 	fs.tags[t] = true
@@ -95,6 +128,98 @@ func (fs *FileServer) flush(t protocol.Tag) {
 	if _, ok := fs.tags[t]; ok {
 		delete(fs.tags, t)
 	}
+	if cancel, ok := fs.cancels[t]; ok {
+		cancel()
+		delete(fs.cancels, t)
+	}
+}
+
+// cancellable returns a context for a request on s that may block. It is
+// cancelled when the request is flushed or the fid clunked, and the returned
+// function must be called once the request is done.
+func (fs *FileServer) cancellable(tag protocol.Tag, s *State) (context.Context, func(), error) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.pendingLock.Lock()
+	if s.closing {
+		s.pendingLock.Unlock()
+		cancel()
+		return nil, nil, ErrNotOpen
+	}
+	if s.pending == nil {
+		s.pending = make(map[protocol.Tag]context.CancelFunc)
+	}
+	s.pending[tag] = cancel
+	s.pendingLock.Unlock()
+
+	// The request may have been flushed already.
+	fs.tagLock.Lock()
+	if _, ok := fs.tags[tag]; ok {
+		fs.cancels[tag] = cancel
+	} else {
+		cancel()
+	}
+	fs.tagLock.Unlock()
+
+	done := func() {
+		fs.tagLock.Lock()
+		delete(fs.cancels, tag)
+		fs.tagLock.Unlock()
+
+		s.pendingLock.Lock()
+		delete(s.pending, tag)
+		s.pendingLock.Unlock()
+		cancel()
+	}
+	return ctx, done, nil
+}
+
+// interrupt cancels the blocking requests on s, which is about to be
+// clunked, and keeps new ones from starting.
+func (s *State) interrupt() {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+	s.closing = true
+	for _, cancel := range s.pending {
+		cancel()
+	}
+}
+
+// state returns the state of fid, locked. The fids are not locked while
+// waiting for the state, which a blocked read or write may hold until the
+// fid is clunked.
+func (fs *FileServer) state(fid protocol.Fid) (*State, error) {
+	fs.fidLock.RLock()
+	s, ok := fs.Fids[fid]
+	fs.fidLock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownFid
+	}
+
+	s.Lock()
+	if s.clunked {
+		s.Unlock()
+		return nil, ErrUnknownFid
+	}
+	return s, nil
+}
+
+// release takes the state of fid out of the fids and locks it, so that it
+// can be clunked. Blocking requests on it are cancelled first, as they hold
+// the lock.
+func (fs *FileServer) release(fid protocol.Fid) (*State, error) {
+	fs.fidLock.Lock()
+	s, ok := fs.Fids[fid]
+	delete(fs.Fids, fid)
+	fs.fidLock.Unlock()
+	if !ok {
+		return nil, ErrUnknownFid
+	}
+
+	s.interrupt()
+	s.Lock()
+	s.clunked = true
+	return s, nil
 }
 
 func (fs *FileServer) flushed(d protocol.Message) bool {
@@ -112,6 +237,7 @@ func (fs *FileServer) flushed(d protocol.Message) bool {
 func (fs *FileServer) Version(r *protocol.VersionRequest) (resp *protocol.VersionResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -122,12 +248,21 @@ func (fs *FileServer) Version(r *protocol.VersionRequest) (resp *protocol.Versio
 
 	fs.logreq(r)
 
+	// A version request starts a new session, so whatever fids are left
+	// from the old one are clunked.
+	fs.Close()
+
 	fs.Lock()
 	defer fs.Unlock()
-	if r.MaxSize < DefaultMaxSize {
+
+	limit := fs.maxSize
+	if limit == 0 || limit > DefaultMaxSize {
+		limit = DefaultMaxSize
+	}
+	if r.MaxSize < limit {
 		fs.MaxSize = r.MaxSize
 	} else {
-		fs.MaxSize = DefaultMaxSize
+		fs.MaxSize = limit
 	}
 
 	proto := "9P2000"
@@ -146,6 +281,7 @@ func (fs *FileServer) Version(r *protocol.VersionRequest) (resp *protocol.Versio
 func (fs *FileServer) Auth(r *protocol.AuthRequest) (resp *protocol.AuthResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -156,12 +292,13 @@ func (fs *FileServer) Auth(r *protocol.AuthRequest) (resp *protocol.AuthResponse
 
 	fs.logreq(r)
 
-	return nil, fmt.Errorf("auth not supported")
+	return nil, ErrNotSupported
 }
 
 func (fs *FileServer) Attach(r *protocol.AttachRequest) (resp *protocol.AttachResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -175,7 +312,7 @@ func (fs *FileServer) Attach(r *protocol.AttachRequest) (resp *protocol.AttachRe
 	defer fs.fidLock.Unlock()
 
 	if _, ok := fs.Fids[r.Fid]; ok {
-		return nil, fmt.Errorf("fid already in use")
+		return nil, ErrFidInUse
 	}
 
 	var root Dir
@@ -186,12 +323,17 @@ func (fs *FileServer) Attach(r *protocol.AttachRequest) (resp *protocol.AttachRe
 	}
 
 	if root == nil {
-		return nil, fmt.Errorf("no such service")
+		return nil, ErrNoService
+	}
+
+	username := r.Username
+	if fs.User != "" {
+		username = fs.User
 	}
 
 	s := &State{
 		service:  r.Service,
-		username: r.Username,
+		username: username,
 		location: FilePath{root},
 	}
 
@@ -212,6 +354,7 @@ func (fs *FileServer) Attach(r *protocol.AttachRequest) (resp *protocol.AttachRe
 func (fs *FileServer) Flush(r *protocol.FlushRequest) (resp *protocol.FlushResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -232,6 +375,7 @@ func (fs *FileServer) Flush(r *protocol.FlushRequest) (resp *protocol.FlushRespo
 func (fs *FileServer) Walk(r *protocol.WalkRequest) (resp *protocol.WalkResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -242,113 +386,74 @@ func (fs *FileServer) Walk(r *protocol.WalkRequest) (resp *protocol.WalkResponse
 
 	fs.logreq(r)
 
-	fs.fidLock.Lock()
-	defer fs.fidLock.Unlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	s, err := fs.state(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-
-	s.Lock()
 	defer s.Unlock()
 
 	if s.open != nil {
-		return nil, fmt.Errorf("fid cannot be open for walk")
+		return nil, ErrOpen
 	}
 
-	if _, ok = fs.Fids[r.NewFid]; ok {
-		return nil, fmt.Errorf("fid already in use")
+	if len(r.Names) > MaxWalkElements {
+		return nil, ErrInvalid
 	}
 
-	if len(r.Names) == 0 {
-		x := &State{
-			service:  s.service,
-			username: s.username,
-			location: s.location,
+	if r.NewFid != r.Fid {
+		fs.fidLock.RLock()
+		_, ok := fs.Fids[r.NewFid]
+		fs.fidLock.RUnlock()
+		if ok {
+			return nil, ErrFidInUse
 		}
-		fs.Fids[r.NewFid] = x
-
-		resp := &protocol.WalkResponse{}
-		return resp, nil
 	}
 
-	cur := s.location.Current()
-	d, err := cur.IsDir()
-	if err != nil {
-		return nil, err
-	}
-	if !d {
-		return nil, fmt.Errorf("walk -- in a non-directory")
-	}
-	root := cur
+	// The walk works on a private copy of the path, so that neither fid ends
+	// up sharing a backing array with the other.
+	newloc := make(FilePath, len(s.location), len(s.location)+len(r.Names))
+	copy(newloc, s.location)
 
-	newloc := s.location
-	first := true
 	var qids []protocol.Qid
-	for i := range r.Names {
-		x, err := root.Open(s.username, protocol.OEXEC)
-		if err != nil {
-			goto write
+	for i, name := range r.Names {
+		next, err := walkTo(s.username, newloc, name)
+		var q protocol.Qid
+		if err == nil {
+			q, err = next.Current().Qid()
 		}
-		x.Close()
-
-		addToLoc := true
-		name := r.Names[i]
-		switch name {
-		case ".":
-			// This is a nop, but we should still report the result
-			addToLoc = false
-		case "..":
-			// Go one directory up, or nop if we're at /
-			root = newloc.Parent()
-			if len(newloc) > 1 {
-				newloc = newloc[:len(newloc)-1]
-				addToLoc = false
-			}
-		default:
-			istree, err := root.IsDir()
-			if err != nil {
+		if err != nil {
+			// Only a failure on the first element is an error. Anything later
+			// is a partial walk, which leaves newfid untouched.
+			if i == 0 {
 				return nil, err
 			}
-			if !istree {
-				goto write
-			}
-
-			d := root.(Dir)
-			root, err = d.Walk(s.username, name)
-			if err != nil {
-				goto write
-			}
-			if root == nil {
-				if first {
-					return nil, errors.New("file does not exist")
-				}
-				goto write
-			}
+			break
 		}
 
-		if addToLoc {
-			newloc = append(newloc, root)
-		}
-		q, err := root.Qid()
-		if err != nil {
-			return nil, err
-		}
+		newloc = next
 		qids = append(qids, q)
+	}
 
-		if i >= len(r.Names)-1 {
-			s := &State{
-				service:  s.service,
-				username: s.username,
-				location: newloc,
+	if len(qids) == len(r.Names) {
+		if r.NewFid == r.Fid {
+			s.location = newloc
+		} else {
+			fs.fidLock.Lock()
+			_, ok := fs.Fids[r.NewFid]
+			if !ok {
+				fs.Fids[r.NewFid] = &State{
+					service:  s.service,
+					username: s.username,
+					location: newloc,
+				}
+			}
+			fs.fidLock.Unlock()
+			if ok {
+				return nil, ErrFidInUse
 			}
-			fs.Fids[r.NewFid] = s
 		}
-
-		first = false
 	}
 
-write:
 	resp = &protocol.WalkResponse{
 		Qids: qids,
 	}
@@ -359,6 +464,7 @@ write:
 func (fs *FileServer) Open(r *protocol.OpenRequest) (resp *protocol.OpenResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -369,18 +475,14 @@ func (fs *FileServer) Open(r *protocol.OpenRequest) (resp *protocol.OpenResponse
 
 	fs.logreq(r)
 
-	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	s, err := fs.state(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-
-	s.Lock()
 	defer s.Unlock()
 
 	if s.open != nil {
-		return nil, fmt.Errorf("already open")
+		return nil, ErrOpen
 	}
 
 	l := s.location.Current()
@@ -388,23 +490,31 @@ func (fs *FileServer) Open(r *protocol.OpenRequest) (resp *protocol.OpenResponse
 	if err != nil {
 		return nil, err
 	}
+
+	isdir := q.Type&protocol.QTDIR != 0
+	if err := checkOpen(s.username, s.location, isdir, r.Mode); err != nil {
+		return nil, err
+	}
+
 	x, err := l.Open(s.username, r.Mode)
 	if err != nil {
 		return nil, err
 	}
 	s.open = x
 	s.mode = r.Mode
+	s.dir = isdir
 	resp = &protocol.OpenResponse{
-		Qid: q,
+		Qid:    q,
+		IOUnit: fs.iounit(),
 	}
 
 	return resp, nil
-
 }
 
 func (fs *FileServer) Create(r *protocol.CreateRequest) (resp *protocol.CreateResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -415,22 +525,18 @@ func (fs *FileServer) Create(r *protocol.CreateRequest) (resp *protocol.CreateRe
 
 	fs.logreq(r)
 
-	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	s, err := fs.state(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-
-	s.Lock()
 	defer s.Unlock()
 
 	if s.open != nil {
-		return nil, fmt.Errorf("already open")
+		return nil, ErrOpen
 	}
 
-	if r.Name == "." || r.Name == ".." {
-		return nil, fmt.Errorf("file name syntax")
+	if !validName(r.Name) {
+		return nil, ErrBadName
 	}
 
 	cur := s.location.Current()
@@ -438,12 +544,31 @@ func (fs *FileServer) Create(r *protocol.CreateRequest) (resp *protocol.CreateRe
 	if err != nil {
 		return nil, err
 	}
-	if !isdir {
-		return nil, fmt.Errorf("create -- in a non-directory")
+	t, ok := cur.(Dir)
+	if !isdir || !ok {
+		return nil, ErrNotDir
+	}
+
+	// Check the open mode up front, so that we do not leave a file behind
+	// that we then refuse to open.
+	mkdir := r.Permissions&protocol.DMDIR != 0
+	loc := append(s.location[:len(s.location):len(s.location)], nil)
+	if err := checkOpen(s.username, loc, mkdir, r.Mode); err != nil {
+		return nil, err
+	}
+
+	dstat, err := t.Stat()
+	if err != nil {
+		return nil, err
+	}
+	perms := r.Permissions
+	if mkdir {
+		perms &= ^protocol.FileMode(0777) | (dstat.Mode & 0777)
+	} else {
+		perms &= ^protocol.FileMode(0666) | (dstat.Mode & 0666)
 	}
-	t := cur.(Dir)
 
-	l, err := t.Create(s.username, r.Name, r.Permissions)
+	l, err := t.Create(s.username, r.Name, perms)
 	if err != nil {
 		return nil, err
 	}
@@ -458,12 +583,14 @@ func (fs *FileServer) Create(r *protocol.CreateRequest) (resp *protocol.CreateRe
 		return nil, err
 	}
 
-	s.location = append(s.location, l)
+	loc[len(loc)-1] = l
+	s.location = loc
 	s.open = x
 	s.mode = r.Mode
+	s.dir = mkdir
 	resp = &protocol.CreateResponse{
 		Qid:    q,
-		IOUnit: 0,
+		IOUnit: fs.iounit(),
 	}
 
 	return resp, nil
@@ -472,6 +599,7 @@ func (fs *FileServer) Create(r *protocol.CreateRequest) (resp *protocol.CreateRe
 func (fs *FileServer) Read(r *protocol.ReadRequest) (resp *protocol.ReadResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -482,36 +610,52 @@ func (fs *FileServer) Read(r *protocol.ReadRequest) (resp *protocol.ReadResponse
 
 	fs.logreq(r)
 
-	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	// The open file has a single offset, so reads and writes on the same fid
+	// cannot run side by side.
+	s, err := fs.state(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-
-	s.RLock()
-	defer s.RUnlock()
+	defer s.Unlock()
 
 	if s.open == nil {
-		return nil, fmt.Errorf("file not open")
+		return nil, ErrNotOpen
 	}
 
 	if (s.mode&3 != protocol.OREAD) && (s.mode&3) != protocol.ORDWR {
-		return nil, fmt.Errorf("file not opened for reading")
+		return nil, ErrBadUse
 	}
 
-	count := int(fs.MaxSize) - (&protocol.ReadResponse{}).EncodedLength() + protocol.HeaderSize
+	count := int(fs.iounit())
 	if count > int(r.Count) {
 		count = int(r.Count)
 	}
 
+	if s.dir {
+		b, err := s.readDir(r.Offset, count)
+		if err != nil {
+			return nil, err
+		}
+		return &protocol.ReadResponse{Data: b}, nil
+	}
+
 	b := make([]byte, count)
 
 	_, err = s.open.Seek(int64(r.Offset), 0)
 	if err != nil {
 		return nil, err
 	}
-	n, err := s.open.Read(b)
+	var n int
+	if cr, ok := s.open.(ContextReader); ok {
+		ctx, done, cerr := fs.cancellable(r.GetTag(), s)
+		if cerr != nil {
+			return nil, cerr
+		}
+		n, err = cr.ReadContext(ctx, b)
+		done()
+	} else {
+		n, err = s.open.Read(b)
+	}
 	if err == io.EOF {
 		n = 0
 	} else if err != nil {
@@ -528,6 +672,7 @@ func (fs *FileServer) Read(r *protocol.ReadRequest) (resp *protocol.ReadResponse
 func (fs *FileServer) Write(r *protocol.WriteRequest) (resp *protocol.WriteResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -538,29 +683,39 @@ func (fs *FileServer) Write(r *protocol.WriteRequest) (resp *protocol.WriteRespo
 
 	fs.logreq(r)
 
-	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	s, err := fs.state(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-
-	s.RLock()
-	defer s.RUnlock()
+	defer s.Unlock()
 
 	if s.open == nil {
-		return nil, fmt.Errorf("file not open")
+		return nil, ErrNotOpen
+	}
+
+	if (s.mode&3) != protocol.OWRITE && (s.mode&3) != protocol.ORDWR {
+		return nil, ErrBadUse
 	}
 
-	if (s.mode&3) != protocol.OWRITE && (s.mode%3) != protocol.ORDWR {
-		return nil, fmt.Errorf("file not opened for writing")
+	if len(r.Data) > int(fs.iounit()) {
+		return nil, ErrTooLarge
 	}
 
 	_, err = s.open.Seek(int64(r.Offset), 0)
 	if err != nil {
 		return nil, err
 	}
-	n, err := s.open.Write(r.Data)
+	var n int
+	if cw, ok := s.open.(ContextWriter); ok {
+		ctx, done, cerr := fs.cancellable(r.GetTag(), s)
+		if cerr != nil {
+			return nil, cerr
+		}
+		n, err = cw.WriteContext(ctx, r.Data)
+		done()
+	} else {
+		n, err = s.open.Write(r.Data)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -575,6 +730,7 @@ func (fs *FileServer) Write(r *protocol.WriteRequest) (resp *protocol.WriteRespo
 func (fs *FileServer) Clunk(r *protocol.ClunkRequest) (resp *protocol.ClunkResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -585,28 +741,20 @@ func (fs *FileServer) Clunk(r *protocol.ClunkRequest) (resp *protocol.ClunkRespo
 
 	fs.logreq(r)
 
-	fs.fidLock.Lock()
-	defer fs.fidLock.Unlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	s, err := fs.release(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-
-	s.Lock()
 	defer s.Unlock()
 
-	if s.open != nil {
-		s.open.Close()
-		s.open = nil
-	}
-
-	delete(fs.Fids, r.Fid)
+	fs.clunk(s)
 	return &protocol.ClunkResponse{}, nil
 }
 
 func (fs *FileServer) Remove(r *protocol.RemoveRequest) (resp *protocol.RemoveResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -617,14 +765,10 @@ func (fs *FileServer) Remove(r *protocol.RemoveRequest) (resp *protocol.RemoveRe
 
 	fs.logreq(r)
 
-	fs.fidLock.Lock()
-	defer fs.fidLock.Unlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	s, err := fs.release(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-	defer delete(fs.Fids, r.Fid)
-	s.Lock()
 	defer s.Unlock()
 
 	if s.open != nil {
@@ -632,21 +776,11 @@ func (fs *FileServer) Remove(r *protocol.RemoveRequest) (resp *protocol.RemoveRe
 		s.open = nil
 	}
 
-	var cur, p File
-
-	// We're not going to remove /.
-	if len(s.location) <= 1 {
-		return &protocol.RemoveResponse{}, nil
-	}
-
-	// Attempt to delete it, but ignore error.
-	cur = s.location.Current()
-	p = s.location.Parent()
-	n, err := cur.Name()
-	if err != nil {
+	// The fid is clunked on the way out whatever happens below, as a remove
+	// request clunks even when the remove itself fails.
+	if err := remove(s.username, s.location); err != nil {
 		return nil, err
 	}
-	p.(Dir).Remove(s.username, n)
 
 	return &protocol.RemoveResponse{}, nil
 }
@@ -654,6 +788,7 @@ func (fs *FileServer) Remove(r *protocol.RemoveRequest) (resp *protocol.RemoveRe
 func (fs *FileServer) Stat(r *protocol.StatRequest) (resp *protocol.StatResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -664,19 +799,15 @@ func (fs *FileServer) Stat(r *protocol.StatRequest) (resp *protocol.StatResponse
 
 	fs.logreq(r)
 
-	fs.fidLock.RLock()
-	defer fs.fidLock.RUnlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	s, err := fs.state(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-
-	s.RLock()
-	defer s.RUnlock()
+	defer s.Unlock()
 
 	l := s.location.Current()
 	if l == nil {
-		return nil, fmt.Errorf("no such file")
+		return nil, ErrNotExist
 	}
 
 	st, err := l.Stat()
@@ -694,6 +825,7 @@ func (fs *FileServer) Stat(r *protocol.StatRequest) (resp *protocol.StatResponse
 func (fs *FileServer) WriteStat(r *protocol.WriteStatRequest) (resp *protocol.WriteStatResponse, err error) {
 	fs.register(r)
 	defer func() {
+		err = Canonical(err)
 		if fs.flushed(r) {
 			resp = nil
 			err = g9p.ErrFlushed
@@ -704,21 +836,17 @@ func (fs *FileServer) WriteStat(r *protocol.WriteStatRequest) (resp *protocol.Wr
 
 	fs.logreq(r)
 
-	fs.fidLock.Lock()
-	defer fs.fidLock.Unlock()
-	s, ok := fs.Fids[r.Fid]
-	if !ok {
-		return nil, fmt.Errorf("unknown fid")
+	s, err := fs.state(r.Fid)
+	if err != nil {
+		return nil, err
 	}
-
-	s.Lock()
 	defer s.Unlock()
 
 	var l File
 	var p Dir
 	l = s.location.Current()
 	if l == nil {
-		return nil, fmt.Errorf("no such file")
+		return nil, ErrNotExist
 	}
 
 	if len(s.location) > 1 {
@@ -731,14 +859,108 @@ func (fs *FileServer) WriteStat(r *protocol.WriteStatRequest) (resp *protocol.Wr
 	return &protocol.WriteStatResponse{}, nil
 }
 
+// iounit returns the largest amount of data that fits in a single read or
+// write message.
+func (fs *FileServer) iounit() uint32 {
+	fs.RLock()
+	defer fs.RUnlock()
+	if fs.MaxSize < IOHeaderSize {
+		return 0
+	}
+	return fs.MaxSize - IOHeaderSize
+}
+
+// clunk closes the open file of a fid, removing it if it was opened with
+// ORCLOSE. The caller must hold the lock of s.
+func (fs *FileServer) clunk(s *State) {
+	if s.open == nil {
+		return
+	}
+
+	s.open.Close()
+	s.open = nil
+	if s.mode&protocol.ORCLOSE != 0 {
+		// There is nobody to report a failure to, as the clunk itself
+		// always succeeds.
+		remove(s.username, s.location)
+	}
+}
+
+// readDir reads as many whole directory entries as fit in count bytes. The
+// offset must be 0, which rewinds the directory, or where the previous read
+// on the fid ended. The caller must hold the lock of s.
+func (s *State) readDir(offset uint64, count int) ([]byte, error) {
+	if offset == 0 {
+		if _, err := s.open.Seek(0, 0); err != nil {
+			return nil, err
+		}
+		s.dirOffset = 0
+		s.dirBuf = nil
+	} else if offset != s.dirOffset {
+		return nil, ErrInvalid
+	}
+
+	for len(s.dirBuf) < count {
+		b := make([]byte, count-len(s.dirBuf))
+		n, err := s.open.Read(b)
+		s.dirBuf = append(s.dirBuf, b[:n]...)
+		if err == io.EOF || n == 0 {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	n := 0
+	for n+2 <= len(s.dirBuf) {
+		size := 2 + int(binary.LittleEndian.Uint16(s.dirBuf[n:]))
+		if n+size > count || n+size > len(s.dirBuf) {
+			break
+		}
+		n += size
+	}
+
+	if n == 0 && len(s.dirBuf) > 0 {
+		// Not even a single entry fits in the read.
+		return nil, ErrInvalid
+	}
+
+	b := make([]byte, n)
+	copy(b, s.dirBuf)
+	s.dirBuf = s.dirBuf[n:]
+	s.dirOffset += uint64(n)
+	return b, nil
+}
+
+// Close clunks every fid, as when the connection the FileServer serves has
+// gone away, so that what they hold, such as locks, is released.
+func (fs *FileServer) Close() error {
+	fs.fidLock.RLock()
+	fids := make([]protocol.Fid, 0, len(fs.Fids))
+	for fid := range fs.Fids {
+		fids = append(fids, fid)
+	}
+	fs.fidLock.RUnlock()
+
+	for _, fid := range fids {
+		if s, err := fs.release(fid); err == nil {
+			fs.clunk(s)
+			s.Unlock()
+		}
+	}
+	return nil
+}
+
 func NewFileServer(root Dir, roots map[string]Dir, maxSize uint32, chat Verbosity) *FileServer {
 	fs := &FileServer{
 		Root:    root,
 		Roots:   roots,
 		MaxSize: maxSize,
+		maxSize: maxSize,
 		Chatty:  chat,
 		Fids:    make(map[protocol.Fid]*State),
 		tags:    make(map[protocol.Tag]bool),
+		cancels: make(map[protocol.Tag]context.CancelFunc),
 	}
 
 	if chat == Debug {
@@ -0,0 +1,26 @@
+package fileserver
+
+import (
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+func TestVersionMaxSize(t *testing.T) {
+	fs := NewFileServer(nil, nil, 8192, Quiet)
+	for _, tc := range []struct {
+		asked, got uint32
+	}{
+		{DefaultMaxSize, 8192},
+		{4096, 4096},
+		{8193, 8192},
+	} {
+		resp, err := fs.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: tc.asked, Version: "9P2000"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.MaxSize != tc.got || fs.MaxSize != tc.got {
+			t.Errorf("asked for %d, got %d, expected %d", tc.asked, resp.MaxSize, tc.got)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package fstest
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/kennylevinsen/g9p"
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// pipeListener is a net.Listener that hands out in-memory connections.
+type pipeListener struct {
+	conns chan net.Conn
+	once  sync.Once
+	done  chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial connects to the listener.
+func (l *pipeListener) Dial() (net.Conn, error) {
+	a, b := net.Pipe()
+	select {
+	case l.conns <- a:
+		return b, nil
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// session is a single connection to a FileServer under test. Fid 0 is
+// attached to the root as the suite user.
+type session struct {
+	*testing.T
+	suite   *Suite
+	fs      *fileserver.FileServer
+	c       *g9p.Client
+	nextFid protocol.Fid
+}
+
+const rootFid protocol.Fid = 0
+
+func newSession(t *testing.T, suite *Suite) *session {
+	root := suite.NewRoot(t)
+	fs := fileserver.NewFileServer(root, nil, MaxSize, fileserver.Quiet)
+
+	l := newPipeListener()
+	go g9p.ServeListener(l, func() g9p.Handler { return fs })
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	c := g9p.NewClient(conn)
+	go c.Start()
+
+	t.Cleanup(func() {
+		c.Stop()
+		conn.Close()
+		l.Close()
+	})
+
+	s := &session{
+		T:       t,
+		suite:   suite,
+		fs:      fs,
+		c:       c,
+		nextFid: rootFid + 1,
+	}
+
+	if _, err := s.version(MaxSize, "9P2000"); err != nil {
+		t.Fatalf("version: %v", err)
+	}
+	if _, err := s.attach(rootFid, suite.User); err != nil {
+		t.Fatalf("attach: %v", err)
+	}
+
+	return s
+}
+
+// fid returns a fid that has not been used in the session yet.
+func (s *session) fid() protocol.Fid {
+	f := s.nextFid
+	s.nextFid++
+	return f
+}
+
+// remoteError turns an error response into the typed error it names.
+func remoteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fileserver.ParseError(err.Error())
+}
+
+func (s *session) version(msize uint32, version string) (*protocol.VersionResponse, error) {
+	resp, err := s.c.Version(&protocol.VersionRequest{
+		Tag:     protocol.NOTAG,
+		MaxSize: msize,
+		Version: version,
+	})
+	return resp, remoteError(err)
+}
+
+func (s *session) attach(fid protocol.Fid, user string) (protocol.Qid, error) {
+	resp, err := s.c.Attach(&protocol.AttachRequest{
+		Tag:      s.c.NextTag(),
+		Fid:      fid,
+		AuthFid:  protocol.NOFID,
+		Username: user,
+		Service:  s.suite.Service,
+	})
+	if err != nil {
+		return protocol.Qid{}, remoteError(err)
+	}
+	return resp.Qid, nil
+}
+
+func (s *session) walk(fid, newfid protocol.Fid, names ...string) ([]protocol.Qid, error) {
+	resp, err := s.c.Walk(&protocol.WalkRequest{
+		Tag:    s.c.NextTag(),
+		Fid:    fid,
+		NewFid: newfid,
+		Names:  names,
+	})
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	return resp.Qids, nil
+}
+
+func (s *session) open(fid protocol.Fid, mode protocol.OpenMode) (protocol.Qid, error) {
+	resp, err := s.c.Open(&protocol.OpenRequest{
+		Tag:  s.c.NextTag(),
+		Fid:  fid,
+		Mode: mode,
+	})
+	if err != nil {
+		return protocol.Qid{}, remoteError(err)
+	}
+	return resp.Qid, nil
+}
+
+func (s *session) create(fid protocol.Fid, name string, perm protocol.FileMode, mode protocol.OpenMode) (protocol.Qid, error) {
+	resp, err := s.c.Create(&protocol.CreateRequest{
+		Tag:         s.c.NextTag(),
+		Fid:         fid,
+		Name:        name,
+		Permissions: perm,
+		Mode:        mode,
+	})
+	if err != nil {
+		return protocol.Qid{}, remoteError(err)
+	}
+	return resp.Qid, nil
+}
+
+func (s *session) read(fid protocol.Fid, offset uint64, count uint32) ([]byte, error) {
+	resp, err := s.c.Read(&protocol.ReadRequest{
+		Tag:    s.c.NextTag(),
+		Fid:    fid,
+		Offset: offset,
+		Count:  count,
+	})
+	if err != nil {
+		return nil, remoteError(err)
+	}
+	return resp.Data, nil
+}
+
+func (s *session) write(fid protocol.Fid, offset uint64, data []byte) (uint32, error) {
+	resp, err := s.c.Write(&protocol.WriteRequest{
+		Tag:    s.c.NextTag(),
+		Fid:    fid,
+		Offset: offset,
+		Data:   data,
+	})
+	if err != nil {
+		return 0, remoteError(err)
+	}
+	return resp.Count, nil
+}
+
+func (s *session) clunk(fid protocol.Fid) error {
+	_, err := s.c.Clunk(&protocol.ClunkRequest{
+		Tag: s.c.NextTag(),
+		Fid: fid,
+	})
+	return remoteError(err)
+}
+
+func (s *session) remove(fid protocol.Fid) error {
+	_, err := s.c.Remove(&protocol.RemoveRequest{
+		Tag: s.c.NextTag(),
+		Fid: fid,
+	})
+	return remoteError(err)
+}
+
+func (s *session) stat(fid protocol.Fid) (protocol.Stat, error) {
+	resp, err := s.c.Stat(&protocol.StatRequest{
+		Tag: s.c.NextTag(),
+		Fid: fid,
+	})
+	if err != nil {
+		return protocol.Stat{}, remoteError(err)
+	}
+	return resp.Stat, nil
+}
+
+func (s *session) wstat(fid protocol.Fid, st protocol.Stat) error {
+	_, err := s.c.WriteStat(&protocol.WriteStatRequest{
+		Tag:  s.c.NextTag(),
+		Fid:  fid,
+		Stat: st,
+	})
+	return remoteError(err)
+}
+
+func (s *session) flush(oldtag protocol.Tag) error {
+	_, err := s.c.Flush(&protocol.FlushRequest{
+		Tag:    s.c.NextTag(),
+		OldTag: oldtag,
+	})
+	return remoteError(err)
+}
+
+// The must helpers fail the test on error.
+
+func (s *session) mustWalk(fid protocol.Fid, names ...string) protocol.Fid {
+	s.Helper()
+	newfid := s.fid()
+	qids, err := s.walk(fid, newfid, names...)
+	if err != nil {
+		s.Fatalf("walk %q: %v", names, err)
+	}
+	if len(qids) != len(names) {
+		s.Fatalf("walk %q: got %d qids, expected %d", names, len(qids), len(names))
+	}
+	return newfid
+}
+
+func (s *session) mustOpen(fid protocol.Fid, mode protocol.OpenMode) {
+	s.Helper()
+	if _, err := s.open(fid, mode); err != nil {
+		s.Fatalf("open with mode %#x: %v", mode, err)
+	}
+}
+
+func (s *session) mustClunk(fid protocol.Fid) {
+	s.Helper()
+	if err := s.clunk(fid); err != nil {
+		s.Fatalf("clunk: %v", err)
+	}
+}
+
+func (s *session) mustStat(fid protocol.Fid) protocol.Stat {
+	s.Helper()
+	st, err := s.stat(fid)
+	if err != nil {
+		s.Fatalf("stat: %v", err)
+	}
+	return st
+}
+
+func (s *session) mustWrite(fid protocol.Fid, offset uint64, data []byte) {
+	s.Helper()
+	n, err := s.write(fid, offset, data)
+	if err != nil {
+		s.Fatalf("write: %v", err)
+	}
+	if int(n) != len(data) {
+		s.Fatalf("write: wrote %d bytes, expected %d", n, len(data))
+	}
+}
+
+func (s *session) mustRead(fid protocol.Fid, offset uint64, count uint32) []byte {
+	s.Helper()
+	b, err := s.read(fid, offset, count)
+	if err != nil {
+		s.Fatalf("read: %v", err)
+	}
+	return b
+}
+
+// mkfile creates a file below the directory dir, writes content to it and
+// clunks it again.
+func (s *session) mkfile(dir protocol.Fid, name string, perm protocol.FileMode, content string) {
+	s.Helper()
+	fid := s.mustWalk(dir)
+	if _, err := s.create(fid, name, perm, protocol.OWRITE); err != nil {
+		s.Fatalf("create %s: %v", name, err)
+	}
+	if content != "" {
+		s.mustWrite(fid, 0, []byte(content))
+	}
+	s.mustClunk(fid)
+}
+
+// mkdir creates a directory below dir.
+func (s *session) mkdir(dir protocol.Fid, name string, perm protocol.FileMode) {
+	s.Helper()
+	fid := s.mustWalk(dir)
+	if _, err := s.create(fid, name, perm|protocol.DMDIR, protocol.OREAD); err != nil {
+		s.Fatalf("create %s: %v", name, err)
+	}
+	s.mustClunk(fid)
+}
+
+// exists reports whether the path can be walked to from the root.
+func (s *session) exists(names ...string) bool {
+	s.Helper()
+	fid := s.fid()
+	qids, err := s.walk(rootFid, fid, names...)
+	if err != nil || len(qids) != len(names) {
+		return false
+	}
+	s.mustClunk(fid)
+	return true
+}
+
+// contents reads the whole file at the path.
+func (s *session) contents(names ...string) string {
+	s.Helper()
+	fid := s.mustWalk(rootFid, names...)
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.OREAD)
+
+	var b []byte
+	for {
+		x := s.mustRead(fid, uint64(len(b)), 4096)
+		if len(x) == 0 {
+			break
+		}
+		b = append(b, x...)
+	}
+	return string(b)
+}
+
+// readDir reads the directory open on fid in reads of count bytes, checking
+// that every read holds whole entries.
+func (s *session) readDir(fid protocol.Fid, count uint32) []protocol.Stat {
+	s.Helper()
+	var offset uint64
+	var stats []protocol.Stat
+	for {
+		b := s.mustRead(fid, offset, count)
+		if len(b) == 0 {
+			return stats
+		}
+		if len(b) > int(count) {
+			s.Fatalf("directory read returned %d bytes for a count of %d", len(b), count)
+		}
+		offset += uint64(len(b))
+
+		buf := bytes.NewBuffer(b)
+		for buf.Len() > 0 {
+			var st protocol.Stat
+			if err := st.Decode(buf); err != nil {
+				s.Fatalf("directory read returned a partial entry: %v", err)
+			}
+			stats = append(stats, st)
+		}
+	}
+}
+
+// expect fails the test unless err is the expected error.
+func (s *session) expect(err error, expected error, format string, args ...interface{}) {
+	s.Helper()
+	if !errors.Is(err, expected) {
+		s.Fatalf(format+": got error %v, expected %v", append(args, err, expected)...)
+	}
+}
+
+// fail fails the test unless err is an error.
+func (s *session) fail(err error, format string, args ...interface{}) {
+	s.Helper()
+	if err == nil {
+		s.Fatalf(format+": unexpected success", args...)
+	}
+}
+
+// dontTouch returns a stat where every field is set to its "don't touch"
+// value.
+func dontTouch() protocol.Stat {
+	return protocol.Stat{
+		Type: ^uint16(0),
+		Dev:  ^uint32(0),
+		Qid: protocol.Qid{
+			Type:    ^protocol.QidType(0),
+			Version: ^uint32(0),
+			Path:    ^uint64(0),
+		},
+		Mode:   ^protocol.FileMode(0),
+		Atime:  ^uint32(0),
+		Mtime:  ^uint32(0),
+		Length: ^uint64(0),
+	}
+}
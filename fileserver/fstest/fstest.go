@@ -0,0 +1,1136 @@
+// Package fstest implements a 9P2000 conformance suite for fileserver.Dir
+// implementations.
+//
+// The suite serves the directory with a fileserver.FileServer over an
+// in-memory connection, and checks the replies to raw protocol requests. A
+// backend is tested by calling Run from a regular test:
+//
+//	func TestConformance(t *testing.T) {
+//		s := &fstest.Suite{
+//			NewRoot: func(t *testing.T) fileserver.Dir {
+//				return ramtree.NewRAMTree("/", 0777, "glenda", "glenda")
+//			},
+//			User:  "glenda",
+//			Other: "nobody",
+//		}
+//		s.Run(t)
+//	}
+package fstest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// MaxSize is the message size negotiated by the suite.
+const MaxSize = 8192
+
+// Suite describes the backend under test.
+type Suite struct {
+	// NewRoot returns a new, empty root directory with mode 0777, owned by
+	// User. It is called once for every test.
+	NewRoot func(t *testing.T) fileserver.Dir
+
+	// User is the user that attaches, and owns the root.
+	User string
+
+	// Other is a user that neither owns the files of the test, nor is in
+	// their group. If empty, the permission tests are skipped.
+	Other string
+
+	// Service is the service name to attach to.
+	Service string
+}
+
+type conformanceTest struct {
+	name string
+	fn   func(s *session)
+
+	// needsOther marks tests that need a second user.
+	needsOther bool
+}
+
+var tests = []conformanceTest{
+	{name: "Version", fn: testVersion},
+	{name: "VersionClunksFids", fn: testVersionClunksFids},
+	{name: "Attach", fn: testAttach},
+	{name: "Auth", fn: testAuth},
+	{name: "StatRoot", fn: testStatRoot},
+	{name: "WalkClone", fn: testWalkClone},
+	{name: "WalkCloneSameFid", fn: testWalkCloneSameFid},
+	{name: "WalkNonexistent", fn: testWalkNonexistent},
+	{name: "WalkPartial", fn: testWalkPartial},
+	{name: "WalkMaxElements", fn: testWalkMaxElements},
+	{name: "WalkDotDot", fn: testWalkDotDot},
+	{name: "WalkThroughFile", fn: testWalkThroughFile},
+	{name: "WalkNewFidInUse", fn: testWalkNewFidInUse},
+	{name: "WalkSameFid", fn: testWalkSameFid},
+	{name: "WalkOpenFid", fn: testWalkOpenFid},
+	{name: "WalkSlash", fn: testWalkSlash},
+	{name: "WalkQids", fn: testWalkQids},
+	{name: "OpenModes", fn: testOpenModes},
+	{name: "OpenTwice", fn: testOpenTwice},
+	{name: "OpenDirForWrite", fn: testOpenDirForWrite},
+	{name: "OpenTrunc", fn: testOpenTrunc},
+	{name: "OpenRemoveOnClose", fn: testOpenRemoveOnClose},
+	{name: "CreateFile", fn: testCreateFile},
+	{name: "CreateDir", fn: testCreateDir},
+	{name: "CreateExisting", fn: testCreateExisting},
+	{name: "CreateBadName", fn: testCreateBadName},
+	{name: "CreateInFile", fn: testCreateInFile},
+	{name: "CreateOpenFid", fn: testCreateOpenFid},
+	{name: "CreateDirForWrite", fn: testCreateDirForWrite},
+	{name: "CreatePermissions", fn: testCreatePermissions},
+	{name: "RemoveFile", fn: testRemoveFile},
+	{name: "RemoveNonEmpty", fn: testRemoveNonEmpty},
+	{name: "RemoveRoot", fn: testRemoveRoot},
+	{name: "RemoveOpen", fn: testRemoveOpen},
+	{name: "ReadWriteOffsets", fn: testReadWriteOffsets},
+	{name: "ReadIOUnit", fn: testReadIOUnit},
+	{name: "DirRead", fn: testDirRead},
+	{name: "DirReadOffsets", fn: testDirReadOffsets},
+	{name: "DirReadQids", fn: testDirReadQids},
+	{name: "WstatRename", fn: testWstatRename},
+	{name: "WstatRenameExisting", fn: testWstatRenameExisting},
+	{name: "WstatRenameRoot", fn: testWstatRenameRoot},
+	{name: "WstatRenameBadName", fn: testWstatRenameBadName},
+	{name: "WstatDontTouch", fn: testWstatDontTouch},
+	{name: "WstatLength", fn: testWstatLength},
+	{name: "WstatDirLength", fn: testWstatDirLength},
+	{name: "WstatMode", fn: testWstatMode},
+	{name: "WstatOwner", fn: testWstatOwner},
+	{name: "WstatMtime", fn: testWstatMtime},
+	{name: "WstatAtomic", fn: testWstatAtomic},
+	{name: "PermRead", fn: testPermRead, needsOther: true},
+	{name: "PermCreate", fn: testPermCreate, needsOther: true},
+	{name: "PermWalk", fn: testPermWalk, needsOther: true},
+	{name: "PermRemove", fn: testPermRemove, needsOther: true},
+	{name: "PermWstat", fn: testPermWstat, needsOther: true},
+	{name: "PermRemoveOnClose", fn: testPermRemoveOnClose, needsOther: true},
+	{name: "Flush", fn: testFlush},
+	{name: "FidReuse", fn: testFidReuse},
+	{name: "FidUnknown", fn: testFidUnknown},
+}
+
+// Run runs the conformance suite, each test against a new root.
+func (suite *Suite) Run(t *testing.T) {
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.needsOther && suite.Other == "" {
+				t.Skip("no other user to test permissions with")
+			}
+
+			s := newSession(t, suite)
+			tc.fn(s)
+
+			// Every test clunks what it uses, so only the root may be left.
+			if n := len(s.fs.Fids); n != 1 {
+				t.Errorf("%d fids left after test, expected only the root", n)
+			}
+		})
+	}
+}
+
+func testVersion(s *session) {
+	resp, err := s.version(MaxSize, "9P2000")
+	if err != nil {
+		s.Fatalf("version: %v", err)
+	}
+	if resp.Version != "9P2000" {
+		s.Errorf("version: got %q, expected 9P2000", resp.Version)
+	}
+	if resp.MaxSize > MaxSize {
+		s.Errorf("version: msize %d larger than requested %d", resp.MaxSize, MaxSize)
+	}
+
+	resp, err = s.version(MaxSize, "9P3000")
+	if err != nil {
+		s.Fatalf("version: %v", err)
+	}
+	if resp.Version != "unknown" {
+		s.Errorf("version: got %q for unknown version, expected unknown", resp.Version)
+	}
+
+	if _, err := s.version(MaxSize, "9P2000"); err != nil {
+		s.Fatalf("version: %v", err)
+	}
+	if _, err := s.attach(rootFid, s.suite.User); err != nil {
+		s.Fatalf("attach: %v", err)
+	}
+}
+
+func testVersionClunksFids(s *session) {
+	fid := s.mustWalk(rootFid)
+	if _, err := s.version(MaxSize, "9P2000"); err != nil {
+		s.Fatalf("version: %v", err)
+	}
+
+	_, err := s.stat(fid)
+	s.expect(err, fileserver.ErrUnknownFid, "stat after version")
+
+	if _, err := s.attach(rootFid, s.suite.User); err != nil {
+		s.Fatalf("attach: %v", err)
+	}
+}
+
+func testAttach(s *session) {
+	_, err := s.attach(rootFid, s.suite.User)
+	s.expect(err, fileserver.ErrFidInUse, "attach with fid in use")
+
+	fid := s.fid()
+	q, err := s.attach(fid, s.suite.User)
+	if err != nil {
+		s.Fatalf("attach: %v", err)
+	}
+	defer s.mustClunk(fid)
+
+	if q.Type&protocol.QTDIR == 0 {
+		s.Errorf("attach: root qid is not a directory")
+	}
+	if st := s.mustStat(rootFid); st.Qid.Path != q.Path {
+		s.Errorf("attach: qid path %d differs from root %d", q.Path, st.Qid.Path)
+	}
+}
+
+func testAuth(s *session) {
+	_, err := s.c.Auth(&protocol.AuthRequest{
+		Tag:      s.c.NextTag(),
+		AuthFid:  s.fid(),
+		Username: s.suite.User,
+		Service:  s.suite.Service,
+	})
+	s.fail(err, "auth")
+}
+
+func testStatRoot(s *session) {
+	st := s.mustStat(rootFid)
+	if st.Mode&protocol.DMDIR == 0 {
+		s.Errorf("root mode %#o lacks DMDIR", st.Mode)
+	}
+	if st.Qid.Type&protocol.QTDIR == 0 {
+		s.Errorf("root qid type %#x lacks QTDIR", st.Qid.Type)
+	}
+	if st.Name != "/" {
+		s.Errorf("root name is %q, expected /", st.Name)
+	}
+	if st.UID != s.suite.User {
+		s.Errorf("root owner is %q, expected %q", st.UID, s.suite.User)
+	}
+}
+
+func testWalkClone(s *session) {
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+
+	if a, b := s.mustStat(rootFid), s.mustStat(fid); a.Qid != b.Qid {
+		s.Errorf("clone: qid %+v differs from original %+v", b.Qid, a.Qid)
+	}
+}
+
+func testWalkCloneSameFid(s *session) {
+	qids, err := s.walk(rootFid, rootFid)
+	if err != nil {
+		s.Fatalf("walk to same fid: %v", err)
+	}
+	if len(qids) != 0 {
+		s.Errorf("walk to same fid: got %d qids, expected none", len(qids))
+	}
+	s.mustStat(rootFid)
+}
+
+func testWalkNonexistent(s *session) {
+	fid := s.fid()
+	_, err := s.walk(rootFid, fid, "nonexistent")
+	s.expect(err, fileserver.ErrNotExist, "walk to nonexistent file")
+	s.expect(s.clunk(fid), fileserver.ErrUnknownFid, "clunk of newfid after failed walk")
+}
+
+func testWalkPartial(s *session) {
+	s.mkdir(rootFid, "a", 0777)
+
+	fid := s.fid()
+	qids, err := s.walk(rootFid, fid, "a", "nonexistent", "b")
+	if err != nil {
+		s.Fatalf("partial walk: %v", err)
+	}
+	if len(qids) != 1 {
+		s.Errorf("partial walk: got %d qids, expected 1", len(qids))
+	}
+	s.expect(s.clunk(fid), fileserver.ErrUnknownFid, "clunk of newfid after partial walk")
+}
+
+func testWalkMaxElements(s *session) {
+	names := make([]string, fileserver.MaxWalkElements)
+	for i := range names {
+		names[i] = ".."
+	}
+
+	fid := s.mustWalk(rootFid, names...)
+	s.mustClunk(fid)
+
+	fid = s.fid()
+	_, err := s.walk(rootFid, fid, append(names, "..")...)
+	s.fail(err, "walk of %d elements", len(names)+1)
+	s.expect(s.clunk(fid), fileserver.ErrUnknownFid, "clunk of newfid after failed walk")
+}
+
+func testWalkDotDot(s *session) {
+	s.mkdir(rootFid, "a", 0777)
+	root := s.mustStat(rootFid)
+
+	fid := s.fid()
+	qids, err := s.walk(rootFid, fid, "a", "..")
+	if err != nil {
+		s.Fatalf("walk: %v", err)
+	}
+	defer s.mustClunk(fid)
+	if len(qids) != 2 || qids[1].Path != root.Qid.Path {
+		s.Errorf("walk to a/..: got %+v, expected to end at root %+v", qids, root.Qid)
+	}
+
+	fid2 := s.fid()
+	qids, err = s.walk(rootFid, fid2, "..")
+	if err != nil {
+		s.Fatalf("walk: %v", err)
+	}
+	defer s.mustClunk(fid2)
+	if len(qids) != 1 || qids[0].Path != root.Qid.Path {
+		s.Errorf("walk to .. from root: got %+v, expected root %+v", qids, root.Qid)
+	}
+}
+
+func testWalkThroughFile(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+
+	fid := s.fid()
+	qids, err := s.walk(rootFid, fid, "f", "x")
+	if err != nil {
+		s.Fatalf("walk: %v", err)
+	}
+	if len(qids) != 1 {
+		s.Errorf("walk through file: got %d qids, expected 1", len(qids))
+	}
+	s.expect(s.clunk(fid), fileserver.ErrUnknownFid, "clunk of newfid after partial walk")
+
+	f := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(f)
+	_, err = s.walk(f, s.fid(), "x")
+	s.expect(err, fileserver.ErrNotDir, "walk from file")
+}
+
+func testWalkNewFidInUse(s *session) {
+	s.mkdir(rootFid, "a", 0777)
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+
+	_, err := s.walk(rootFid, fid, "a")
+	s.expect(err, fileserver.ErrFidInUse, "walk to fid in use")
+}
+
+func testWalkSameFid(s *session) {
+	s.mkdir(rootFid, "a", 0777)
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+
+	if _, err := s.walk(fid, fid, "a"); err != nil {
+		s.Fatalf("walk fid to itself: %v", err)
+	}
+	if st := s.mustStat(fid); st.Name != "a" {
+		s.Fatalf("walk fid to itself: fid is at %q, expected a", st.Name)
+	}
+
+	_, err := s.walk(fid, fid, "nonexistent")
+	s.expect(err, fileserver.ErrNotExist, "failed walk of fid to itself")
+
+	qids, err := s.walk(fid, fid, "..", "nonexistent")
+	if err != nil {
+		s.Fatalf("partial walk of fid to itself: %v", err)
+	}
+	if len(qids) != 1 {
+		s.Errorf("partial walk of fid to itself: got %d qids, expected 1", len(qids))
+	}
+	if st := s.mustStat(fid); st.Name != "a" {
+		s.Errorf("partial walk of fid to itself moved it to %q", st.Name)
+	}
+}
+
+func testWalkOpenFid(s *session) {
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.OREAD)
+
+	_, err := s.walk(fid, s.fid())
+	s.expect(err, fileserver.ErrOpen, "walk from open fid")
+}
+
+func testWalkSlash(s *session) {
+	s.mkdir(rootFid, "a", 0777)
+	a := s.mustWalk(rootFid, "a")
+	s.mkdir(a, "b", 0777)
+	s.mustClunk(a)
+
+	fid := s.fid()
+	_, err := s.walk(rootFid, fid, "a/b")
+	s.fail(err, "walk of name with slash")
+
+	_, err = s.walk(rootFid, fid, "")
+	s.fail(err, "walk of empty name")
+}
+
+func testWalkQids(s *session) {
+	s.mkdir(rootFid, "d", 0777)
+	s.mkfile(rootFid, "f", 0666, "")
+
+	fid := s.fid()
+	qids, err := s.walk(rootFid, fid, "d")
+	if err != nil {
+		s.Fatalf("walk: %v", err)
+	}
+	s.mustClunk(fid)
+	dq := qids[0]
+	if dq.Type&protocol.QTDIR == 0 {
+		s.Errorf("directory qid type %#x lacks QTDIR", dq.Type)
+	}
+
+	qids, err = s.walk(rootFid, fid, "f")
+	if err != nil {
+		s.Fatalf("walk: %v", err)
+	}
+	s.mustClunk(fid)
+	fq := qids[0]
+	if fq.Type&protocol.QTDIR != 0 {
+		s.Errorf("file qid type %#x has QTDIR", fq.Type)
+	}
+	if fq.Path == dq.Path {
+		s.Errorf("file and directory share qid path %d", fq.Path)
+	}
+
+	qids, err = s.walk(rootFid, fid, "f")
+	if err != nil {
+		s.Fatalf("walk: %v", err)
+	}
+	s.mustClunk(fid)
+	if qids[0].Path != fq.Path {
+		s.Errorf("qid path changed between walks: %d and %d", fq.Path, qids[0].Path)
+	}
+}
+
+func testOpenModes(s *session) {
+	s.mkfile(rootFid, "f", 0666, "hello")
+
+	fid := s.mustWalk(rootFid, "f")
+	s.mustOpen(fid, protocol.OREAD)
+	if b := s.mustRead(fid, 0, 100); string(b) != "hello" {
+		s.Errorf("read: got %q, expected hello", b)
+	}
+	_, err := s.write(fid, 0, []byte("x"))
+	s.expect(err, fileserver.ErrBadUse, "write to file open for reading")
+	s.mustClunk(fid)
+
+	fid = s.mustWalk(rootFid, "f")
+	s.mustOpen(fid, protocol.OWRITE)
+	s.mustWrite(fid, 0, []byte("j"))
+	_, err = s.read(fid, 0, 100)
+	s.expect(err, fileserver.ErrBadUse, "read from file open for writing")
+	s.mustClunk(fid)
+
+	fid = s.mustWalk(rootFid, "f")
+	s.mustOpen(fid, protocol.ORDWR)
+	s.mustWrite(fid, 4, []byte("y"))
+	if b := s.mustRead(fid, 0, 100); string(b) != "jelly" {
+		s.Errorf("read: got %q, expected jelly", b)
+	}
+	s.mustClunk(fid)
+
+	_, err = s.read(rootFid, 0, 100)
+	s.expect(err, fileserver.ErrNotOpen, "read from unopened fid")
+}
+
+func testOpenTwice(s *session) {
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.OREAD)
+
+	_, err := s.open(fid, protocol.OREAD)
+	s.expect(err, fileserver.ErrOpen, "second open")
+}
+
+func testOpenDirForWrite(s *session) {
+	for _, mode := range []protocol.OpenMode{protocol.OWRITE, protocol.ORDWR, protocol.OREAD | protocol.OTRUNC} {
+		fid := s.mustWalk(rootFid)
+		_, err := s.open(fid, mode)
+		s.expect(err, fileserver.ErrIsDir, "open of directory with mode %#x", mode)
+		s.mustClunk(fid)
+	}
+}
+
+func testOpenTrunc(s *session) {
+	s.mkfile(rootFid, "f", 0666, "hello")
+
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.OWRITE|protocol.OTRUNC)
+
+	if st := s.mustStat(fid); st.Length != 0 {
+		s.Errorf("length after OTRUNC is %d, expected 0", st.Length)
+	}
+}
+
+func testOpenRemoveOnClose(s *session) {
+	s.mkfile(rootFid, "f", 0666, "hello")
+
+	fid := s.mustWalk(rootFid, "f")
+	s.mustOpen(fid, protocol.OREAD|protocol.ORCLOSE)
+	if !s.exists("f") {
+		s.Fatalf("file removed before clunk")
+	}
+	s.mustClunk(fid)
+
+	if s.exists("f") {
+		s.Errorf("file opened with ORCLOSE exists after clunk")
+	}
+}
+
+func testCreateFile(s *session) {
+	fid := s.mustWalk(rootFid)
+	q, err := s.create(fid, "f", 0666, protocol.ORDWR)
+	if err != nil {
+		s.Fatalf("create: %v", err)
+	}
+	if q.Type&protocol.QTDIR != 0 {
+		s.Errorf("created file has directory qid")
+	}
+
+	// The fid now refers to the new file, open with the given mode.
+	s.mustWrite(fid, 0, []byte("hello"))
+	if b := s.mustRead(fid, 0, 100); string(b) != "hello" {
+		s.Errorf("read: got %q, expected hello", b)
+	}
+	st := s.mustStat(fid)
+	if st.Name != "f" || st.Qid.Path != q.Path {
+		s.Errorf("stat of created file: got %+v", st)
+	}
+	s.mustClunk(fid)
+
+	if c := s.contents("f"); c != "hello" {
+		s.Errorf("contents: got %q, expected hello", c)
+	}
+}
+
+func testCreateDir(s *session) {
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	q, err := s.create(fid, "d", 0777|protocol.DMDIR, protocol.OREAD)
+	if err != nil {
+		s.Fatalf("create: %v", err)
+	}
+	if q.Type&protocol.QTDIR == 0 {
+		s.Errorf("created directory lacks QTDIR")
+	}
+	if st := s.mustStat(fid); st.Mode&protocol.DMDIR == 0 {
+		s.Errorf("created directory mode %#o lacks DMDIR", st.Mode)
+	}
+	if stats := s.readDir(fid, MaxSize); len(stats) != 0 {
+		s.Errorf("new directory has %d entries", len(stats))
+	}
+}
+
+func testCreateExisting(s *session) {
+	s.mkfile(rootFid, "f", 0666, "hello")
+
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	_, err := s.create(fid, "f", 0666, protocol.OWRITE)
+	s.expect(err, fileserver.ErrExist, "create of existing file")
+
+	if c := s.contents("f"); c != "hello" {
+		s.Errorf("failed create changed contents to %q", c)
+	}
+}
+
+func testCreateBadName(s *session) {
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		_, err := s.create(fid, name, 0666, protocol.OWRITE)
+		s.fail(err, "create of %q", name)
+	}
+}
+
+func testCreateInFile(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+	_, err := s.create(fid, "x", 0666, protocol.OWRITE)
+	s.expect(err, fileserver.ErrNotDir, "create in file")
+}
+
+func testCreateOpenFid(s *session) {
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.OREAD)
+
+	_, err := s.create(fid, "f", 0666, protocol.OWRITE)
+	s.expect(err, fileserver.ErrOpen, "create on open fid")
+}
+
+func testCreateDirForWrite(s *session) {
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	_, err := s.create(fid, "d", 0777|protocol.DMDIR, protocol.OWRITE)
+	s.expect(err, fileserver.ErrIsDir, "create of directory for writing")
+
+	if s.exists("d") {
+		s.Errorf("failed create left directory behind")
+	}
+}
+
+func testCreatePermissions(s *session) {
+	root := s.mustStat(rootFid)
+
+	fid := s.mustWalk(rootFid)
+	if _, err := s.create(fid, "f", 0777, protocol.OREAD); err != nil {
+		s.Fatalf("create: %v", err)
+	}
+	st := s.mustStat(fid)
+	s.mustClunk(fid)
+
+	expected := protocol.FileMode(0777) & (^protocol.FileMode(0666) | root.Mode&0666)
+	if st.Mode&0777 != expected {
+		s.Errorf("file mode is %#o, expected %#o", st.Mode&0777, expected)
+	}
+	if st.UID != s.suite.User {
+		s.Errorf("file owner is %q, expected %q", st.UID, s.suite.User)
+	}
+
+	fid = s.mustWalk(rootFid)
+	if _, err := s.create(fid, "d", 0775|protocol.DMDIR, protocol.OREAD); err != nil {
+		s.Fatalf("create: %v", err)
+	}
+	st = s.mustStat(fid)
+	s.mustClunk(fid)
+
+	expected = protocol.FileMode(0775) & (^protocol.FileMode(0777) | root.Mode&0777)
+	if st.Mode&0777 != expected {
+		s.Errorf("directory mode is %#o, expected %#o", st.Mode&0777, expected)
+	}
+}
+
+func testRemoveFile(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+
+	fid := s.mustWalk(rootFid, "f")
+	if err := s.remove(fid); err != nil {
+		s.Fatalf("remove: %v", err)
+	}
+	s.expect(s.clunk(fid), fileserver.ErrUnknownFid, "clunk after remove")
+
+	if s.exists("f") {
+		s.Errorf("file exists after remove")
+	}
+}
+
+func testRemoveNonEmpty(s *session) {
+	s.mkdir(rootFid, "d", 0777)
+	d := s.mustWalk(rootFid, "d")
+	s.mkfile(d, "f", 0666, "")
+
+	s.expect(s.remove(d), fileserver.ErrNotEmpty, "remove of non-empty directory")
+	s.expect(s.clunk(d), fileserver.ErrUnknownFid, "clunk after failed remove")
+
+	if !s.exists("d", "f") {
+		s.Errorf("failed remove removed files")
+	}
+}
+
+func testRemoveRoot(s *session) {
+	fid := s.mustWalk(rootFid)
+	s.fail(s.remove(fid), "remove of root")
+	s.expect(s.clunk(fid), fileserver.ErrUnknownFid, "clunk after failed remove")
+	s.mustStat(rootFid)
+}
+
+func testRemoveOpen(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+
+	fid := s.mustWalk(rootFid, "f")
+	s.mustOpen(fid, protocol.ORDWR)
+	if err := s.remove(fid); err != nil {
+		s.Fatalf("remove of open file: %v", err)
+	}
+	if s.exists("f") {
+		s.Errorf("file exists after remove")
+	}
+}
+
+func testReadWriteOffsets(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.ORDWR)
+
+	s.mustWrite(fid, 0, []byte("hello"))
+	s.mustWrite(fid, 10, []byte("world"))
+
+	if st := s.mustStat(fid); st.Length != 15 {
+		s.Errorf("length is %d, expected 15", st.Length)
+	}
+	expected := "hello\x00\x00\x00\x00\x00world"
+	if b := s.mustRead(fid, 0, 100); string(b) != expected {
+		s.Errorf("read: got %q, expected %q", b, expected)
+	}
+	if b := s.mustRead(fid, 3, 4); string(b) != "lo\x00\x00" {
+		s.Errorf("read at offset: got %q", b)
+	}
+	if b := s.mustRead(fid, 100, 100); len(b) != 0 {
+		s.Errorf("read past end: got %d bytes, expected none", len(b))
+	}
+}
+
+func testReadIOUnit(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.ORDWR)
+
+	data := bytes.Repeat([]byte("0123456789"), 2*MaxSize/10)
+	var offset int
+	chunk := MaxSize - fileserver.IOHeaderSize
+	for offset < len(data) {
+		end := offset + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+		s.mustWrite(fid, uint64(offset), data[offset:end])
+		offset = end
+	}
+
+	_, err := s.write(fid, 0, make([]byte, chunk+1))
+	s.fail(err, "write larger than iounit")
+
+	b := s.mustRead(fid, 0, MaxSize*2)
+	if len(b) > chunk {
+		s.Errorf("read returned %d bytes, more than the iounit %d", len(b), chunk)
+	}
+	if !bytes.Equal(b, data[:len(b)]) {
+		s.Errorf("read returned the wrong data")
+	}
+}
+
+func testDirRead(s *session) {
+	names := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		name := fmt.Sprintf("file-with-a-fairly-long-name-%02d", i)
+		s.mkfile(rootFid, name, 0666, "")
+		names[name] = true
+	}
+
+	for _, count := range []uint32{MaxSize, 500, 128} {
+		fid := s.mustWalk(rootFid)
+		s.mustOpen(fid, protocol.OREAD)
+
+		seen := make(map[string]bool)
+		for _, st := range s.readDir(fid, count) {
+			if seen[st.Name] {
+				s.Errorf("count %d: %s listed twice", count, st.Name)
+			}
+			seen[st.Name] = true
+		}
+		for name := range names {
+			if !seen[name] {
+				s.Errorf("count %d: %s not listed", count, name)
+			}
+		}
+		if len(seen) != len(names) {
+			s.Errorf("count %d: listed %d entries, expected %d", count, len(seen), len(names))
+		}
+
+		s.mustClunk(fid)
+	}
+
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.OREAD)
+	_, err := s.read(fid, 0, 10)
+	s.fail(err, "directory read with a count too small for one entry")
+}
+
+func testDirReadOffsets(s *session) {
+	for i := 0; i < 10; i++ {
+		s.mkfile(rootFid, fmt.Sprintf("f%d", i), 0666, "")
+	}
+
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.OREAD)
+
+	first := s.mustRead(fid, 0, 200)
+	if len(first) == 0 {
+		s.Fatalf("directory read returned nothing")
+	}
+
+	_, err := s.read(fid, uint64(len(first))+1, 200)
+	s.fail(err, "directory read at arbitrary offset")
+
+	// Reading from 0 again starts over.
+	all := s.readDir(fid, MaxSize)
+	if len(all) != 10 {
+		s.Errorf("directory read after rewind listed %d entries, expected 10", len(all))
+	}
+}
+
+func testDirReadQids(s *session) {
+	s.mkdir(rootFid, "d", 0777)
+	s.mkfile(rootFid, "f", 0666, "abc")
+
+	fid := s.mustWalk(rootFid)
+	defer s.mustClunk(fid)
+	s.mustOpen(fid, protocol.OREAD)
+
+	for _, st := range s.readDir(fid, MaxSize) {
+		f := s.mustWalk(rootFid, st.Name)
+		wst := s.mustStat(f)
+		s.mustClunk(f)
+
+		if st.Qid != wst.Qid {
+			s.Errorf("%s: listed qid %+v, stat qid %+v", st.Name, st.Qid, wst.Qid)
+		}
+		if st.Mode != wst.Mode || st.Length != wst.Length || st.UID != wst.UID {
+			s.Errorf("%s: listed stat %+v, stat %+v", st.Name, st, wst)
+		}
+	}
+}
+
+func testWstatRename(s *session) {
+	s.mkfile(rootFid, "f", 0666, "hello")
+
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	st := dontTouch()
+	st.Name = "g"
+	if err := s.wstat(fid, st); err != nil {
+		s.Fatalf("rename: %v", err)
+	}
+
+	if s.exists("f") {
+		s.Errorf("old name exists after rename")
+	}
+	if c := s.contents("g"); c != "hello" {
+		s.Errorf("contents after rename: got %q, expected hello", c)
+	}
+	if st := s.mustStat(fid); st.Name != "g" {
+		s.Errorf("stat after rename: name is %q, expected g", st.Name)
+	}
+}
+
+func testWstatRenameExisting(s *session) {
+	s.mkfile(rootFid, "f", 0666, "f")
+	s.mkfile(rootFid, "g", 0666, "g")
+
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	st := dontTouch()
+	st.Name = "g"
+	s.expect(s.wstat(fid, st), fileserver.ErrExist, "rename onto existing file")
+
+	if s.contents("f") != "f" || s.contents("g") != "g" {
+		s.Errorf("failed rename changed files")
+	}
+}
+
+func testWstatRenameRoot(s *session) {
+	st := dontTouch()
+	st.Name = "root"
+	s.fail(s.wstat(rootFid, st), "rename of root")
+}
+
+func testWstatRenameBadName(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	for _, name := range []string{".", "..", "a/b"} {
+		st := dontTouch()
+		st.Name = name
+		s.fail(s.wstat(fid, st), "rename to %q", name)
+	}
+}
+
+func testWstatDontTouch(s *session) {
+	s.mkfile(rootFid, "f", 0644, "hello")
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	before := s.mustStat(fid)
+	if err := s.wstat(fid, dontTouch()); err != nil {
+		s.Fatalf("wstat with nothing to change: %v", err)
+	}
+	after := s.mustStat(fid)
+
+	before.Atime, after.Atime = 0, 0
+	if before != after {
+		s.Errorf("wstat with nothing to change changed %+v to %+v", before, after)
+	}
+}
+
+func testWstatLength(s *session) {
+	s.mkfile(rootFid, "f", 0666, "hello")
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	st := dontTouch()
+	st.Length = 2
+	if err := s.wstat(fid, st); err != nil {
+		s.Fatalf("truncate: %v", err)
+	}
+	if c := s.contents("f"); c != "he" {
+		s.Errorf("contents after truncate: got %q, expected he", c)
+	}
+
+	st.Length = 5
+	if err := s.wstat(fid, st); err != nil {
+		s.Fatalf("extend: %v", err)
+	}
+	if c := s.contents("f"); c != "he\x00\x00\x00" {
+		s.Errorf("contents after extend: got %q", c)
+	}
+}
+
+func testWstatDirLength(s *session) {
+	s.mkdir(rootFid, "d", 0777)
+	fid := s.mustWalk(rootFid, "d")
+	defer s.mustClunk(fid)
+
+	st := dontTouch()
+	st.Length = 10
+	s.fail(s.wstat(fid, st), "set length of directory")
+}
+
+func testWstatMode(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	st := dontTouch()
+	st.Mode = 0600
+	if err := s.wstat(fid, st); err != nil {
+		s.Fatalf("chmod: %v", err)
+	}
+	if st := s.mustStat(fid); st.Mode&0777 != 0600 {
+		s.Errorf("mode after chmod is %#o, expected 0600", st.Mode&0777)
+	}
+
+	st.Mode = 0600 | protocol.DMDIR
+	s.fail(s.wstat(fid, st), "setting DMDIR on file")
+}
+
+func testWstatOwner(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	st := dontTouch()
+	st.UID = s.suite.User + "-other"
+	s.fail(s.wstat(fid, st), "change of owner")
+}
+
+func testWstatMtime(s *session) {
+	s.mkfile(rootFid, "f", 0666, "")
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	st := dontTouch()
+	st.Mtime = 1000000000
+	if err := s.wstat(fid, st); err != nil {
+		s.Fatalf("set mtime: %v", err)
+	}
+	if st := s.mustStat(fid); st.Mtime != 1000000000 {
+		s.Errorf("mtime is %d, expected 1000000000", st.Mtime)
+	}
+}
+
+func testWstatAtomic(s *session) {
+	s.mkfile(rootFid, "f", 0666, "hello")
+	fid := s.mustWalk(rootFid, "f")
+	defer s.mustClunk(fid)
+
+	before := s.mustStat(fid)
+
+	// The rename and truncate are fine on their own, but the change of
+	// owner is not, so nothing may happen.
+	st := dontTouch()
+	st.Name = "g"
+	st.Length = 1
+	st.UID = s.suite.User + "-other"
+	s.fail(s.wstat(fid, st), "wstat with illegal change")
+
+	if !s.exists("f") || s.exists("g") {
+		s.Errorf("failed wstat renamed file")
+	}
+	if after := s.mustStat(fid); after.Length != before.Length {
+		s.Errorf("failed wstat changed length to %d", after.Length)
+	}
+}
+
+// attachOther attaches a new fid to the root as the other user.
+func (s *session) attachOther() protocol.Fid {
+	s.Helper()
+	fid := s.fid()
+	if _, err := s.attach(fid, s.suite.Other); err != nil {
+		s.Fatalf("attach as %s: %v", s.suite.Other, err)
+	}
+	return fid
+}
+
+func testPermRead(s *session) {
+	s.mkfile(rootFid, "f", 0644, "hello")
+	other := s.attachOther()
+	defer s.mustClunk(other)
+
+	fid := s.mustWalk(other, "f")
+	s.mustOpen(fid, protocol.OREAD)
+	s.mustClunk(fid)
+
+	fid = s.mustWalk(other, "f")
+	_, err := s.open(fid, protocol.OWRITE)
+	s.expect(err, fileserver.ErrPermission, "open for writing without permission")
+	s.mustClunk(fid)
+}
+
+func testPermCreate(s *session) {
+	s.mkdir(rootFid, "d", 0755)
+	other := s.attachOther()
+	defer s.mustClunk(other)
+
+	fid := s.mustWalk(other, "d")
+	defer s.mustClunk(fid)
+	_, err := s.create(fid, "f", 0666, protocol.OWRITE)
+	s.expect(err, fileserver.ErrPermission, "create without permission")
+}
+
+func testPermWalk(s *session) {
+	s.mkdir(rootFid, "d", 0700)
+	d := s.mustWalk(rootFid, "d")
+	s.mkfile(d, "f", 0666, "")
+	s.mustClunk(d)
+
+	other := s.attachOther()
+	defer s.mustClunk(other)
+
+	fid := s.fid()
+	qids, err := s.walk(other, fid, "d", "f")
+	if err != nil {
+		s.Fatalf("walk: %v", err)
+	}
+	if len(qids) != 1 {
+		s.Errorf("walk through directory without permission: got %d qids, expected 1", len(qids))
+	}
+	s.expect(s.clunk(fid), fileserver.ErrUnknownFid, "clunk of newfid after partial walk")
+}
+
+func testPermRemove(s *session) {
+	s.mkdir(rootFid, "d", 0755)
+	d := s.mustWalk(rootFid, "d")
+	s.mkfile(d, "f", 0666, "")
+	s.mustClunk(d)
+
+	other := s.attachOther()
+	defer s.mustClunk(other)
+
+	fid := s.mustWalk(other, "d", "f")
+	s.expect(s.remove(fid), fileserver.ErrPermission, "remove without permission")
+	if !s.exists("d", "f") {
+		s.Errorf("file removed without permission")
+	}
+}
+
+func testPermWstat(s *session) {
+	s.mkdir(rootFid, "d", 0755)
+	d := s.mustWalk(rootFid, "d")
+	s.mkfile(d, "f", 0666, "")
+	s.mustClunk(d)
+
+	other := s.attachOther()
+	defer s.mustClunk(other)
+
+	fid := s.mustWalk(other, "d", "f")
+	defer s.mustClunk(fid)
+
+	st := dontTouch()
+	st.Mode = 0777
+	s.expect(s.wstat(fid, st), fileserver.ErrPermission, "chmod by other user")
+
+	st = dontTouch()
+	st.Name = "g"
+	s.expect(s.wstat(fid, st), fileserver.ErrPermission, "rename without permission")
+
+	// Writing to the file is allowed, and so is changing its length.
+	st = dontTouch()
+	st.Length = 0
+	if err := s.wstat(fid, st); err != nil {
+		s.Errorf("truncate with permission: %v", err)
+	}
+}
+
+func testPermRemoveOnClose(s *session) {
+	s.mkdir(rootFid, "d", 0755)
+	d := s.mustWalk(rootFid, "d")
+	s.mkfile(d, "f", 0666, "")
+	s.mustClunk(d)
+
+	other := s.attachOther()
+	defer s.mustClunk(other)
+
+	fid := s.mustWalk(other, "d", "f")
+	defer s.mustClunk(fid)
+	_, err := s.open(fid, protocol.OREAD|protocol.ORCLOSE)
+	s.expect(err, fileserver.ErrPermission, "ORCLOSE without permission to remove")
+}
+
+func testFlush(s *session) {
+	// Flushing a tag that is not in use is harmless.
+	if err := s.flush(s.c.NextTag()); err != nil {
+		s.Fatalf("flush: %v", err)
+	}
+	s.mustStat(rootFid)
+}
+
+func testFidReuse(s *session) {
+	fid := s.mustWalk(rootFid)
+	s.mustClunk(fid)
+
+	if _, err := s.walk(rootFid, fid); err != nil {
+		s.Fatalf("walk to clunked fid: %v", err)
+	}
+	s.mustClunk(fid)
+	s.expect(s.clunk(fid), fileserver.ErrUnknownFid, "second clunk")
+
+	if _, err := s.attach(fid, s.suite.User); err != nil {
+		s.Fatalf("attach to clunked fid: %v", err)
+	}
+	s.mustClunk(fid)
+}
+
+func testFidUnknown(s *session) {
+	fid := s.fid()
+	_, err := s.stat(fid)
+	s.expect(err, fileserver.ErrUnknownFid, "stat")
+	_, err = s.open(fid, protocol.OREAD)
+	s.expect(err, fileserver.ErrUnknownFid, "open")
+	_, err = s.walk(fid, s.fid())
+	s.expect(err, fileserver.ErrUnknownFid, "walk")
+	_, err = s.read(fid, 0, 10)
+	s.expect(err, fileserver.ErrUnknownFid, "read")
+	s.expect(s.wstat(fid, dontTouch()), fileserver.ErrUnknownFid, "wstat")
+	s.expect(s.remove(fid), fileserver.ErrUnknownFid, "remove")
+}
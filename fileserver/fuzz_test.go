@@ -0,0 +1,286 @@
+package fileserver_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// The fuzzer works with a handful of fids, names and users, so that the
+// random requests mostly refer to things that exist.
+const (
+	fuzzFids     = 8
+	fuzzMaxSize  = 1024
+	fuzzMaxWrite = 2 * fuzzMaxSize
+)
+
+var (
+	fuzzNames = []string{"a", "b", "c", "..", ".", "", "a/b", "d"}
+	fuzzUsers = []string{"glenda", "other"}
+)
+
+// fuzzInput hands out the fuzzer data a byte at a time, and zeroes once it
+// runs dry.
+type fuzzInput struct {
+	data []byte
+}
+
+func (in *fuzzInput) done() bool {
+	return len(in.data) == 0
+}
+
+func (in *fuzzInput) byte() byte {
+	if len(in.data) == 0 {
+		return 0
+	}
+	b := in.data[0]
+	in.data = in.data[1:]
+	return b
+}
+
+func (in *fuzzInput) uint16() uint16 {
+	return uint16(in.byte()) | uint16(in.byte())<<8
+}
+
+func (in *fuzzInput) fid() protocol.Fid {
+	return protocol.Fid(in.byte() % fuzzFids)
+}
+
+func (in *fuzzInput) name() string {
+	return fuzzNames[int(in.byte())%len(fuzzNames)]
+}
+
+func (in *fuzzInput) user() string {
+	return fuzzUsers[int(in.byte())%len(fuzzUsers)]
+}
+
+func (in *fuzzInput) names() []string {
+	// Allow a few more than MaxWalkElements to reach the limit.
+	n := int(in.byte()) % (fileserver.MaxWalkElements + 3)
+	names := make([]string, n)
+	for i := range names {
+		names[i] = in.name()
+	}
+	return names
+}
+
+// fuzzer runs a sequence of requests against a FileServer, and keeps track
+// of the fids that must exist after each.
+type fuzzer struct {
+	t    *testing.T
+	fs   *fileserver.FileServer
+	tag  protocol.Tag
+	fids map[protocol.Fid]bool
+}
+
+func newFuzzer(t *testing.T) *fuzzer {
+	root := ramtree.NewRAMTree("/", 0777, "glenda", "glenda")
+	return &fuzzer{
+		t:    t,
+		fs:   fileserver.NewFileServer(root, nil, fuzzMaxSize, fileserver.Quiet),
+		fids: make(map[protocol.Fid]bool),
+	}
+}
+
+func (f *fuzzer) nextTag() protocol.Tag {
+	f.tag++
+	if f.tag == protocol.NOTAG {
+		f.tag = 0
+	}
+	return f.tag
+}
+
+func (f *fuzzer) step(in *fuzzInput) {
+	switch in.byte() % 12 {
+	case 0:
+		r := &protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: uint32(in.uint16()), Version: "9P2000"}
+		if in.byte()%4 == 0 {
+			r.Version = "9P3000"
+		}
+		if _, err := f.fs.Version(r); err == nil {
+			f.fids = make(map[protocol.Fid]bool)
+		}
+
+	case 1:
+		r := &protocol.AttachRequest{Tag: f.nextTag(), Fid: in.fid(), AuthFid: protocol.NOFID, Username: in.user()}
+		_, err := f.fs.Attach(r)
+		if err == nil {
+			if f.fids[r.Fid] {
+				f.t.Fatalf("attach to fid %d in use succeeded", r.Fid)
+			}
+			f.fids[r.Fid] = true
+		}
+
+	case 2:
+		r := &protocol.WalkRequest{Tag: f.nextTag(), Fid: in.fid(), NewFid: in.fid(), Names: in.names()}
+		resp, err := f.fs.Walk(r)
+		if err != nil {
+			return
+		}
+		if len(resp.Qids) > len(r.Names) {
+			f.t.Fatalf("walk of %d names returned %d qids", len(r.Names), len(resp.Qids))
+		}
+		if len(r.Names) > 0 && len(resp.Qids) == 0 {
+			f.t.Fatalf("walk succeeded without walking the first name")
+		}
+		if len(resp.Qids) == len(r.Names) {
+			f.fids[r.NewFid] = true
+		}
+
+	case 3:
+		r := &protocol.OpenRequest{Tag: f.nextTag(), Fid: in.fid(), Mode: protocol.OpenMode(in.byte() & 0x53)}
+		f.fs.Open(r)
+
+	case 4:
+		r := &protocol.CreateRequest{
+			Tag:         f.nextTag(),
+			Fid:         in.fid(),
+			Name:        in.name(),
+			Permissions: protocol.FileMode(in.uint16() & 0777),
+			Mode:        protocol.OpenMode(in.byte() & 0x53),
+		}
+		if in.byte()%2 == 0 {
+			r.Permissions |= protocol.DMDIR
+		}
+		f.fs.Create(r)
+
+	case 5:
+		r := &protocol.ReadRequest{Tag: f.nextTag(), Fid: in.fid(), Offset: uint64(in.uint16()), Count: uint32(in.uint16())}
+		if in.byte()%2 == 0 {
+			r.Offset = 0
+		}
+		resp, err := f.fs.Read(r)
+		if err == nil && uint32(len(resp.Data)) > r.Count {
+			f.t.Fatalf("read of %d bytes returned %d", r.Count, len(resp.Data))
+		}
+
+	case 6:
+		n := int(in.uint16()) % fuzzMaxWrite
+		r := &protocol.WriteRequest{Tag: f.nextTag(), Fid: in.fid(), Offset: uint64(in.uint16()), Data: bytes.Repeat([]byte{in.byte()}, n)}
+		resp, err := f.fs.Write(r)
+		if err == nil && int(resp.Count) != n {
+			f.t.Fatalf("write of %d bytes wrote %d", n, resp.Count)
+		}
+
+	case 7:
+		r := &protocol.ClunkRequest{Tag: f.nextTag(), Fid: in.fid()}
+		_, err := f.fs.Clunk(r)
+		if err == nil != f.fids[r.Fid] {
+			f.t.Fatalf("clunk of fid %d: %v, but fid known is %v", r.Fid, err, f.fids[r.Fid])
+		}
+		delete(f.fids, r.Fid)
+
+	case 8:
+		r := &protocol.RemoveRequest{Tag: f.nextTag(), Fid: in.fid()}
+		f.fs.Remove(r)
+		delete(f.fids, r.Fid)
+
+	case 9:
+		r := &protocol.StatRequest{Tag: f.nextTag(), Fid: in.fid()}
+		f.fs.Stat(r)
+
+	case 10:
+		st := protocol.Stat{
+			Type:   ^uint16(0),
+			Dev:    ^uint32(0),
+			Qid:    protocol.Qid{Type: ^protocol.QidType(0), Version: ^uint32(0), Path: ^uint64(0)},
+			Mode:   ^protocol.FileMode(0),
+			Atime:  ^uint32(0),
+			Mtime:  ^uint32(0),
+			Length: ^uint64(0),
+		}
+		// Each bit picks a field to change.
+		b := in.byte()
+		if b&1 != 0 {
+			st.Name = in.name()
+		}
+		if b&2 != 0 {
+			st.Mode = protocol.FileMode(in.uint16() & 0777)
+		}
+		if b&4 != 0 {
+			st.Length = uint64(in.uint16())
+		}
+		if b&8 != 0 {
+			st.Mtime = uint32(in.uint16())
+		}
+		if b&16 != 0 {
+			st.GID = in.user()
+		}
+		if b&32 != 0 {
+			st.UID = in.user()
+		}
+		r := &protocol.WriteStatRequest{Tag: f.nextTag(), Fid: in.fid(), Stat: st}
+		f.fs.WriteStat(r)
+
+	case 11:
+		r := &protocol.FlushRequest{Tag: f.nextTag(), OldTag: protocol.Tag(in.byte())}
+		f.fs.Flush(r)
+	}
+}
+
+func (f *fuzzer) check() {
+	if err := fileserver.CheckInvariants(f.fs); err != nil {
+		f.t.Fatal(err)
+	}
+	if len(f.fs.Fids) != len(f.fids) {
+		f.t.Fatalf("server has %d fids, expected %d", len(f.fs.Fids), len(f.fids))
+	}
+	for fid := range f.fids {
+		if _, ok := f.fs.Fids[fid]; !ok {
+			f.t.Fatalf("fid %d missing", fid)
+		}
+	}
+}
+
+// FuzzFileServer feeds sequences of requests to a FileServer backed by a
+// RAMTree, checking that it keeps track of its fids and tags, and that every
+// fid is released again.
+func FuzzFileServer(f *testing.F) {
+	f.Add([]byte{
+		1, 0, 0, // attach fid 0 as glenda
+		4, 0, 0, 0xff, 0x01, 2, 1, // create file a in fid 0, ORDWR
+		6, 0, 10, 0, 4, 0, 'x', // write 10 bytes at 4
+		5, 0, 0, 0, 0x10, 0, 1, // read
+		2, 0, 1, 0, // clone fid 0 to 1
+	})
+	f.Add([]byte{
+		1, 0, 0,
+		2, 0, 1, 0,
+		4, 1, 7, 0xff, 0x01, 0, 0, // create directory d
+		4, 1, 0, 0xb6, 0x01, 1, 1, // create a inside d
+		2, 0, 2, 3, 7, 0, 3, // walk d/a/..
+		3, 2, 0, // open d
+		5, 2, 0, 0, 100, 0, 0, // read d
+		5, 2, 0, 0, 100, 0, 1,
+		10, 1, 1, // rename
+		8, 1, // remove
+		0, 0, 0x20, 0, // version
+	})
+	f.Add([]byte{
+		1, 0, 1, // attach as other
+		2, 0, 1, 19, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+		10, 0, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		11, 0, 0,
+	})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fz := newFuzzer(t)
+		in := &fuzzInput{data: data}
+		for !in.done() {
+			fz.step(in)
+			fz.check()
+		}
+
+		// Clunking what is left must release every fid.
+		for fid := range fz.fids {
+			if _, err := fz.fs.Clunk(&protocol.ClunkRequest{Tag: fz.nextTag(), Fid: fid}); err != nil {
+				t.Fatalf("clunk of fid %d: %v", fid, err)
+			}
+			delete(fz.fids, fid)
+		}
+		fz.check()
+	})
+}
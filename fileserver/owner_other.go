@@ -0,0 +1,11 @@
+//go:build !unix
+
+package fileserver
+
+import "os"
+
+// ownedByUs reports whether the file described by fi belongs to the user we
+// run as, which cannot be told on this system.
+func ownedByUs(fi os.FileInfo) bool {
+	return true
+}
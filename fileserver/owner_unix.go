@@ -0,0 +1,15 @@
+//go:build unix
+
+package fileserver
+
+import (
+	"os"
+	"syscall"
+)
+
+// ownedByUs reports whether the file described by fi belongs to the user we
+// run as.
+func ownedByUs(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
@@ -0,0 +1,40 @@
+package fileserver
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// socketUser returns the name of the user that the process on the other end
+// of conn, which must be a Unix domain socket, runs as. Users without a name
+// are given their uid.
+func socketUser(conn net.Conn) (string, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return "", errNoPeerCred
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var cred *syscall.Ucred
+	var cerr error
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	uid := strconv.FormatUint(uint64(cred.Uid), 10)
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return uid, nil
+	}
+	return u.Username, nil
+}
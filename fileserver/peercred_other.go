@@ -0,0 +1,17 @@
+//go:build !linux
+
+package fileserver
+
+import (
+	"errors"
+	"net"
+)
+
+// socketUser returns the name of the user that the process on the other end
+// of conn runs as. It is only supported on Linux.
+func socketUser(conn net.Conn) (string, error) {
+	if _, ok := conn.(*net.UnixConn); !ok {
+		return "", errNoPeerCred
+	}
+	return "", errors.New("peer credentials are not supported on this system")
+}
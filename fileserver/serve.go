@@ -0,0 +1,265 @@
+package fileserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kennylevinsen/g9p"
+)
+
+// DefaultPort is the port 9P is served on when an address names none.
+const DefaultPort = "564"
+
+// ParseAddr returns the network and address of a Plan 9 style dial string:
+//
+//	tcp!host!port  tcp, or tcp4 or tcp6; host * is every address, and the
+//	               port defaults to 564
+//	unix!path      a Unix domain socket
+//	ns!name        the Unix domain socket name in the namespace directory
+//
+// Addresses without a network are taken to be paths of Unix domain sockets
+// if they hold a slash, and host:port addresses otherwise.
+func ParseAddr(addr string) (string, string, error) {
+	parts := strings.Split(addr, "!")
+	switch {
+	case len(parts) == 1 && strings.Contains(addr, "/"):
+		return "unix", addr, nil
+	case len(parts) == 1:
+		return "tcp", addr, nil
+	}
+
+	switch parts[0] {
+	case "tcp", "tcp4", "tcp6":
+		if len(parts) > 3 {
+			break
+		}
+		host, port := parts[1], DefaultPort
+		if len(parts) == 3 {
+			port = parts[2]
+		}
+		if host == "*" {
+			host = ""
+		}
+		return parts[0], net.JoinHostPort(host, port), nil
+	case "unix":
+		if len(parts) != 2 || parts[1] == "" {
+			break
+		}
+		return "unix", parts[1], nil
+	case "ns":
+		if len(parts) != 2 || parts[1] == "" || strings.Contains(parts[1], "/") {
+			break
+		}
+		ns, err := Namespace()
+		if err != nil {
+			return "", "", err
+		}
+		return "unix", filepath.Join(ns, parts[1]), nil
+	default:
+		return "", "", fmt.Errorf("unknown network in address %q", addr)
+	}
+	return "", "", fmt.Errorf("malformed address %q", addr)
+}
+
+// Namespace returns the namespace directory, which local services post their
+// Unix domain sockets in, as plan9port does: $NAMESPACE if it is set, and
+// /tmp/ns.$USER.$DISPLAY otherwise, with a DISPLAY of :0 if there is none.
+func Namespace() (string, error) {
+	if ns := os.Getenv("NAMESPACE"); ns != "" {
+		return ns, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	disp := os.Getenv("DISPLAY")
+	if disp == "" {
+		disp = ":0"
+	}
+	// Screens of a display share the namespace.
+	disp = strings.TrimSuffix(disp, ".0")
+	disp = strings.ReplaceAll(disp, "/", "_")
+	return fmt.Sprintf("/tmp/ns.%s.%s", u.Username, disp), nil
+}
+
+// makeNamespace creates the namespace directory if it does not exist, and
+// makes sure that only we have access to it.
+func makeNamespace(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0700 || !ownedByUs(fi) {
+		return fmt.Errorf("bad namespace directory %s: must be a directory owned by us with mode 0700", dir)
+	}
+	return nil
+}
+
+// Listen listens on addr, as taken by ParseAddr. The namespace directory is
+// created if need be, and Unix domain sockets left behind by servers that
+// are gone are replaced.
+func Listen(addr string) (net.Listener, error) {
+	network, address, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		if strings.HasPrefix(addr, "ns!") {
+			if err := makeNamespace(filepath.Dir(address)); err != nil {
+				return nil, err
+			}
+		}
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, err := net.Dial("unix", address); err == nil {
+				c.Close()
+				return nil, fmt.Errorf("%s is in use", address)
+			}
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
+
+// ServeListener serves every connection accepted on l with a FileServer of
+// its own, made by h. Unlike g9p.ServeListener, it clunks the fids left on
+// a connection once it goes away, so that what they hold, such as locks, is
+// released.
+func ServeListener(l net.Listener, h func() *FileServer) error {
+	return serve(l, h, false)
+}
+
+// ServePeerCred is like ServeListener, but attaches are made as the user on
+// the other end of the connection, as found by PeerUser, whatever the client
+// claims. Connections whose user cannot be found are refused.
+func ServePeerCred(l net.Listener, h func() *FileServer) error {
+	return serve(l, h, true)
+}
+
+func serve(l net.Listener, h func() *FileServer, peer bool) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			fs := h()
+			if peer {
+				var err error
+				if fs.User, err = PeerUser(conn); err != nil {
+					log.Printf("Refusing connection from %v: %v", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+			}
+			serveConn(conn, fs)
+		}()
+	}
+}
+
+// errNoPeerCred is returned by PeerUser for connections that carry no
+// credentials.
+var errNoPeerCred = errors.New("peer credentials are only available on Unix domain sockets and TLS connections")
+
+// PeerUser returns the user on the other end of conn. For Unix domain
+// sockets, that is the user the process runs as, so local users cannot pass
+// themselves off as each other. For TLS connections, it is the common name
+// of the verified client certificate, and the handshake is done if it has
+// not been already.
+func PeerUser(conn net.Conn) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return socketUser(conn)
+	}
+	if err := tc.Handshake(); err != nil {
+		return "", err
+	}
+	st := tc.ConnectionState()
+	if len(st.VerifiedChains) == 0 || len(st.PeerCertificates) == 0 {
+		return "", errors.New("no verified client certificate")
+	}
+	cn := st.PeerCertificates[0].Subject.CommonName
+	if cn == "" {
+		return "", errors.New("client certificate has no common name")
+	}
+	return cn, nil
+}
+
+func serveConn(conn net.Conn, fs *FileServer) {
+	cl := &connListener{
+		conn: &watchedConn{Conn: conn, done: make(chan struct{})},
+		next: make(chan net.Conn, 1),
+	}
+	cl.next <- cl.conn
+	go g9p.ServeListener(cl, func() g9p.Handler { return fs })
+
+	<-cl.conn.done
+	conn.Close()
+	fs.Close()
+}
+
+// connListener is a listener that accepts a single connection, and then
+// reports itself closed once that connection is gone.
+type connListener struct {
+	conn *watchedConn
+	next chan net.Conn
+}
+
+func (cl *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-cl.next:
+		return c, nil
+	case <-cl.conn.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (cl *connListener) Close() error {
+	return nil
+}
+
+func (cl *connListener) Addr() net.Addr {
+	return cl.conn.LocalAddr()
+}
+
+// watchedConn closes done once the connection fails or is closed.
+type watchedConn struct {
+	net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *watchedConn) gone() {
+	c.once.Do(func() { close(c.done) })
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil {
+		c.gone()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.gone()
+	}
+	return n, err
+}
+
+func (c *watchedConn) Close() error {
+	c.gone()
+	return c.Conn.Close()
+}
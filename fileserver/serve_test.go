@@ -0,0 +1,77 @@
+package fileserver
+
+import (
+	"net"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	t.Setenv("NAMESPACE", "/tmp/ns.glenda.:0")
+	for _, tc := range []struct {
+		addr, network, address string
+	}{
+		{"localhost:564", "tcp", "localhost:564"},
+		{"/tmp/ns.glenda.:0/ramfs", "unix", "/tmp/ns.glenda.:0/ramfs"},
+		{"tcp!*!5640", "tcp", ":5640"},
+		{"tcp6!::1", "tcp6", "[::1]:564"},
+		{"unix!ramfs.sock", "unix", "ramfs.sock"},
+		{"ns!ramfs", "unix", "/tmp/ns.glenda.:0/ramfs"},
+	} {
+		network, address, err := ParseAddr(tc.addr)
+		if err != nil || network != tc.network || address != tc.address {
+			t.Errorf("%q: got %s %s, %v, expected %s %s", tc.addr, network, address, err, tc.network, tc.address)
+		}
+	}
+
+	for _, addr := range []string{"udp!host!564", "tcp!a!b!c", "unix!", "unix!a!b", "ns!a/b"} {
+		if _, _, err := ParseAddr(addr); err == nil {
+			t.Errorf("%q: parsed", addr)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	ns := filepath.Join(t.TempDir(), "ns")
+	t.Setenv("NAMESPACE", ns)
+
+	l, err := Listen("ns!test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen("ns!test"); err == nil {
+		t.Fatal("listening twice on a socket succeeded")
+	}
+
+	// A socket left behind is replaced.
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	l, err = Listen("ns!test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if runtime.GOOS != "linux" {
+		return
+	}
+	c, err := net.Dial("unix", filepath.Join(ns, "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	name, err := PeerUser(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := user.Current(); err == nil && name != u.Username {
+		t.Fatalf("peer is %s, expected %s", name, u.Username)
+	}
+}
@@ -1,7 +1,9 @@
 package fileserver
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"strings"
 
 	"github.com/kennylevinsen/g9p/protocol"
 )
@@ -35,6 +37,26 @@ type OpenFile interface {
 	Close() error
 }
 
+// ContextReader is implemented by open files whose reads may block, such as
+// event files. The context is cancelled when the read is flushed, or when its
+// fid is clunked or removed.
+type ContextReader interface {
+	ReadContext(ctx context.Context, p []byte) (int, error)
+}
+
+// ContextWriter is implemented by open files whose writes may block. The
+// context is cancelled as for ContextReader.
+type ContextWriter interface {
+	WriteContext(ctx context.Context, p []byte) (int, error)
+}
+
+// UserStatWriter is implemented by files that apply a wstat on behalf of the
+// user making it, such as those that hand the changes on to a host with that
+// user's credentials. The file server uses it in place of WriteStat.
+type UserStatWriter interface {
+	WriteStatAs(user string, s protocol.Stat) error
+}
+
 type FilePath []File
 
 func (fp FilePath) Current() File {
@@ -53,86 +75,273 @@ func (fp FilePath) Parent() File {
 	return fp[len(fp)-2]
 }
 
+// walkTo walks a single name from the end of loc, returning the resulting
+// path. Walking ".." from the root of the path stays at the root.
+func walkTo(user string, loc FilePath, name string) (FilePath, error) {
+	cur := loc.Current()
+	isdir, err := cur.IsDir()
+	if err != nil {
+		return nil, err
+	}
+	if !isdir {
+		return nil, ErrNotDir
+	}
+
+	d, ok := cur.(Dir)
+	if !ok {
+		return nil, ErrNotDir
+	}
+
+	x, err := d.Open(user, protocol.OEXEC)
+	if err != nil {
+		return nil, err
+	}
+	x.Close()
+
+	switch name {
+	case "":
+		return nil, ErrBadName
+	case ".":
+		// This is a nop, but we should still report the result
+		return loc, nil
+	case "..":
+		// Go one directory up, or nop if we're at /
+		if len(loc) > 1 {
+			return loc[:len(loc)-1], nil
+		}
+		return loc, nil
+	}
+
+	// A name with a slash in it would let backends that work on paths walk
+	// several levels at once, or out of their root.
+	if strings.Contains(name, "/") {
+		return nil, ErrNotExist
+	}
+
+	f, err := d.Walk(user, name)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return nil, ErrNotExist
+	}
+
+	return append(loc, f), nil
+}
+
+// checkOpen checks whether the file at the end of loc may be opened with
+// mode. Directories may only be opened for reading, and removing a file on
+// close requires write permission in its directory.
+func checkOpen(user string, loc FilePath, isdir bool, mode protocol.OpenMode) error {
+	if isdir && (mode&3 == protocol.OWRITE || mode&3 == protocol.ORDWR || mode&protocol.OTRUNC != 0) {
+		return ErrIsDir
+	}
+
+	if mode&protocol.ORCLOSE != 0 {
+		if len(loc) <= 1 {
+			return ErrPermission
+		}
+		pstat, err := loc.Parent().Stat()
+		if err != nil {
+			return err
+		}
+		if !hasPerm(user, pstat, protocol.OWRITE) {
+			return ErrPermission
+		}
+	}
+
+	return nil
+}
+
+// remove removes the file at the end of loc from its directory.
+func remove(user string, loc FilePath) error {
+	if len(loc) <= 1 {
+		return ErrPermission
+	}
+
+	cur := loc.Current()
+	p, ok := loc.Parent().(Dir)
+	if !ok {
+		return ErrNotDir
+	}
+
+	pstat, err := p.Stat()
+	if err != nil {
+		return err
+	}
+	if !hasPerm(user, pstat, protocol.OWRITE) {
+		return ErrPermission
+	}
+
+	rem, err := cur.CanRemove()
+	if err != nil {
+		return err
+	}
+	if !rem {
+		return ErrNotEmpty
+	}
+
+	n, err := cur.Name()
+	if err != nil {
+		return err
+	}
+	return p.Remove(user, n)
+}
+
+// isLeader reports whether user is the leader of group. Without a group
+// database, every user leads the group bearing its own name, as on Plan 9.
+func isLeader(user, group string) bool {
+	return user != "" && user == group
+}
+
+// isMember reports whether user is a member of group.
+func isMember(user, group string) bool {
+	return isLeader(user, group)
+}
+
+// hasPerm reports whether the permission bits in st grant user the access
+// requested by mode.
+func hasPerm(user string, st protocol.Stat, mode protocol.OpenMode) bool {
+	var perm protocol.FileMode
+	switch mode & 3 {
+	case protocol.OREAD:
+		perm = protocol.DMREAD
+	case protocol.OWRITE:
+		perm = protocol.DMWRITE
+	case protocol.ORDWR:
+		perm = protocol.DMREAD | protocol.DMWRITE
+	case protocol.OEXEC:
+		perm = protocol.DMEXEC
+	}
+
+	granted := st.Mode & 7
+	if user == st.UID {
+		granted |= (st.Mode >> 6) & 7
+	}
+	if isMember(user, st.GID) {
+		granted |= (st.Mode >> 3) & 7
+	}
+	return granted&perm == perm
+}
+
+// validName reports whether name may be used as a directory entry.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// setStat applies a wstat request to e, which lives in parent (nil for the
+// root). Every field is validated before anything is changed, so the request
+// either succeeds as a whole or leaves the file untouched.
 func setStat(user string, e File, parent Dir, nstat protocol.Stat) error {
 	ostat, err := e.Stat()
 	if err != nil {
 		return err
 	}
 
-	needWrite := false
+	isdir := ostat.Mode&protocol.DMDIR != 0
+	owner := user == ostat.UID
+	leader := isLeader(user, ostat.GID)
+
+	changed := false
 	rename := false
-	curname := ""
-	newname := ""
+	curname := ostat.Name
+	st := ostat
 
 	if nstat.Type != ^uint16(0) && nstat.Type != ostat.Type {
-		return errors.New("it is illegal to modify type")
+		return ErrIllegal
 	}
 	if nstat.Dev != ^uint32(0) && nstat.Dev != ostat.Dev {
-		return errors.New("it is illegal to modify dev")
+		return ErrIllegal
 	}
 	if nstat.Mode != ^protocol.FileMode(0) && nstat.Mode != ostat.Mode {
-		// TODO Ensure we don't flip DMDIR
-		if user != ostat.UID {
-			return errors.New("only owner can change mode")
+		if !owner && !leader {
+			return ErrPermission
+		}
+		if nstat.Mode&protocol.DMDIR != ostat.Mode&protocol.DMDIR {
+			return ErrIllegal
 		}
-		ostat.Mode = ostat.Mode&protocol.DMDIR | nstat.Mode & ^protocol.DMDIR
+		st.Mode = nstat.Mode
+		changed = true
 	}
 	if nstat.Atime != ^uint32(0) && nstat.Atime != ostat.Atime {
-		return errors.New("it is illegal to modify atime")
+		return ErrIllegal
 	}
 	if nstat.Mtime != ^uint32(0) && nstat.Mtime != ostat.Mtime {
-		if user != ostat.UID {
-			return errors.New("only owner can change mtime")
+		if !owner && !leader {
+			return ErrPermission
 		}
-		needWrite = true
-		ostat.Mtime = nstat.Mtime
+		st.Mtime = nstat.Mtime
+		changed = true
 	}
 	if nstat.Length != ^uint64(0) && nstat.Length != ostat.Length {
-		if ostat.Mode&protocol.DMDIR != 0 {
-			return errors.New("cannot set length of directory")
+		if isdir {
+			return ErrIsDir
 		}
-		if nstat.Length > ostat.Length {
-			return errors.New("cannot extend length")
+		if !hasPerm(user, ostat, protocol.OWRITE) {
+			return ErrPermission
 		}
-		ostat.Length = nstat.Length
+		st.Length = nstat.Length
+		changed = true
 	}
 	if nstat.Name != "" && nstat.Name != ostat.Name {
-		if parent != nil {
-			curname = ostat.Name
-			newname = nstat.Name
-			ostat.Name = nstat.Name
-			rename = true
-		} else {
-			return errors.New("it is illegal to rename root")
+		if parent == nil {
+			return ErrIllegal
+		}
+		if !validName(nstat.Name) {
+			return ErrBadName
+		}
+		pstat, err := parent.Stat()
+		if err != nil {
+			return err
+		}
+		if !hasPerm(user, pstat, protocol.OWRITE) {
+			return ErrPermission
 		}
+		st.Name = nstat.Name
+		rename = true
+		changed = true
 	}
 	if nstat.UID != "" && nstat.UID != ostat.UID {
-		// NOTE: It is normally illegal to change the file owner, but we are a bit more relaxed.
-		ostat.UID = nstat.UID
-		needWrite = true
+		return ErrIllegal
 	}
 	if nstat.GID != "" && nstat.GID != ostat.GID {
-		ostat.GID = nstat.GID
-		needWrite = true
+		// The owner may move a file to any group it belongs to, while the
+		// leader of the current group may hand it to a group it also leads.
+		if !(owner && isMember(user, nstat.GID)) && !(leader && isLeader(user, nstat.GID)) {
+			return ErrPermission
+		}
+		st.GID = nstat.GID
+		changed = true
 	}
 	if nstat.MUID != "" && nstat.MUID != ostat.MUID {
-		return errors.New("it is illegal to modify muid")
+		return ErrIllegal
 	}
 
-	if needWrite {
-		x, err := e.Open(user, protocol.OWRITE)
-		if err != nil {
-			return err
-		}
-		x.Close()
+	// A wstat that touches nothing is a request to sync the file, which we
+	// have nothing to do for.
+	if !changed {
+		return nil
 	}
 
-	// Try to perform the rename
 	if rename {
-		if err := parent.Rename(user, curname, newname); err != nil {
+		if err := parent.Rename(user, curname, st.Name); err != nil {
 			return err
 		}
 	}
 
-	return e.WriteStat(ostat)
+	write := e.WriteStat
+	if uw, ok := e.(UserStatWriter); ok {
+		write = func(s protocol.Stat) error { return uw.WriteStatAs(user, s) }
+	}
+	if err := write(st); err != nil {
+		if rename {
+			// Put the name back, so the failed wstat leaves no trace.
+			if rerr := parent.Rename(user, st.Name, curname); rerr != nil {
+				return fmt.Errorf("%v (and rename rollback failed: %v)", err, rerr)
+			}
+		}
+		return err
+	}
+
+	return nil
 }
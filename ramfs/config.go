@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
+)
+
+// options are the settings of a service. Given on the command line or before
+// the first service of the config file, they apply to every service.
+type options struct {
+	user  string
+	group string
+
+	state       string
+	seed        string
+	archiveFile string
+	interval    time.Duration
+	syncPolicy  string
+	journalSize int64
+
+	limits    ramtree.Limits
+	usageFile string
+
+	historyVersions int
+	historyAge      time.Duration
+
+	eventFile    string
+	expiryFile   string
+	reapInterval time.Duration
+
+	trashDir       string
+	trashRetention time.Duration
+
+	spillThreshold int64
+	spillDir       string
+
+	locks bool
+
+	dedup     bool
+	dedupFile string
+
+	dumpDir      string
+	dumpInterval time.Duration
+}
+
+// register adds flags for the options to fs, with their current values as
+// defaults.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.user, "user", o.user, "user that owns /")
+	fs.StringVar(&o.group, "group", o.group, "group that owns /")
+
+	fs.StringVar(&o.state, "state", o.state, "file to keep the tree in between restarts")
+	fs.StringVar(&o.seed, "seed", o.seed, "tar or tar.gz file to fill the tree from, unless it is restored from the state file")
+	fs.StringVar(&o.archiveFile, "archive-file", o.archiveFile, "name of the file in / that reads as a tar archive of the tree, such as archive.tar, empty for none")
+	fs.DurationVar(&o.interval, "interval", o.interval, "time between snapshots of the tree to the state file, 0 to only save on shutdown")
+	fs.StringVar(&o.syncPolicy, "sync", o.syncPolicy, "when to sync the journal to disk: always, periodic or never")
+	fs.Int64Var(&o.journalSize, "journal-size", o.journalSize, "journal size in bytes that triggers a snapshot, 0 for no limit")
+
+	fs.Int64Var(&o.limits.Bytes, "max-bytes", o.limits.Bytes, "total size of all files in bytes, 0 for no limit")
+	fs.Int64Var(&o.limits.Files, "max-files", o.limits.Files, "number of files and directories, 0 for no limit")
+	fs.Int64Var(&o.limits.FileSize, "max-file-size", o.limits.FileSize, "size of a single file in bytes, 0 for no limit")
+	fs.Int64Var(&o.limits.UserBytes, "max-user-bytes", o.limits.UserBytes, "total size of the files of each user in bytes, 0 for no limit")
+	fs.Int64Var(&o.limits.UserFiles, "max-user-files", o.limits.UserFiles, "number of files and directories of each user, 0 for no limit")
+	fs.StringVar(&o.usageFile, "usage-file", o.usageFile, "name of the file in / that reports usage and limits, such as .usage, empty for none")
+
+	fs.IntVar(&o.historyVersions, "history-versions", o.historyVersions, "number of old versions of each file to keep, 0 for no limit; history is off unless this or -history-age is set")
+	fs.DurationVar(&o.historyAge, "history-age", o.historyAge, "time to keep old versions of files for, 0 for no limit")
+
+	fs.StringVar(&o.eventFile, "event-file", o.eventFile, "name of the file in / that reports changes to the tree, such as .events, empty for none")
+	fs.StringVar(&o.expiryFile, "expiry-file", o.expiryFile, "name of the file in / that sets and lists expiry times, such as .expiry, empty for none")
+	fs.DurationVar(&o.reapInterval, "reap-interval", o.reapInterval, "time between removals of expired files and of what has been in the trash too long")
+
+	fs.StringVar(&o.trashDir, "trash", o.trashDir, "name of the directory in / that removed files are moved to, empty to remove them at once")
+	fs.DurationVar(&o.trashRetention, "trash-retention", o.trashRetention, "time to keep removed files in the trash for, 0 to keep them until purged")
+
+	fs.Int64Var(&o.spillThreshold, "spill-threshold", o.spillThreshold, "size in bytes above which the content of a file is moved to disk, 0 to keep everything in memory")
+	fs.StringVar(&o.spillDir, "spill-dir", o.spillDir, "directory to keep content moved to disk in, empty for the default temporary directory")
+
+	fs.BoolVar(&o.locks, "locks", o.locks, "provide advisory locks on files through name.lock")
+
+	fs.BoolVar(&o.dedup, "dedup", o.dedup, "store identical blocks of file content once")
+	fs.StringVar(&o.dedupFile, "dedup-file", o.dedupFile, "name of the file in / that reports how well content is deduplicated, such as .dedup, empty for none")
+
+	fs.StringVar(&o.dumpDir, "dump", o.dumpDir, "name of the directory in / holding dumps of the tree, such as dump, empty for none")
+	fs.DurationVar(&o.dumpInterval, "dump-interval", o.dumpInterval, "time between dumps of the tree, 0 to only dump on request")
+}
+
+// defaultOptions returns the options services have unless told otherwise.
+// The tree is owned by the user running the server, and the files and
+// directories the server can add to / are left out unless asked for.
+func defaultOptions() options {
+	o := options{
+		user:         "none",
+		group:        "none",
+		interval:     5 * time.Minute,
+		syncPolicy:   "always",
+		journalSize:  64 * 1024 * 1024,
+		reapInterval: time.Minute,
+
+		trashRetention: 7 * 24 * time.Hour,
+	}
+	if u, err := user.Current(); err == nil {
+		o.user = u.Username
+		o.group = u.Username
+		if g, err := user.LookupGroupId(u.Gid); err == nil {
+			o.group = g.Name
+		}
+	}
+	return o
+}
+
+var syncPolicies = map[string]ramtree.SyncPolicy{
+	"always":   ramtree.SyncAlways,
+	"periodic": ramtree.SyncPeriodic,
+	"never":    ramtree.SyncNever,
+}
+
+// check reports what is wrong with the options.
+func (o *options) check() error {
+	if o.user == "" || o.group == "" {
+		return errors.New("the user and group owning / must be given")
+	}
+	if _, ok := syncPolicies[o.syncPolicy]; !ok {
+		return fmt.Errorf("unknown sync policy %q, expected always, periodic or never", o.syncPolicy)
+	}
+	for _, v := range []struct {
+		name  string
+		value int64
+	}{
+		{"interval", int64(o.interval)},
+		{"journal-size", o.journalSize},
+		{"max-bytes", o.limits.Bytes},
+		{"max-files", o.limits.Files},
+		{"max-file-size", o.limits.FileSize},
+		{"max-user-bytes", o.limits.UserBytes},
+		{"max-user-files", o.limits.UserFiles},
+		{"history-versions", int64(o.historyVersions)},
+		{"history-age", int64(o.historyAge)},
+		{"trash-retention", int64(o.trashRetention)},
+		{"spill-threshold", o.spillThreshold},
+		{"dump-interval", int64(o.dumpInterval)},
+	} {
+		if v.value < 0 {
+			return fmt.Errorf("-%s must not be negative", v.name)
+		}
+	}
+	if o.reapInterval <= 0 {
+		return errors.New("-reap-interval must be positive")
+	}
+	return nil
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var verbosities = map[string]fileserver.Verbosity{
+	"quiet":     fileserver.Quiet,
+	"chatty":    fileserver.Chatty,
+	"loud":      fileserver.Loud,
+	"obnoxious": fileserver.Obnoxious,
+	"debug":     fileserver.Debug,
+}
+
+// verbosity is a flag naming a fileserver.Verbosity.
+type verbosity fileserver.Verbosity
+
+func (v *verbosity) String() string {
+	for name, vv := range verbosities {
+		if vv == fileserver.Verbosity(*v) {
+			return name
+		}
+	}
+	return ""
+}
+
+func (v *verbosity) Set(s string) error {
+	vv, ok := verbosities[s]
+	if !ok {
+		return fmt.Errorf("expected quiet, chatty, loud, obnoxious or debug")
+	}
+	*v = verbosity(vv)
+	return nil
+}
+
+// minMsize is the smallest message size that leaves room for some data in
+// reads and writes.
+const minMsize = 256
+
+// config is what to serve, and how.
+type config struct {
+	listen   []string
+	peerCred bool
+	msize    uint
+
+	tlsCert     string
+	tlsKey      string
+	tlsClientCA string
+
+	chat     fileserver.Verbosity
+	services []serviceConfig
+}
+
+type serviceConfig struct {
+	name string
+	opts options
+}
+
+// setting is a line of the config file.
+type setting struct {
+	line  int
+	name  string
+	value string
+}
+
+// section is a service in the config file.
+type section struct {
+	line     int
+	name     string
+	settings []setting
+}
+
+// readConfig parses the config file at path. It holds one setting per line,
+// named as the flags without the leading dash:
+//
+//	listen tcp!*!564
+//	verbosity chatty
+//	max-bytes 1073741824
+//
+//	service tmp
+//		trash .trash
+//
+//	service home
+//		state /var/lib/ramfs/home
+//		locks
+//
+// Settings before the first service apply to every service, while those
+// after a service line apply to that service only. Boolean settings may
+// leave out their value, and everything after a # is a comment.
+func readConfig(path string) ([]setting, []section, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var global []setting
+	var sections []section
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+		value := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), name))
+		if name == "service" {
+			if len(fields) != 2 {
+				return nil, nil, fmt.Errorf("%s:%d: expected service name", path, n)
+			}
+			sections = append(sections, section{line: n, name: value})
+			continue
+		}
+		st := setting{line: n, name: name, value: value}
+		if len(sections) == 0 {
+			global = append(global, st)
+		} else {
+			sections[len(sections)-1].settings = append(sections[len(sections)-1].settings, st)
+		}
+	}
+	return global, sections, s.Err()
+}
+
+// apply sets the flags of fs named by settings, leaving out those in skip.
+func apply(fs *flag.FlagSet, path string, settings []setting, skip map[string]bool) error {
+	for _, st := range settings {
+		f := fs.Lookup(st.name)
+		if f == nil {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, st.line, st.name)
+		}
+		if skip[st.name] {
+			continue
+		}
+		value := st.value
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() && value == "" {
+			value = "true"
+		}
+		if err := fs.Set(st.name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value %q for %s: %v", path, st.line, value, st.name, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig parses the command line args, and the config file it names,
+// into a config. Flags given on the command line take precedence over the
+// settings before the first service of the config file, and the settings of
+// a service over both.
+func parseConfig(fs *flag.FlagSet, args []string) (*config, error) {
+	cfg := &config{msize: 10 * 1024 * 1024}
+	defaults := defaultOptions()
+	var (
+		configFile string
+		listen     stringList
+		services   stringList
+		chat       verbosity
+	)
+	fs.StringVar(&configFile, "config", "", "file to read settings from")
+	fs.Var(&listen, "listen", "address to serve on, such as tcp!*!564, unix!/tmp/ramfs or ns!ramfs for the namespace directory; may be given more than once")
+	fs.BoolVar(&cfg.peerCred, "peercred", false, "attach as the user on the other end of Unix domain sockets, whatever the client claims")
+	fs.UintVar(&cfg.msize, "msize", cfg.msize, "largest 9P message size in bytes")
+	fs.StringVar(&cfg.tlsCert, "tls-cert", "", "PEM file with the certificate to serve TCP addresses over TLS with")
+	fs.StringVar(&cfg.tlsKey, "tls-key", "", "PEM file with the key of the -tls-cert certificate")
+	fs.StringVar(&cfg.tlsClientCA, "tls-client-ca", "", "PEM file with the authorities that must sign client certificates, whose common name is then the user attached as")
+	fs.Var(&chat, "verbosity", "what to log of the 9P traffic: quiet, chatty, loud, obnoxious or debug")
+	fs.Var(&services, "service", "name of a service to serve a tree as; may be given more than once")
+	defaults.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	switch fs.NArg() {
+	case 0:
+	case 4:
+		// The service, owner and address were once given as arguments.
+		services = append(services, fs.Arg(0))
+		defaults.user, defaults.group = fs.Arg(1), fs.Arg(2)
+		listen = append(listen, fs.Arg(3))
+		set["user"], set["group"], set["listen"] = true, true, true
+	default:
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	var sections []section
+	if configFile != "" {
+		var global []setting
+		var err error
+		global, sections, err = readConfig(configFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := apply(fs, configFile, global, set); err != nil {
+			return nil, err
+		}
+	}
+
+	cfg.listen = listen
+	cfg.chat = fileserver.Verbosity(chat)
+	if len(cfg.listen) == 0 {
+		return nil, errors.New("no address to listen on, give one with -listen")
+	}
+	for _, addr := range cfg.listen {
+		network, _, err := fileserver.ParseAddr(addr)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.peerCred && network != "unix" {
+			return nil, fmt.Errorf("-peercred needs Unix domain sockets, and %s is not one", addr)
+		}
+	}
+	if (cfg.tlsCert == "") != (cfg.tlsKey == "") {
+		return nil, errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if cfg.tlsClientCA != "" && cfg.tlsCert == "" {
+		return nil, errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+	if cfg.msize < minMsize || cfg.msize > fileserver.DefaultMaxSize {
+		return nil, fmt.Errorf("-msize must be between %d and %d", minMsize, fileserver.DefaultMaxSize)
+	}
+
+	seen := make(map[string]bool)
+	add := func(name string, opts options) error {
+		if seen[name] {
+			return fmt.Errorf("service %q given more than once", name)
+		}
+		seen[name] = true
+		if err := opts.check(); err != nil {
+			return fmt.Errorf("service %q: %v", name, err)
+		}
+		cfg.services = append(cfg.services, serviceConfig{name: name, opts: opts})
+		return nil
+	}
+	for _, sec := range sections {
+		opts := defaults
+		sfs := flag.NewFlagSet(sec.name, flag.ContinueOnError)
+		opts.register(sfs)
+		if err := apply(sfs, configFile, sec.settings, nil); err != nil {
+			return nil, err
+		}
+		if err := add(sec.name, opts); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range services {
+		if err := add(name, defaults); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.services) == 0 {
+		return nil, errors.New("no service to serve, give one with -service")
+	}
+
+	states := make(map[string]string)
+	for _, sc := range cfg.services {
+		if sc.opts.state == "" {
+			continue
+		}
+		if other, ok := states[sc.opts.state]; ok {
+			return nil, fmt.Errorf("services %q and %q share the state file %s", other, sc.name, sc.opts.state)
+		}
+		states[sc.opts.state] = sc.name
+	}
+	return cfg, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func parse(t *testing.T, config string, args ...string) (*config, error) {
+	if config != "" {
+		path := filepath.Join(t.TempDir(), "ramfs.conf")
+		if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args = append([]string{"-config", path}, args...)
+	}
+	fs := flag.NewFlagSet("ramfs", flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	return parseConfig(fs, args)
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := parse(t, `
+listen tcp!*!5640   # everywhere
+max-bytes 100
+user glenda
+
+service tmp
+	trash .trash
+	max-bytes 200
+	usage-file .usage
+
+service home
+	locks
+	state /tmp/home
+`, "-max-bytes", "50", "-service", "scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.listen) != 1 || cfg.listen[0] != "tcp!*!5640" {
+		t.Fatalf("listening on %v", cfg.listen)
+	}
+	if len(cfg.services) != 3 {
+		t.Fatalf("%d services, expected 3", len(cfg.services))
+	}
+	tmp, home, scratch := cfg.services[0], cfg.services[1], cfg.services[2]
+	if tmp.name != "tmp" || tmp.opts.trashDir != ".trash" || tmp.opts.limits.Bytes != 200 || tmp.opts.user != "glenda" || tmp.opts.usageFile != ".usage" {
+		t.Fatalf("tmp: %+v", tmp)
+	}
+	if home.name != "home" || !home.opts.locks || home.opts.state != "/tmp/home" || home.opts.limits.Bytes != 50 {
+		t.Fatalf("home: %+v", home)
+	}
+	if scratch.name != "scratch" || scratch.opts.locks || scratch.opts.trashDir != "" {
+		t.Fatalf("scratch: %+v", scratch)
+	}
+	// What the server adds to / is off unless asked for.
+	o := scratch.opts
+	for _, name := range []string{o.archiveFile, o.usageFile, o.eventFile, o.expiryFile, o.dedupFile, o.dumpDir} {
+		if name != "" {
+			t.Fatalf("scratch adds %q to /", name)
+		}
+	}
+}
+
+func TestConfigLegacy(t *testing.T) {
+	cfg, err := parse(t, "", "-msize", "8192", "ramfs", "glenda", "sys", "localhost:564")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.services) != 1 || cfg.services[0].opts.user != "glenda" || cfg.services[0].opts.group != "sys" || cfg.msize != 8192 {
+		t.Fatalf("got %+v", cfg)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		args   []string
+	}{
+		{"", []string{"-service", "a"}},
+		{"", []string{"-listen", ":564"}},
+		{"", []string{"-listen", ":564", "-service", "a", "-service", "a"}},
+		{"", []string{"-listen", ":564", "-service", "a", "-service", "b", "-state", "/tmp/s"}},
+		{"", []string{"-listen", ":564", "-service", "a", "-msize", "10"}},
+		{"", []string{"-listen", "udp!x!1", "-service", "a"}},
+		{"", []string{"-listen", ":564", "-service", "a", "-sync", "sometimes"}},
+		{"", []string{"-listen", ":564", "-service", "a", "-max-bytes", "-1"}},
+		{"", []string{"-verbosity", "shouty"}},
+		{"", []string{"-listen", ":564", "-service", "a", "-tls-cert", "cert.pem"}},
+		{"", []string{"-listen", ":564", "-service", "a", "-tls-client-ca", "ca.pem"}},
+		{"", []string{"-listen", "unix!ramfs.sock", "-listen", ":564", "-service", "a", "-peercred"}},
+		{"listen :564\nservice a\n\tlisten :565\n", nil},
+		{"listen :564\nservice a\n\tmax-bytes lots\n", nil},
+		{"listen :564\nservice\n", nil},
+	} {
+		if _, err := parse(t, tc.config, tc.args...); err == nil {
+			t.Errorf("%q %v: parsed", tc.config, tc.args)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package ramtree
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Import adds the files and directories of a tar archive, which may be
+// gzip compressed, to the tree. Modes, owners and modification times are
+// kept. Directories that the archive does not list are created with the
+// owner of the directory they are made in. Directories that already exist
+// are merged with those in the archive, but existing files are not
+// replaced.
+//
+// Nothing is recorded in the journal, so, like Add, it is meant for setting
+// up a tree before it is served.
+func (t *RAMTree) Import(r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg:
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return fmt.Errorf("%s: unsupported file type %q", hdr.Name, hdr.Typeflag)
+		}
+
+		elems, err := archivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if len(elems) == 0 {
+			// The root itself, as listed by "tar -C dir .".
+			if hdr.Typeflag == tar.TypeDir {
+				t.Lock()
+				t.setArchived(hdr)
+				t.Unlock()
+			}
+			continue
+		}
+
+		dir, err := t.mkdirAll(elems[:len(elems)-1])
+		if err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if err := dir.importEntry(elems[len(elems)-1], hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// archivePath splits a path from an archive into its elements, refusing
+// those that would leave the tree.
+func archivePath(name string) ([]string, error) {
+	var elems []string
+	for _, e := range strings.Split(name, "/") {
+		switch e {
+		case "", ".":
+		case "..":
+			return nil, fmt.Errorf("%s: path leaves the tree", name)
+		default:
+			elems = append(elems, e)
+		}
+	}
+	return elems, nil
+}
+
+// mkdirAll returns the directory at the path given by elems, creating the
+// directories that are missing.
+func (t *RAMTree) mkdirAll(elems []string) (*RAMTree, error) {
+	dir := t
+	for _, name := range elems {
+		dir.Lock()
+		f, ok := dir.tree[name]
+		if !ok {
+			f = dir.create(time.Now(), nextID(), name, protocol.DMDIR|0755, dir.user, dir.group)
+		}
+		dir.Unlock()
+
+		next, ok := f.(*RAMTree)
+		if !ok {
+			return nil, fileserver.ErrNotDir
+		}
+		dir = next
+	}
+	return dir, nil
+}
+
+// importEntry adds name as described by hdr, reading the content of files
+// from r.
+func (t *RAMTree) importEntry(name string, hdr *tar.Header, r io.Reader) error {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	existing, ok := t.tree[name]
+
+	if hdr.Typeflag == tar.TypeDir {
+		if !ok {
+			existing = t.create(now, nextID(), name, protocol.DMDIR|archiveMode(hdr), t.user, t.group)
+		}
+		dir, isDir := existing.(*RAMTree)
+		if !isDir {
+			return fileserver.ErrExist
+		}
+		dir.Lock()
+		dir.setArchived(hdr)
+		dir.Unlock()
+		return nil
+	}
+
+	if ok {
+		return fileserver.ErrExist
+	}
+	f := t.create(now, nextID(), name, archiveMode(hdr), t.user, t.group).(*RAMFile)
+	f.Lock()
+	defer f.Unlock()
+	if err := f.content.load(r, hdr.Size); err != nil {
+		return err
+	}
+	f.user, f.group = archiveOwner(hdr)
+	f.muser = f.user
+	f.mtime = hdr.ModTime
+	f.atime = hdr.ModTime
+	return nil
+}
+
+// setArchived takes the mode, owners and modification time of a directory
+// from hdr. The caller must hold the lock.
+func (t *RAMTree) setArchived(hdr *tar.Header) {
+	t.permissions = archiveMode(hdr)
+	t.user, t.group = archiveOwner(hdr)
+	t.muser = t.user
+	t.mtime = hdr.ModTime
+	t.atime = hdr.ModTime
+}
+
+func archiveMode(hdr *tar.Header) protocol.FileMode {
+	return protocol.FileMode(hdr.Mode & 0777)
+}
+
+// archiveOwner returns the owners of an entry by name, falling back to the
+// numeric IDs for archives that do not carry names.
+func archiveOwner(hdr *tar.Header) (string, string) {
+	user, group := hdr.Uname, hdr.Gname
+	if user == "" {
+		user = strconv.Itoa(hdr.Uid)
+	}
+	if group == "" {
+		group = strconv.Itoa(hdr.Gid)
+	}
+	return user, group
+}
+
+// Export writes the tree to w as a tar archive, with the tree at the root
+// of the archive. Files that are not stored in snapshots are left out. The
+// tree is copied before it is written, in the same way as by Dump.Take, so
+// files are written as they were at one point, but changes made while the
+// copy is taken may or may not be included.
+func (t *RAMTree) Export(w io.Writer) error {
+	dd := freeze(t).(*dumpDir)
+	defer thawDump(dd)
+	return export(w, dd, nil)
+}
+
+// export writes dd to w as a tar archive. If may is not nil, only the
+// directories it lets be read and walked are listed, and only the files it
+// lets be read are written.
+func export(w io.Writer, dd *dumpDir, may func(protocol.Stat, protocol.OpenMode) bool) error {
+	tw := tar.NewWriter(w)
+	if may == nil || may(dd.stat, protocol.OREAD) && may(dd.stat, protocol.OEXEC) {
+		if err := exportDir(tw, "", dd, may); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func exportDir(tw *tar.Writer, prefix string, dd *dumpDir, may func(protocol.Stat, protocol.OpenMode) bool) error {
+	names := make([]string, 0, len(dd.tree))
+	for name := range dd.tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := path.Join(prefix, name)
+		switch f := dd.tree[name].(type) {
+		case *dumpDir:
+			if err := tw.WriteHeader(archiveHeader(p+"/", tar.TypeDir, f.stat)); err != nil {
+				return err
+			}
+			if may != nil && !(may(f.stat, protocol.OREAD) && may(f.stat, protocol.OEXEC)) {
+				continue
+			}
+			if err := exportDir(tw, p, f, may); err != nil {
+				return err
+			}
+		case *dumpFile:
+			if may != nil && !may(f.stat, protocol.OREAD) {
+				continue
+			}
+			hdr := archiveHeader(p, tar.TypeReg, f.stat)
+			hdr.Size = f.content.Len()
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := f.content.WriteTo(tw); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func archiveHeader(name string, typ byte, st protocol.Stat) *tar.Header {
+	return &tar.Header{
+		Typeflag: typ,
+		Name:     name,
+		Mode:     int64(st.Mode & 0777),
+		Uname:    st.UID,
+		Gname:    st.GID,
+		ModTime:  time.Unix(int64(st.Mtime), 0),
+	}
+}
+
+// ArchiveFile returns a read-only file that reads as a tar archive of the
+// tree, as written by Export, holding only what the reader may read. The
+// tree is copied when the file is opened, and the archive is written as it
+// is read, so it can only be read in order. It can be added to a tree with
+// RAMTree.Add.
+func (t *RAMTree) ArchiveFile(name, user, group string) fileserver.File {
+	return &archiveFile{
+		synthFile: newSynthFile(name, 0444, user, group, nil, nil),
+		t:         t,
+	}
+}
+
+type archiveFile struct {
+	*synthFile
+	t *RAMTree
+}
+
+func (f *archiveFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if !permCheck(f.user == user, f.permissions, mode) {
+		return nil, fileserver.ErrPermission
+	}
+
+	dd := freeze(f.t).(*dumpDir)
+	r, w := io.Pipe()
+	of := &archiveOpenFile{r: r, done: make(chan struct{})}
+	go func() {
+		defer close(of.done)
+		err := export(w, dd, func(st protocol.Stat, mode protocol.OpenMode) bool {
+			return permCheck(st.UID == user, st.Mode, mode)
+		})
+		thawDump(dd)
+		w.CloseWithError(err)
+	}()
+	return of, nil
+}
+
+type archiveOpenFile struct {
+	r      *io.PipeReader
+	offset int64
+
+	// done is closed once the archive has been written, or has stopped
+	// being written as the file was closed.
+	done chan struct{}
+}
+
+// Seek skips ahead to offset, as what has been read is gone.
+func (of *archiveOpenFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += of.offset
+	default:
+		return of.offset, errors.New("invalid whence value")
+	}
+	if offset < of.offset {
+		return of.offset, errors.New("archive can only be read in order")
+	}
+	n, err := io.CopyN(io.Discard, of.r, offset-of.offset)
+	of.offset += n
+	if err != nil && err != io.EOF {
+		return of.offset, err
+	}
+	return offset, nil
+}
+
+func (of *archiveOpenFile) Read(p []byte) (int, error) {
+	for {
+		// The pipe passes on empty writes, which must not read as the
+		// end of the archive.
+		n, err := of.r.Read(p)
+		if n > 0 || err != nil || len(p) == 0 {
+			of.offset += int64(n)
+			return n, err
+		}
+	}
+}
+
+func (of *archiveOpenFile) Write(p []byte) (int, error) {
+	return 0, fileserver.ErrPermission
+}
+
+func (of *archiveOpenFile) Close() error {
+	err := of.r.Close()
+	<-of.done
+	return err
+}
@@ -0,0 +1,146 @@
+package ramtree
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	root := newTestTree(t)
+	root.Add("archive.tar", root.ArchiveFile("archive.tar", "glenda", "glenda"))
+
+	archive := readAll(t, root.tree["archive.tar"])
+	restored := NewRAMTree("/", 0777, "glenda", "glenda")
+	if err := restored.Import(bytes.NewReader(archive)); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if _, ok := restored.tree["archive.tar"]; ok {
+		t.Fatal("archive file included in archive")
+	}
+
+	for _, p := range [][]string{{"dir"}, {"dir", "file"}, {"empty"}} {
+		a, b := lookup(t, root, p), lookup(t, restored, p)
+		sa, _ := a.Stat()
+		sb, _ := b.Stat()
+		if sa.Mode != sb.Mode || sa.UID != sb.UID || sa.GID != sb.GID || sa.Mtime != sb.Mtime || sa.Length != sb.Length {
+			t.Errorf("%v: stat differs: %+v and %+v", p, sa, sb)
+		}
+	}
+	if c := readAll(t, lookup(t, restored, []string{"dir", "file"})); string(c) != "hello, world" {
+		t.Errorf("content is %q", c)
+	}
+}
+
+// TestArchiveFilePermission checks that the archive holds only what its
+// reader may read, and that the files copied for it are given back.
+func TestArchiveFilePermission(t *testing.T) {
+	root := newTestTree(t)
+	af := root.ArchiveFile("archive.tar", "glenda", "glenda")
+
+	names := func(user string) []string {
+		of, err := af.Open(user, protocol.OREAD)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer of.Close()
+		var names []string
+		tr := tar.NewReader(of)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return names
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, hdr.Name)
+		}
+	}
+	if got := strings.Join(names("glenda"), " "); got != "dir/ dir/file empty" {
+		t.Fatalf("archive read by the owner holds %q", got)
+	}
+	// dir is 0750 and empty 0600.
+	if got := strings.Join(names("other"), " "); got != "dir/" {
+		t.Fatalf("archive read by other holds %q", got)
+	}
+
+	rf := lookup(t, root, []string{"dir", "file"}).(*RAMFile)
+	rf.RLock()
+	frozen := rf.frozen
+	rf.RUnlock()
+	if frozen != 0 {
+		t.Fatalf("%d copies of the file held after reading archives", frozen)
+	}
+}
+
+func lookup(t *testing.T, root *RAMTree, p []string) fileserver.File {
+	var f fileserver.File = root
+	for _, name := range p {
+		f = f.(*RAMTree).tree[name]
+		if f == nil {
+			t.Fatalf("%v: not found", p)
+		}
+	}
+	return f
+}
+
+func TestImportGzip(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "./a/b/c", Mode: 0640, Uid: 1000, Gid: 100, ModTime: mtime, Size: 3})
+	tw.Write([]byte("abc"))
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0700, Uname: "glenda", Gname: "sys", ModTime: mtime})
+	tw.Close()
+	zw.Close()
+
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	if err := root.Import(&buf); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	st, _ := lookup(t, root, []string{"a"}).Stat()
+	if st.Mode != protocol.DMDIR|0700 || st.UID != "glenda" || st.GID != "sys" || st.Mtime != uint32(mtime.Unix()) {
+		t.Errorf("a: unexpected stat %+v", st)
+	}
+	st, _ = lookup(t, root, []string{"a", "b"}).Stat()
+	if st.Mode != protocol.DMDIR|0755 || st.UID != "glenda" {
+		t.Errorf("a/b: unexpected stat %+v", st)
+	}
+	st, _ = lookup(t, root, []string{"a", "b", "c"}).Stat()
+	if st.Mode != 0640 || st.UID != "1000" || st.GID != "100" || st.Length != 3 {
+		t.Errorf("a/b/c: unexpected stat %+v", st)
+	}
+}
+
+func TestImportRejects(t *testing.T) {
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeReg, Name: "../escape"},
+		{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "target"},
+		{Typeflag: tar.TypeReg, Name: "dir"},
+	} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(hdr)
+		tw.Close()
+
+		root := newTestTree(t)
+		err := root.Import(&buf)
+		if err == nil {
+			t.Errorf("%s: import succeeded", hdr.Name)
+		}
+		if hdr.Name == "dir" && !errors.Is(err, fileserver.ErrExist) {
+			t.Errorf("%s: got %v, expected ErrExist", hdr.Name, err)
+		}
+	}
+}
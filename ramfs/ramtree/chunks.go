@@ -0,0 +1,465 @@
+package ramtree
+
+import (
+	"io"
+)
+
+// chunkSize is the size of the blocks file content is stored in.
+const chunkSize = 64 * 1024
+
+// chunks holds the content of a file as fixed-size blocks, so that growing a
+// file never copies what is already there. Blocks that have never been
+// written to are nil, and read as zeroes. Blocks in memory are only as long
+// as what has been written to them, and read as zeroes past that, so that
+// small files take little memory.
+//
+// Blocks may be shared with frozen copies, in which case they are copied
+// before they are changed.
+//
+// Once spilled, blocks are kept in a backing file rather than in memory.
+type chunks struct {
+	blocks [][]byte
+	size   int64
+
+	// shared marks the blocks that frozen copies refer to. It is nil until
+	// the first freeze.
+	shared []bool
+
+	// store holds the blocks that have been spilled, at the offsets in
+	// slots, which are -1 for blocks that are not in it. Both are nil
+	// until the content is first spilled.
+	store *backing
+	slots []int64
+
+	// resident is the number of bytes of the content held in memory.
+	// What blocks have allocated past their length to grow into is not
+	// counted.
+	resident int64
+}
+
+func (c *chunks) Len() int64 {
+	return c.size
+}
+
+// onDisk reports whether block idx is kept in the backing file.
+func (c *chunks) onDisk(idx int64) bool {
+	return c.slots != nil && c.slots[idx] >= 0
+}
+
+// ReadAt reads into p from offset, returning how much was read. Reads stop
+// at the end of the content.
+func (c *chunks) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= c.size {
+		return 0, nil
+	}
+	if rem := c.size - offset; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+
+	n := 0
+	for n < len(p) {
+		idx, off := (offset+int64(n))/chunkSize, (offset+int64(n))%chunkSize
+		l := len(p) - n
+		if l > chunkSize-int(off) {
+			l = chunkSize - int(off)
+		}
+		switch {
+		case c.blocks[idx] != nil:
+			m := 0
+			if b := c.blocks[idx]; int(off) < len(b) {
+				m = copy(p[n:n+l], b[off:])
+			}
+			zero(p[n+m : n+l])
+		case c.onDisk(idx):
+			if _, err := c.store.f.ReadAt(p[n:n+l], c.slots[idx]+off); err != nil {
+				return n, err
+			}
+		default:
+			zero(p[n : n+l])
+		}
+		n += l
+	}
+	return n, nil
+}
+
+// WriteAt writes p at offset, growing the content as needed.
+func (c *chunks) WriteAt(p []byte, offset int64) error {
+	end := offset + int64(len(p))
+	c.grow(end)
+
+	n := 0
+	for n < len(p) {
+		idx, off := (offset+int64(n))/chunkSize, (offset+int64(n))%chunkSize
+		l := len(p) - n
+		if l > chunkSize-int(off) {
+			l = chunkSize - int(off)
+		}
+		switch {
+		case c.onDisk(idx):
+			if err := c.own(idx); err != nil {
+				return err
+			}
+			if _, err := c.store.f.WriteAt(p[n:n+l], c.slots[idx]+off); err != nil {
+				return err
+			}
+		case c.blocks[idx] == nil && c.store != nil:
+			// New blocks of spilled content go straight to the
+			// backing file.
+			b := make([]byte, chunkSize)
+			copy(b[off:], p[n:n+l])
+			if err := c.spillBlock(idx, b); err != nil {
+				return err
+			}
+		default:
+			c.own(idx)
+			c.fit(idx, int(off)+l)
+			copy(c.blocks[idx][off:], p[n:n+l])
+		}
+		n += l
+	}
+	return nil
+}
+
+// Truncate sets the size of the content. Growing it leaves a hole.
+func (c *chunks) Truncate(size int64) error {
+	if size >= c.size {
+		c.grow(size)
+		return nil
+	}
+
+	nblocks := (size + chunkSize - 1) / chunkSize
+	for i := nblocks; i < int64(len(c.blocks)); i++ {
+		c.drop(i)
+	}
+	c.blocks = c.blocks[:nblocks]
+	if c.shared != nil {
+		c.shared = c.shared[:nblocks]
+	}
+	if c.slots != nil {
+		c.slots = c.slots[:nblocks]
+	}
+	c.size = size
+	if size == 0 && c.store != nil && !c.store.frozen {
+		// Emptied content starts over in memory.
+		c.store.close()
+		c.store = nil
+		c.slots = nil
+	}
+
+	// What is cut off the last block must read as zeroes, should the file
+	// grow again.
+	off := size % chunkSize
+	if off == 0 {
+		return nil
+	}
+	last := nblocks - 1
+	switch {
+	case c.blocks[last] != nil:
+		c.own(last)
+		if b := c.blocks[last]; int(off) < len(b) {
+			// Zeroed, what is past the length may be grown into.
+			zero(b[off:])
+			c.blocks[last] = b[:off]
+			c.resident -= int64(len(b)) - off
+		}
+	case c.onDisk(last):
+		if err := c.own(last); err != nil {
+			return err
+		}
+		if _, err := c.store.f.WriteAt(make([]byte, chunkSize-off), c.slots[last]+off); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop forgets block idx, giving back its slot in the backing file unless a
+// frozen copy refers to it.
+func (c *chunks) drop(idx int64) {
+	switch {
+	case c.blocks[idx] != nil:
+		c.resident -= int64(len(c.blocks[idx]))
+		c.blocks[idx] = nil
+	case c.onDisk(idx):
+		if c.shared == nil || !c.shared[idx] {
+			c.store.release(c.slots[idx])
+		}
+		c.slots[idx] = -1
+	}
+}
+
+// fit makes block idx hold at least n bytes, allocating it if it is nil. A
+// block that is too short is replaced by one of up to twice its capacity, so
+// that appending copies little.
+func (c *chunks) fit(idx int64, n int) {
+	b := c.blocks[idx]
+	if n <= len(b) {
+		return
+	}
+	if n <= cap(b) {
+		// What is past the length has never been written to.
+		c.blocks[idx] = b[:n]
+		c.resident += int64(n - len(b))
+		return
+	}
+	size := 2 * cap(b)
+	if size < n {
+		size = n
+	}
+	if size > chunkSize {
+		size = chunkSize
+	}
+	nb := make([]byte, n, size)
+	copy(nb, b)
+	c.resident += int64(n - len(b))
+	c.blocks[idx] = nb
+	if c.shared != nil {
+		c.shared[idx] = false
+	}
+}
+
+func (c *chunks) grow(size int64) {
+	if size <= c.size {
+		return
+	}
+	for int64(len(c.blocks))*chunkSize < size {
+		c.blocks = append(c.blocks, nil)
+		if c.shared != nil {
+			c.shared = append(c.shared, false)
+		}
+		if c.slots != nil {
+			c.slots = append(c.slots, -1)
+		}
+	}
+	c.size = size
+}
+
+// own makes sure that block idx is not shared, so it may be changed.
+func (c *chunks) own(idx int64) error {
+	if c.shared == nil || !c.shared[idx] {
+		return nil
+	}
+	if c.onDisk(idx) {
+		// The frozen copies keep the old slot, and the block moves to a
+		// new one.
+		b := make([]byte, chunkSize)
+		if _, err := c.store.f.ReadAt(b, c.slots[idx]); err != nil {
+			return err
+		}
+		slot := c.store.alloc()
+		if _, err := c.store.f.WriteAt(b, slot); err != nil {
+			c.store.release(slot)
+			return err
+		}
+		c.slots[idx] = slot
+		c.shared[idx] = false
+		return nil
+	}
+	old := c.blocks[idx]
+	b := make([]byte, len(old))
+	copy(b, old)
+	c.blocks[idx] = b
+	c.shared[idx] = false
+	return nil
+}
+
+// spill moves the blocks held in memory to a backing file from s, and keeps
+// the blocks written afterwards there as well.
+func (c *chunks) spill(s *Spill) error {
+	if c.store == nil {
+		store, err := s.create()
+		if err != nil {
+			return err
+		}
+		c.store = store
+		c.slots = make([]int64, len(c.blocks))
+		for i := range c.slots {
+			c.slots[i] = -1
+		}
+	}
+
+	for i, b := range c.blocks {
+		if b == nil {
+			continue
+		}
+		if err := c.spillBlock(int64(i), b); err != nil {
+			return err
+		}
+		c.blocks[i] = nil
+		c.resident -= int64(len(b))
+		if c.shared != nil {
+			// The frozen copies keep the block in memory.
+			c.shared[i] = false
+		}
+	}
+	return nil
+}
+
+// spillBlock writes b to a new slot in the backing file as block idx,
+// filling the rest of the slot with zeroes.
+func (c *chunks) spillBlock(idx int64, b []byte) error {
+	if len(b) < chunkSize {
+		full := make([]byte, chunkSize)
+		copy(full, b)
+		b = full
+	}
+	slot := c.store.alloc()
+	if _, err := c.store.f.WriteAt(b, slot); err != nil {
+		c.store.release(slot)
+		return err
+	}
+	c.slots[idx] = slot
+	return nil
+}
+
+// release gives up the backing file, unless frozen copies may still refer
+// to it. They close it once they are gone. The content must not be used
+// afterwards.
+func (c *chunks) release() {
+	if c.store != nil && !c.store.frozen {
+		c.store.close()
+	}
+	c.blocks = nil
+	c.shared = nil
+	c.slots = nil
+	c.store = nil
+	c.size = 0
+	c.resident = 0
+}
+
+// freeze returns a copy of the content that shares its blocks. The copy must
+// not be changed.
+func (c *chunks) freeze() chunks {
+	blocks := make([][]byte, len(c.blocks))
+	copy(blocks, c.blocks)
+	var slots []int64
+	if c.slots != nil {
+		slots = make([]int64, len(c.slots))
+		copy(slots, c.slots)
+		c.store.frozen = true
+	}
+
+	if len(c.shared) != len(c.blocks) {
+		c.shared = make([]bool, len(c.blocks))
+	}
+	for i := range c.shared {
+		c.shared[i] = c.blocks[i] != nil || c.onDisk(int64(i))
+	}
+	return chunks{blocks: blocks, size: c.size, store: c.store, slots: slots}
+}
+
+// thaw forgets that blocks are shared, once no frozen copies refer to them.
+// If dedup is set, full blocks stay shared, as the store may have handed
+// them to other files.
+func (c *chunks) thaw(dedup bool) {
+	for i := range c.shared {
+		if !dedup || len(c.blocks[i]) != chunkSize {
+			c.shared[i] = false
+		}
+	}
+	if c.store != nil {
+		c.store.frozen = false
+	}
+}
+
+// clone returns a copy of the content that shares its blocks, and copies
+// them before they are changed, so it may be used as live content.
+func (c *chunks) clone() chunks {
+	cc := c.freeze()
+	cc.shared = make([]bool, len(cc.blocks))
+	for i := range cc.blocks {
+		cc.shared[i] = cc.blocks[i] != nil || cc.onDisk(int64(i))
+		cc.resident += int64(len(cc.blocks[i]))
+	}
+	return cc
+}
+
+// WriteTo writes the whole content to w.
+func (c *chunks) WriteTo(w io.Writer) (int64, error) {
+	var zeroes, buf []byte
+	var n int64
+	for n < c.size {
+		l := c.size - n
+		if l > chunkSize {
+			l = chunkSize
+		}
+		idx := n / chunkSize
+		b := c.blocks[idx]
+		switch {
+		case b != nil && int64(len(b)) >= l:
+		case b != nil:
+			if buf == nil {
+				buf = make([]byte, chunkSize)
+			}
+			zero(buf[copy(buf, b):l])
+			b = buf
+		case c.onDisk(idx):
+			if buf == nil {
+				buf = make([]byte, chunkSize)
+			}
+			if _, err := c.store.f.ReadAt(buf[:l], c.slots[idx]); err != nil {
+				return n, err
+			}
+			b = buf
+		default:
+			if zeroes == nil {
+				zeroes = make([]byte, chunkSize)
+			}
+			b = zeroes
+		}
+		m, err := w.Write(b[:l])
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// load replaces the content with the next size bytes from r. Blocks of
+// zeroes are kept as holes.
+func (c *chunks) load(r io.Reader, size int64) error {
+	c.blocks = nil
+	c.shared = nil
+	c.slots = nil
+	c.store = nil
+	c.size = 0
+	c.resident = 0
+
+	for c.size < size {
+		l := size - c.size
+		if l > chunkSize {
+			l = chunkSize
+		}
+		b := make([]byte, l)
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if isZero(b) {
+			b = nil
+		} else {
+			c.resident += l
+		}
+		c.blocks = append(c.blocks, b)
+		c.size += l
+	}
+	return nil
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+func isZero(b []byte) bool {
+	for _, x := range b {
+		if x != 0 {
+			return false
+		}
+	}
+	return true
+}
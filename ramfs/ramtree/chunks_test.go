@@ -0,0 +1,170 @@
+package ramtree
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// TestChunks checks random writes, reads and truncations against a plain
+// slice.
+func TestChunks(t *testing.T) {
+	var c chunks
+	testChunks(t, &c)
+}
+
+func testChunks(t *testing.T, c *chunks) {
+	rnd := rand.New(rand.NewSource(1))
+	var ref []byte
+
+	for i := 0; i < 2000; i++ {
+		off := rnd.Int63n(4 * chunkSize)
+		switch rnd.Intn(3) {
+		case 0:
+			p := make([]byte, rnd.Intn(2*chunkSize))
+			rnd.Read(p)
+			if err := c.WriteAt(p, off); err != nil {
+				t.Fatalf("step %d: write: %v", i, err)
+			}
+			if end := int(off) + len(p); end > len(ref) {
+				ref = append(ref, make([]byte, end-len(ref))...)
+			}
+			copy(ref[off:], p)
+		case 1:
+			if err := c.Truncate(off); err != nil {
+				t.Fatalf("step %d: truncate: %v", i, err)
+			}
+			if int(off) > len(ref) {
+				ref = append(ref, make([]byte, int(off)-len(ref))...)
+			} else {
+				ref = ref[:off]
+			}
+		case 2:
+			p := make([]byte, rnd.Intn(2*chunkSize))
+			n, err := c.ReadAt(p, off)
+			if err != nil {
+				t.Fatalf("step %d: read: %v", i, err)
+			}
+			var expected []byte
+			if int(off) < len(ref) {
+				expected = ref[off:]
+				if len(expected) > len(p) {
+					expected = expected[:len(p)]
+				}
+			}
+			if !bytes.Equal(p[:n], expected) {
+				t.Fatalf("step %d: read of %d bytes at %d differs", i, len(p), off)
+			}
+		}
+
+		if c.Len() != int64(len(ref)) {
+			t.Fatalf("step %d: length %d, expected %d", i, c.Len(), len(ref))
+		}
+	}
+
+	var buf bytes.Buffer
+	c.WriteTo(&buf)
+	if !bytes.Equal(buf.Bytes(), ref) {
+		t.Fatal("content differs")
+	}
+}
+
+func TestChunksHoles(t *testing.T) {
+	var c chunks
+	c.WriteAt([]byte("x"), 10*chunkSize)
+	for i, b := range c.blocks[:10] {
+		if b != nil {
+			t.Fatalf("block %d of the hole is allocated", i)
+		}
+	}
+
+	p := make([]byte, 3)
+	p[0] = 1
+	if n, _ := c.ReadAt(p, 10*chunkSize-2); n != 3 || !bytes.Equal(p, []byte{0, 0, 'x'}) {
+		t.Fatalf("read across hole: got %q", p[:n])
+	}
+
+	// Shrinking and growing again must not resurrect old data.
+	c.Truncate(10 * chunkSize)
+	c.Truncate(11 * chunkSize)
+	if n, _ := c.ReadAt(p, 10*chunkSize); n != 3 || !bytes.Equal(p, []byte{0, 0, 0}) {
+		t.Fatalf("read after truncate: got %q", p[:n])
+	}
+}
+
+// TestChunksSmall checks that blocks take no more memory than what is
+// written to them needs.
+func TestChunksSmall(t *testing.T) {
+	var c chunks
+	c.WriteAt([]byte("x"), 0)
+	if c.resident != 1 {
+		t.Fatalf("1 byte takes %d bytes", c.resident)
+	}
+
+	for c.Len() < chunkSize+100 {
+		c.WriteAt(make([]byte, 1000), c.Len())
+	}
+	if c.resident != c.Len() {
+		t.Fatalf("%d bytes take %d bytes", c.Len(), c.resident)
+	}
+
+	// The rest of a partly written block reads as zeroes, also after it was
+	// cut short.
+	c.WriteAt([]byte("yy"), chunkSize+200)
+	c.Truncate(chunkSize + 201)
+	c.Truncate(chunkSize + 300)
+	p := make([]byte, 4)
+	if n, _ := c.ReadAt(p, chunkSize+199); n != 4 || !bytes.Equal(p, []byte{0, 'y', 0, 0}) {
+		t.Fatalf("read of partly written block: got %q", p[:n])
+	}
+}
+
+const benchWriteSize = 8 * 1024
+
+func BenchmarkFileAppend(b *testing.B) {
+	f := NewRAMFile("f", 0666, "glenda", "glenda")
+	of, _ := f.Open("glenda", protocol.OWRITE)
+	p := make([]byte, benchWriteSize)
+
+	b.SetBytes(benchWriteSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		of.Write(p)
+	}
+}
+
+func BenchmarkFileRandomWrite(b *testing.B) {
+	const size = 256 * 1024 * 1024
+	f := NewRAMFile("f", 0666, "glenda", "glenda")
+	of, _ := f.Open("glenda", protocol.OWRITE)
+	p := make([]byte, benchWriteSize)
+	rnd := rand.New(rand.NewSource(1))
+
+	b.SetBytes(benchWriteSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		of.Seek(rnd.Int63n(size), 0)
+		of.Write(p)
+	}
+}
+
+func BenchmarkFileRead(b *testing.B) {
+	const size = 64 * 1024 * 1024
+	f := NewRAMFile("f", 0666, "glenda", "glenda")
+	of, _ := f.Open("glenda", protocol.ORDWR)
+	p := make([]byte, benchWriteSize)
+	for i := 0; i < size/benchWriteSize; i++ {
+		of.Write(p)
+	}
+
+	b.SetBytes(benchWriteSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%(size/benchWriteSize) == 0 {
+			of.Seek(0, 0)
+		}
+		of.Read(p)
+	}
+}
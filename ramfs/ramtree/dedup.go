@@ -0,0 +1,186 @@
+package ramtree
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"runtime"
+	"sync"
+	"weak"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Dedup stores identical blocks of file content once, in the spirit of
+// Venti. Blocks are addressed by the SHA-256 hash of their content, and a
+// block that has been stored before is replaced by the stored one, which
+// is then shared and copied before it is changed, as blocks shared with
+// dumps are. Blocks of zeroes become holes.
+//
+// Blocks are stored when the file they were written to is closed, so a
+// block written many times while a file is open is only hashed once. The
+// store only refers weakly to blocks, so they are forgotten once no file,
+// dump or version holds them anymore. Spilled content is not deduplicated,
+// and neither are blocks that are only partly written, such as the last
+// block of most files.
+type Dedup struct {
+	sync.Mutex
+	root   *RAMTree
+	blocks map[[sha256.Size]byte]weak.Pointer[[chunkSize]byte]
+	hits   int64
+	misses int64
+}
+
+// DedupStats describes how well content is deduplicated.
+type DedupStats struct {
+	// Blocks is the number of blocks held in memory by the files of the
+	// tree, and Unique how many of them differ. Their ratio is the
+	// deduplication ratio.
+	Blocks int64
+	Unique int64
+
+	// Stored is the number of blocks in the store, which includes those
+	// only held by dumps and versions.
+	Stored int64
+
+	// Hits and Misses count the blocks that were and were not found in
+	// the store when stored.
+	Hits   int64
+	Misses int64
+}
+
+// Ratio returns the deduplication ratio, or 1 if there are no blocks.
+func (s DedupStats) Ratio() float64 {
+	if s.Unique == 0 {
+		return 1
+	}
+	return float64(s.Blocks) / float64(s.Unique)
+}
+
+// NewDedup returns an empty store.
+func NewDedup() *Dedup {
+	return &Dedup{
+		blocks: make(map[[sha256.Size]byte]weak.Pointer[[chunkSize]byte]),
+	}
+}
+
+// SetDedup makes d store the content of the files in the tree, which must
+// be a root, storing what it already holds.
+func (t *RAMTree) SetDedup(d *Dedup) {
+	d.Lock()
+	d.root = t
+	d.Unlock()
+	t.dedup = d
+	walkTree(t, func(f fileserver.File) {
+		if f, ok := f.(*RAMFile); ok {
+			f.Lock()
+			resident := f.content.resident
+			for i := range f.content.blocks {
+				d.store(&f.content, int64(i))
+			}
+			f.account(resident)
+			f.Unlock()
+		}
+	})
+}
+
+// store replaces block idx of c by the stored block with the same content,
+// or stores it if there is none. The caller must hold the lock of the file
+// that c belongs to.
+func (d *Dedup) store(c *chunks, idx int64) {
+	if d == nil || idx >= int64(len(c.blocks)) || c.blocks[idx] == nil {
+		return
+	}
+	b := c.blocks[idx]
+	if isZero(b) {
+		c.drop(idx)
+		return
+	}
+	if len(b) != chunkSize {
+		return
+	}
+
+	key := sha256.Sum256(b)
+	d.Lock()
+	defer d.Unlock()
+	if stored := d.blocks[key].Value(); stored != nil {
+		d.hits++
+		c.blocks[idx] = stored[:]
+	} else {
+		d.misses++
+		p := (*[chunkSize]byte)(b)
+		wp := weak.Make(p)
+		d.blocks[key] = wp
+		runtime.AddCleanup(p, d.forget, key)
+	}
+
+	// The block may now be handed to other files, so it must not be
+	// changed in place.
+	if len(c.shared) != len(c.blocks) {
+		c.shared = make([]bool, len(c.blocks))
+	}
+	c.shared[idx] = true
+}
+
+// forget removes the entry for key, once the block it referred to is gone.
+func (d *Dedup) forget(key [sha256.Size]byte) {
+	d.Lock()
+	defer d.Unlock()
+	if wp, ok := d.blocks[key]; ok && wp.Value() == nil {
+		delete(d.blocks, key)
+	}
+}
+
+// Stats returns the current statistics. Counting the blocks of the tree
+// reads every file in it.
+func (d *Dedup) Stats() DedupStats {
+	d.Lock()
+	var s DedupStats
+	for _, wp := range d.blocks {
+		if wp.Value() != nil {
+			s.Stored++
+		}
+	}
+	s.Hits, s.Misses = d.hits, d.misses
+	root := d.root
+	d.Unlock()
+
+	if root == nil {
+		return s
+	}
+	seen := make(map[*byte]bool)
+	walkTree(root, func(f fileserver.File) {
+		rf, ok := f.(*RAMFile)
+		if !ok {
+			return
+		}
+		rf.RLock()
+		defer rf.RUnlock()
+		for _, b := range rf.content.blocks {
+			if b == nil {
+				continue
+			}
+			s.Blocks++
+			if !seen[&b[0]] {
+				seen[&b[0]] = true
+				s.Unique++
+			}
+		}
+	})
+	return s
+}
+
+// String formats the statistics as a single line:
+//
+//	blocks 120 unique 100 ratio 1.20 stored 104 hits 20 misses 104
+func (d *Dedup) String() string {
+	s := d.Stats()
+	return fmt.Sprintf("blocks %d unique %d ratio %.2f stored %d hits %d misses %d\n", s.Blocks, s.Unique, s.Ratio(), s.Stored, s.Hits, s.Misses)
+}
+
+// File returns a read-only file reporting the statistics, as formatted by
+// String. It can be added to a tree with RAMTree.Add.
+func (d *Dedup) File(name, user, group string) fileserver.File {
+	return newSynthFile(name, 0444, user, group, func(string) []byte {
+		return []byte(d.String())
+	}, nil)
+}
@@ -0,0 +1,86 @@
+package ramtree
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func writeContent(t *testing.T, root *RAMTree, name string, content []byte) fileserver.File {
+	f, err := root.Create("glenda", name, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	of, err := f.Open("glenda", protocol.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := of.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	of.Close()
+	return f
+}
+
+func TestDedup(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	d := NewDedup()
+	root.SetDedup(d)
+
+	content := make([]byte, 3*chunkSize)
+	for i := range content[:2*chunkSize] {
+		content[i] = byte(i / 7)
+	}
+	a := writeContent(t, root, "a", content).(*RAMFile)
+	b := writeContent(t, root, "b", content).(*RAMFile)
+
+	for i := 0; i < 2; i++ {
+		if &a.content.blocks[i][0] != &b.content.blocks[i][0] {
+			t.Fatalf("block %d is not shared", i)
+		}
+	}
+	if a.content.blocks[2] != nil {
+		t.Fatal("block of zeroes is not a hole")
+	}
+	s := d.Stats()
+	if s.Blocks != 4 || s.Unique != 2 || s.Ratio() != 2 || s.Hits != 2 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	of, _ := b.Open("glenda", protocol.OWRITE)
+	of.Write([]byte("changed"))
+	of.Close()
+	if got := readAll(t, a); !bytes.Equal(got, content) {
+		t.Fatal("write to one file changed the other")
+	}
+	if got := readAll(t, b); string(got[:7]) != "changed" {
+		t.Fatalf("file starts with %q", got[:7])
+	}
+}
+
+func TestDedupForget(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	d := NewDedup()
+	root.SetDedup(d)
+	writeContent(t, root, "a", bytes.Repeat([]byte("a"), chunkSize))
+	if s := d.Stats(); s.Stored != 1 {
+		t.Fatalf("%d blocks stored", s.Stored)
+	}
+
+	root.Remove("glenda", "a")
+	for i := 0; i < 100; i++ {
+		runtime.GC()
+		d.Lock()
+		n := len(d.blocks)
+		d.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("block of removed file still in the store")
+}
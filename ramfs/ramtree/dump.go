@@ -0,0 +1,471 @@
+package ramtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// DumpTimeFormat is the layout of the names dumps are given.
+const DumpTimeFormat = "2006-01-02T15:04"
+
+// Dump is a directory of read-only dumps of a tree, in the spirit of the
+// Plan 9 dump file system. Every dump is named for the time it was taken,
+// and holds the tree as it was then. Dumps share the content of files with
+// the tree, so taking one only costs memory for what is changed afterwards.
+//
+// Writing "snap" to the ctl file in the directory takes a dump, and the
+// owner of the directory may remove dumps. Dumps are kept in memory only.
+type Dump struct {
+	sync.RWMutex
+	root    *RAMTree
+	id      uint64
+	name    string
+	user    string
+	group   string
+	mtime   time.Time
+	version uint32
+	dumps   map[string]*dumpDir
+	ctl     *synthFile
+}
+
+// NewDump returns an empty directory of dumps of root, called name and owned
+// by user and group.
+func NewDump(root *RAMTree, name, user, group string) *Dump {
+	d := &Dump{
+		root:  root,
+		id:    nextID(),
+		name:  name,
+		user:  user,
+		group: group,
+		mtime: time.Now(),
+		dumps: make(map[string]*dumpDir),
+	}
+	d.ctl = newSynthFile("ctl", 0200, user, group, func(string) []byte { return nil }, d.command)
+	return d
+}
+
+func (d *Dump) command(user string, p []byte) error {
+	switch cmd := string(bytes.TrimSpace(p)); cmd {
+	case "snap":
+		_, err := d.Take()
+		return err
+	default:
+		return fmt.Errorf("unknown command: %q", cmd)
+	}
+}
+
+// Take dumps the tree, returning the name of the dump. Every file and
+// directory is locked while it is copied, but the tree as a whole is not, so
+// changes made while the dump is taken may or may not be included.
+func (d *Dump) Take() (string, error) {
+	dir := freeze(d.root).(*dumpDir)
+
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	name := now.Format(DumpTimeFormat)
+	for i := 2; d.dumps[name] != nil; i++ {
+		name = fmt.Sprintf("%s.%d", now.Format(DumpTimeFormat), i)
+	}
+	dir.stat.Name = name
+	d.dumps[name] = dir
+	d.mtime = now
+	d.version++
+	return name, nil
+}
+
+// Names returns the names of the dumps, oldest first.
+func (d *Dump) Names() []string {
+	d.RLock()
+	defer d.RUnlock()
+	names := make([]string, 0, len(d.dumps))
+	for name := range d.dumps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (d *Dump) Name() (string, error) {
+	return d.name, nil
+}
+
+func (d *Dump) Qid() (protocol.Qid, error) {
+	d.RLock()
+	defer d.RUnlock()
+	return protocol.Qid{
+		Type:    protocol.QTDIR,
+		Version: d.version,
+		Path:    d.id,
+	}, nil
+}
+
+func (d *Dump) Stat() (protocol.Stat, error) {
+	q, _ := d.Qid()
+	d.RLock()
+	defer d.RUnlock()
+	return protocol.Stat{
+		Qid:   q,
+		Mode:  protocol.DMDIR | 0755,
+		Name:  d.name,
+		UID:   d.user,
+		GID:   d.group,
+		MUID:  d.user,
+		Atime: uint32(time.Now().Unix()),
+		Mtime: uint32(d.mtime.Unix()),
+	}, nil
+}
+
+func (d *Dump) WriteStat(protocol.Stat) error {
+	return fileserver.ErrReadOnly
+}
+
+func (d *Dump) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if !permCheck(d.user == user, 0755, mode) {
+		return nil, fileserver.ErrPermission
+	}
+	return newDirListing(func() []fileserver.File {
+		names := d.Names()
+		d.RLock()
+		defer d.RUnlock()
+		files := []fileserver.File{d.ctl}
+		for _, name := range names {
+			if dir, ok := d.dumps[name]; ok {
+				files = append(files, dir)
+			}
+		}
+		return files
+	})
+}
+
+func (d *Dump) IsDir() (bool, error) {
+	return true, nil
+}
+
+func (d *Dump) CanRemove() (bool, error) {
+	return true, nil
+}
+
+func (d *Dump) Walk(user, name string) (fileserver.File, error) {
+	if !permCheck(d.user == user, 0755, protocol.OEXEC) {
+		return nil, fileserver.ErrPermission
+	}
+	if name == "ctl" {
+		return d.ctl, nil
+	}
+	d.RLock()
+	defer d.RUnlock()
+	if dir, ok := d.dumps[name]; ok {
+		return dir, nil
+	}
+	return nil, nil
+}
+
+func (d *Dump) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrReadOnly
+}
+
+func (d *Dump) Rename(user, oldname, newname string) error {
+	return fileserver.ErrReadOnly
+}
+
+// Remove forgets a dump, releasing what only it refers to.
+func (d *Dump) Remove(user, name string) error {
+	if user != d.user {
+		return fileserver.ErrPermission
+	}
+	d.Lock()
+	defer d.Unlock()
+	dir, ok := d.dumps[name]
+	if !ok {
+		if name == "ctl" {
+			return fileserver.ErrPermission
+		}
+		return fileserver.ErrNotExist
+	}
+	delete(d.dumps, name)
+	d.mtime = time.Now()
+	d.version++
+	thawDump(dir)
+	return nil
+}
+
+// thawDump gives the content of the files in a removed dump back to the
+// files it was frozen from.
+func thawDump(f fileserver.File) {
+	switch f := f.(type) {
+	case *dumpDir:
+		for _, c := range f.tree {
+			thawDump(c)
+		}
+	case *dumpFile:
+		rf := f.content.from
+		rf.Lock()
+		rf.thawContent(f.content)
+		rf.Unlock()
+	}
+}
+
+// freeze copies f into a read-only file or directory, sharing the content
+// of files. Files that are not stored in snapshots are left out.
+func freeze(f fileserver.File) fileserver.File {
+	switch f := f.(type) {
+	case *RAMTree:
+		st, _ := f.Stat()
+		st.Qid.Path = nextID()
+		dir := &dumpDir{stat: st, tree: make(map[string]fileserver.File)}
+
+		f.RLock()
+		children := make(map[string]fileserver.File, len(f.tree))
+		for name, c := range f.tree {
+			children[name] = c
+		}
+		f.RUnlock()
+
+		for name, c := range children {
+			if fc := freeze(c); fc != nil {
+				dir.tree[name] = fc
+			}
+		}
+		return dir
+	case *RAMFile:
+		st, _ := f.Stat()
+		st.Qid.Path = nextID()
+		f.Lock()
+		content := f.freezeContent()
+		f.Unlock()
+		st.Length = uint64(content.Len())
+		return &dumpFile{stat: st, content: content}
+	}
+	return nil
+}
+
+// dumpDir is a directory in a dump.
+type dumpDir struct {
+	stat protocol.Stat
+	tree map[string]fileserver.File
+}
+
+func (dd *dumpDir) Name() (string, error) {
+	return dd.stat.Name, nil
+}
+
+func (dd *dumpDir) Qid() (protocol.Qid, error) {
+	return dd.stat.Qid, nil
+}
+
+func (dd *dumpDir) Stat() (protocol.Stat, error) {
+	return dd.stat, nil
+}
+
+func (dd *dumpDir) WriteStat(protocol.Stat) error {
+	return fileserver.ErrReadOnly
+}
+
+func (dd *dumpDir) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD && mode&3 != protocol.OEXEC || mode&protocol.OTRUNC != 0 {
+		return nil, fileserver.ErrReadOnly
+	}
+	if !permCheck(dd.stat.UID == user, dd.stat.Mode, mode) {
+		return nil, fileserver.ErrPermission
+	}
+	return newDirListing(func() []fileserver.File {
+		names := make([]string, 0, len(dd.tree))
+		for name := range dd.tree {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		files := make([]fileserver.File, 0, len(names))
+		for _, name := range names {
+			files = append(files, dd.tree[name])
+		}
+		return files
+	})
+}
+
+func (dd *dumpDir) IsDir() (bool, error) {
+	return true, nil
+}
+
+func (dd *dumpDir) CanRemove() (bool, error) {
+	return true, nil
+}
+
+func (dd *dumpDir) Walk(user, name string) (fileserver.File, error) {
+	if !permCheck(dd.stat.UID == user, dd.stat.Mode, protocol.OEXEC) {
+		return nil, fileserver.ErrPermission
+	}
+	return dd.tree[name], nil
+}
+
+func (dd *dumpDir) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrReadOnly
+}
+
+func (dd *dumpDir) Rename(user, oldname, newname string) error {
+	return fileserver.ErrReadOnly
+}
+
+func (dd *dumpDir) Remove(user, name string) error {
+	return fileserver.ErrReadOnly
+}
+
+// dumpFile is a file in a dump, or an old version of a file.
+type dumpFile struct {
+	stat    protocol.Stat
+	content *frozenContent
+}
+
+// frozenContent is a frozen copy of the content of a file. It can no longer
+// be read once it has been given back to the file.
+type frozenContent struct {
+	sync.RWMutex
+	chunks
+	from     *RAMFile
+	released bool
+}
+
+func (fc *frozenContent) Len() int64 {
+	fc.RLock()
+	defer fc.RUnlock()
+	return fc.chunks.Len()
+}
+
+func (fc *frozenContent) ReadAt(p []byte, offset int64) (int, error) {
+	fc.RLock()
+	defer fc.RUnlock()
+	if fc.released {
+		return 0, fileserver.ErrNotExist
+	}
+	return fc.chunks.ReadAt(p, offset)
+}
+
+func (fc *frozenContent) WriteTo(w io.Writer) (int64, error) {
+	fc.RLock()
+	defer fc.RUnlock()
+	if fc.released {
+		return 0, fileserver.ErrNotExist
+	}
+	return fc.chunks.WriteTo(w)
+}
+
+// forget drops the copy, reporting whether it was still held.
+func (fc *frozenContent) forget() bool {
+	fc.Lock()
+	defer fc.Unlock()
+	if fc.released {
+		return false
+	}
+	fc.released = true
+	fc.chunks = chunks{}
+	return true
+}
+
+// freezeContent returns a frozen copy of the content of f, which shares its
+// blocks until it is given back with thawContent. The caller must hold the
+// lock.
+func (f *RAMFile) freezeContent() *frozenContent {
+	f.frozen++
+	return &frozenContent{chunks: f.content.freeze(), from: f}
+}
+
+// thawContent gives back a frozen copy of the content of f. Once none are
+// left, the blocks of f may be changed in place again, and the backing files
+// the content has given up are closed. The caller must hold the lock.
+func (f *RAMFile) thawContent(fc *frozenContent) {
+	if !fc.forget() {
+		return
+	}
+	f.frozen--
+	if f.frozen == 0 {
+		f.content.thaw(f.dedup != nil)
+		for _, b := range f.stale {
+			b.close()
+		}
+		f.stale = nil
+	}
+}
+
+func (df *dumpFile) Name() (string, error) {
+	return df.stat.Name, nil
+}
+
+func (df *dumpFile) Qid() (protocol.Qid, error) {
+	return df.stat.Qid, nil
+}
+
+func (df *dumpFile) Stat() (protocol.Stat, error) {
+	return df.stat, nil
+}
+
+func (df *dumpFile) WriteStat(protocol.Stat) error {
+	return fileserver.ErrReadOnly
+}
+
+func (df *dumpFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if mode&3 != protocol.OREAD && mode&3 != protocol.OEXEC || mode&protocol.OTRUNC != 0 {
+		return nil, fileserver.ErrReadOnly
+	}
+	if !permCheck(df.stat.UID == user, df.stat.Mode, mode) {
+		return nil, fileserver.ErrPermission
+	}
+	return &dumpOpenFile{f: df}, nil
+}
+
+func (df *dumpFile) IsDir() (bool, error) {
+	return false, nil
+}
+
+func (df *dumpFile) CanRemove() (bool, error) {
+	return true, nil
+}
+
+type dumpOpenFile struct {
+	f      *dumpFile
+	offset int64
+}
+
+func (of *dumpOpenFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += of.offset
+	case 2:
+		offset += of.f.content.Len()
+	default:
+		return of.offset, errors.New("invalid whence value")
+	}
+	if offset < 0 {
+		return of.offset, errors.New("negative seek invalid")
+	}
+	of.offset = offset
+	return offset, nil
+}
+
+func (of *dumpOpenFile) Read(p []byte) (int, error) {
+	n, err := of.f.content.ReadAt(p, of.offset)
+	if err != nil {
+		return n, err
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	of.offset += int64(n)
+	return n, nil
+}
+
+func (of *dumpOpenFile) Write(p []byte) (int, error) {
+	return 0, fileserver.ErrReadOnly
+}
+
+func (of *dumpOpenFile) Close() error {
+	return nil
+}
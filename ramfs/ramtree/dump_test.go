@@ -0,0 +1,172 @@
+package ramtree
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func readAll(t *testing.T, f fileserver.File) []byte {
+	of, err := f.Open("glenda", protocol.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+
+	// RAMOpenFile returns 0 rather than io.EOF at the end.
+	var b []byte
+	buf := make([]byte, 8192)
+	for {
+		n, err := of.Read(buf)
+		b = append(b, buf[:n]...)
+		if err == io.EOF || err == nil && n == 0 {
+			return b
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	dir, err := root.Create("glenda", "dir", 0777|protocol.DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := dir.(fileserver.Dir).Create("glenda", "file", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 3*chunkSize)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	of, _ := f.Open("glenda", protocol.OWRITE)
+	of.Write(content)
+	of.Close()
+
+	d := NewDump(root, "snapshots", "glenda", "glenda")
+	root.Add("snapshots", d)
+	if st, _ := d.Stat(); st.Name != "snapshots" {
+		t.Fatalf("dump directory named %q", st.Name)
+	}
+	name, err := d.Take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name2, _ := d.Take(); name2 != name+".2" {
+		t.Fatalf("second dump named %q", name2)
+	}
+
+	// Change the live tree in every way that could leak into the dump.
+	if err := writeFile(t, f, chunkSize, 10); err != nil {
+		t.Fatal(err)
+	}
+	f.WriteStat(protocol.Stat{Length: ^uint64(0), Mode: 0600, Atime: ^uint32(0), Mtime: ^uint32(0)})
+	if _, err := dir.(fileserver.Dir).Create("glenda", "new", 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ddir, _ := d.Walk("glenda", name)
+	if sub, _ := ddir.(fileserver.Dir).Walk("glenda", "snapshots"); sub != nil {
+		t.Fatal("dump includes itself")
+	}
+	sub, _ := ddir.(fileserver.Dir).Walk("glenda", "dir")
+	if n, _ := sub.(fileserver.Dir).Walk("glenda", "new"); n != nil {
+		t.Fatal("file created after the dump shows up in it")
+	}
+	df, _ := sub.(fileserver.Dir).Walk("glenda", "file")
+	if got := readAll(t, df); string(got) != string(content) {
+		t.Fatal("dumped content changed")
+	}
+	if st, _ := df.Stat(); st.Length != uint64(len(content)) {
+		t.Fatalf("dumped length is %d", st.Length)
+	}
+	if st, _ := df.Stat(); st.Mode != 0666 {
+		t.Fatalf("dumped mode is %o", st.Mode)
+	}
+
+	// Only the block written to after the dump has been copied.
+	rf := f.(*RAMFile)
+	frozen := df.(*dumpFile)
+	if &rf.content.blocks[0][0] != &frozen.content.blocks[0][0] {
+		t.Fatal("unchanged block is not shared")
+	}
+	if &rf.content.blocks[1][0] == &frozen.content.blocks[1][0] {
+		t.Fatal("changed block is shared")
+	}
+
+	if _, err := df.Open("glenda", protocol.OWRITE); !errors.Is(err, fileserver.ErrReadOnly) {
+		t.Fatalf("open for write: got %v", err)
+	}
+	if _, err := sub.(fileserver.Dir).Create("glenda", "x", 0666); !errors.Is(err, fileserver.ErrReadOnly) {
+		t.Fatalf("create: got %v", err)
+	}
+
+	of, _ = d.ctl.Open("glenda", protocol.OWRITE)
+	if _, err := of.Write([]byte("snap\n")); err != nil {
+		t.Fatal(err)
+	}
+	of.Close()
+	if n := len(d.Names()); n != 3 {
+		t.Fatalf("%d dumps after writing snap, expected 3", n)
+	}
+	if err := d.Remove("glenda", name); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.Names()); n != 2 {
+		t.Fatalf("%d dumps after remove, expected 2", n)
+	}
+}
+
+// TestDumpRemove checks that once the last dump holding a file is removed,
+// the file is changed in place again, and the dumped copy can no longer be
+// read.
+func TestDumpRemove(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	f, _ := root.Create("glenda", "file", 0666)
+	if err := writeFile(t, f, 0, 2*chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	rf := f.(*RAMFile)
+
+	d := NewDump(root, "dump", "glenda", "glenda")
+	first, _ := d.Take()
+	second, _ := d.Take()
+	ddir, _ := d.Walk("glenda", first)
+	df, _ := ddir.(fileserver.Dir).Walk("glenda", "file")
+	of, err := df.Open("glenda", protocol.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+
+	if err := d.Remove("glenda", first); err != nil {
+		t.Fatal(err)
+	}
+	if !rf.content.shared[0] {
+		t.Fatal("block held by a dump is no longer shared")
+	}
+	if err := d.Remove("glenda", second); err != nil {
+		t.Fatal(err)
+	}
+	for i, shared := range rf.content.shared {
+		if shared {
+			t.Fatalf("block %d shared after the last dump was removed", i)
+		}
+	}
+	block := &rf.content.blocks[0][0]
+	if err := writeFile(t, f, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	if &rf.content.blocks[0][0] != block {
+		t.Fatal("block copied after the last dump was removed")
+	}
+	if _, err := of.Read(make([]byte, 10)); !errors.Is(err, fileserver.ErrNotExist) {
+		t.Fatalf("read of removed dump: got %v", err)
+	}
+}
@@ -0,0 +1,321 @@
+package ramtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Expiry removes files and directories from a tree once their time to live
+// is up. An expired directory is removed along with everything in it.
+// Files that are open, and directories holding them, are left until they
+// have been closed.
+//
+// If the tree has a trash, what expires is moved there rather than removed,
+// an expired directory as a whole once nothing in it is open. What is in the
+// trash is kept for its retention, whatever its time to live.
+//
+// Entries are given a time to live through the control file returned by
+// File, which takes one command per write:
+//
+//	ttl path duration      expire path after duration
+//	default path duration  expire what is created in directory path after duration
+//
+// where path starts at the root, and a duration of "never" clears it. A
+// default is inherited by directories created below. Setting the time to
+// live of an entry takes the permission to remove it, and setting a default
+// that to write to the directory, as well as being able to walk to it.
+// Reading the file lists the expiry times and defaults of what the reader can
+// walk to:
+//
+//	expire /scratch/a 2026-10-16T12:00:00Z
+//	default /scratch 1h0m0s
+//
+// Expiry times are kept in memory only.
+type Expiry struct {
+	// mu is held while reaping, so that nothing is removed once Close has
+	// returned.
+	mu     sync.Mutex
+	closed bool
+
+	root *RAMTree
+	done chan struct{}
+}
+
+// NewExpiry returns an Expiry for the tree at root.
+func NewExpiry(root *RAMTree) *Expiry {
+	return &Expiry{root: root, done: make(chan struct{})}
+}
+
+// File returns the control file. It can be added to a tree with
+// RAMTree.Add.
+func (e *Expiry) File(name, user, group string) fileserver.File {
+	return newSynthFile(name, 0666, user, group, e.list, e.command)
+}
+
+// Run removes what has expired every interval, until Close is called.
+func (e *Expiry) Run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			e.Reap(now)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// Close stops Run. Nothing expires from then on.
+func (e *Expiry) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.closed {
+		e.closed = true
+		close(e.done)
+	}
+}
+
+// Reap removes what has expired by now, returning how many files and
+// directories it removed.
+func (e *Expiry) Reap(now time.Time) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return 0
+	}
+	return reap(e.root, now, false)
+}
+
+func reap(t *RAMTree, now time.Time, expired bool) int {
+	t.RLock()
+	children := make(map[string]fileserver.File, len(t.tree))
+	for name, c := range t.tree {
+		children[name] = c
+	}
+	t.RUnlock()
+
+	n := 0
+	for name, c := range children {
+		switch c := c.(type) {
+		case *RAMTree:
+			if t.trash != nil && c == t.trash.dir {
+				// What is in the trash is kept for its retention.
+				continue
+			}
+			c.RLock()
+			cexpired := expired || isExpired(c.expires, now)
+			c.RUnlock()
+			// The trash takes an expired directory as a whole.
+			if !cexpired || t.trash == nil {
+				n += reap(c, now, cexpired)
+			}
+			if cexpired {
+				n += t.removeExpired(name, c)
+			}
+		case *RAMFile:
+			c.RLock()
+			cexpired := expired || isExpired(c.expires, now)
+			c.RUnlock()
+			if cexpired {
+				n += t.removeExpired(name, c)
+			}
+		}
+	}
+	return n
+}
+
+func isExpired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// removeExpired removes f, the entry name of t, along with everything below
+// it, or moves it to the trash, unless something in it is open. It returns
+// how many files and directories it removed.
+func (t *RAMTree) removeExpired(name string, f fileserver.File) int {
+	n, open := 0, false
+	walkTree(f, func(c fileserver.File) {
+		n++
+		switch c := c.(type) {
+		case *RAMTree:
+			c.RLock()
+			open = open || c.opens > 0
+			c.RUnlock()
+		case *RAMFile:
+			c.RLock()
+			open = open || c.opens > 0
+			c.RUnlock()
+		}
+	})
+	if open {
+		return 0
+	}
+
+	var err error
+	if t.trash != nil {
+		err = t.trash.expire(t, name, f)
+	} else {
+		err = t.remove(name, f)
+	}
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// lookup returns the file at path, and the directory holding it, if user may
+// walk to it. The parent of the root is nil.
+func (e *Expiry) lookup(user, path string) (*RAMTree, fileserver.File, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, nil, fmt.Errorf("path not absolute: %q", path)
+	}
+	var parent *RAMTree
+	var f fileserver.File = e.root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		t, ok := f.(*RAMTree)
+		if !ok {
+			return nil, nil, fileserver.ErrNotExist
+		}
+		t.RLock()
+		f = t.tree[name]
+		ok = permCheck(t.user == user, t.permissions, protocol.OEXEC)
+		t.RUnlock()
+		if !ok {
+			return nil, nil, fileserver.ErrPermission
+		}
+		if f == nil {
+			return nil, nil, fileserver.ErrNotExist
+		}
+		parent = t
+	}
+	return parent, f, nil
+}
+
+// setExpiry sets when f expires, reporting false if it cannot expire.
+func setExpiry(f fileserver.File, expires time.Time) bool {
+	switch f := f.(type) {
+	case *RAMTree:
+		f.Lock()
+		f.expires = expires
+		f.Unlock()
+	case *RAMFile:
+		f.Lock()
+		f.expires = expires
+		f.Unlock()
+	default:
+		return false
+	}
+	return true
+}
+
+func parseTTL(s string) (time.Duration, error) {
+	if s == "never" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration: %q", s)
+	}
+	return d, nil
+}
+
+func (e *Expiry) command(user string, p []byte) error {
+	args := strings.Fields(string(p))
+	if len(args) != 3 {
+		return fmt.Errorf("unknown command: %q", bytes.TrimSpace(p))
+	}
+	ttl, err := parseTTL(args[2])
+	if err != nil {
+		return err
+	}
+	parent, f, err := e.lookup(user, args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "ttl":
+		if parent == nil {
+			return errors.New("the root does not expire")
+		}
+		parent.RLock()
+		ok := permCheck(parent.user == user, parent.permissions, protocol.OWRITE)
+		parent.RUnlock()
+		if !ok {
+			return fileserver.ErrPermission
+		}
+		var expires time.Time
+		if ttl > 0 {
+			expires = time.Now().Add(ttl)
+		}
+		if !setExpiry(f, expires) {
+			return fileserver.ErrPermission
+		}
+	case "default":
+		t, ok := f.(*RAMTree)
+		if !ok {
+			return fileserver.ErrNotDir
+		}
+		t.Lock()
+		defer t.Unlock()
+		if !permCheck(t.user == user, t.permissions, protocol.OWRITE) {
+			return fileserver.ErrPermission
+		}
+		t.ttl = ttl
+	default:
+		return fmt.Errorf("unknown command: %q", args[0])
+	}
+	return nil
+}
+
+// list formats the expiry times and defaults of what user may walk to,
+// sorted by path.
+func (e *Expiry) list(user string) []byte {
+	var lines []string
+	var walk func(path string, f fileserver.File)
+	walk = func(path string, f fileserver.File) {
+		switch f := f.(type) {
+		case *RAMTree:
+			f.RLock()
+			if !f.expires.IsZero() {
+				lines = append(lines, fmt.Sprintf("expire %s %s\n", path, f.expires.UTC().Format(time.RFC3339)))
+			}
+			if f.ttl > 0 {
+				lines = append(lines, fmt.Sprintf("default %s %v\n", path, f.ttl))
+			}
+			children := make(map[string]fileserver.File, len(f.tree))
+			if permCheck(f.user == user, f.permissions, protocol.OEXEC) {
+				for name, c := range f.tree {
+					children[name] = c
+				}
+			}
+			f.RUnlock()
+			for name, c := range children {
+				walk(strings.TrimSuffix(path, "/")+"/"+name, c)
+			}
+		case *RAMFile:
+			f.RLock()
+			if !f.expires.IsZero() {
+				lines = append(lines, fmt.Sprintf("expire %s %s\n", path, f.expires.UTC().Format(time.RFC3339)))
+			}
+			f.RUnlock()
+		}
+	}
+	walk("/", e.root)
+
+	sort.SliceStable(lines, func(i, j int) bool {
+		return strings.Fields(lines[i])[1] < strings.Fields(lines[j])[1]
+	})
+	return []byte(strings.Join(lines, ""))
+}
@@ -0,0 +1,175 @@
+package ramtree
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func command(t *testing.T, f fileserver.File, user, cmd string) error {
+	of, err := f.Open(user, protocol.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+	_, err = of.Write([]byte(cmd))
+	return err
+}
+
+func TestExpiry(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	e := NewExpiry(root)
+	ctl := e.File(".expiry", "glenda", "glenda")
+	root.Add(".expiry", ctl)
+
+	scratch, _ := root.Create("glenda", "scratch", 0777|protocol.DMDIR)
+	keep, _ := root.Create("glenda", "keep", 0666)
+	if err := command(t, ctl, "glenda", "default /scratch 1h"); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := scratch.(fileserver.Dir).Create("glenda", "sub", 0777|protocol.DMDIR)
+	a, _ := sub.(fileserver.Dir).Create("glenda", "a", 0666)
+	b, _ := scratch.(fileserver.Dir).Create("glenda", "b", 0666)
+	if err := command(t, ctl, "glenda", "ttl /keep 2h"); err != nil {
+		t.Fatal(err)
+	}
+	if err := command(t, ctl, "glenda", "ttl /keep never"); err != nil {
+		t.Fatal(err)
+	}
+	if err := command(t, ctl, "nobody", "ttl /scratch 1s"); err != nil {
+		t.Fatal(err)
+	}
+	if err := command(t, ctl, "glenda", "ttl /missing 1s"); err == nil {
+		t.Fatal("setting the time to live of a missing file succeeded")
+	}
+
+	list := string(readAll(t, ctl))
+	for _, s := range []string{"default /scratch 1h0m0s", "default /scratch/sub 1h0m0s", "expire /scratch/b ", "expire /scratch/sub/a "} {
+		if !strings.Contains(list, s) {
+			t.Fatalf("listing lacks %q:\n%s", s, list)
+		}
+	}
+	if strings.Contains(list, "/keep") {
+		t.Fatalf("cleared expiry listed:\n%s", list)
+	}
+
+	if n := e.Reap(time.Now()); n != 0 {
+		t.Fatalf("%d removed before anything expired", n)
+	}
+
+	// An open file holds on to itself and the directories above it.
+	of, _ := a.Open("glenda", protocol.OREAD)
+	later := time.Now().Add(90 * time.Minute)
+	if n := e.Reap(later); n != 1 {
+		t.Fatalf("%d removed with a file open, expected 1", n)
+	}
+	if f, _ := scratch.(fileserver.Dir).Walk("glenda", "b"); f != nil || b == nil {
+		t.Fatal("expired file was not removed")
+	}
+	of.Close()
+	if n := e.Reap(later); n != 3 {
+		t.Fatalf("%d removed after close, expected 3", n)
+	}
+	if f, _ := root.Walk("glenda", "scratch"); f != nil {
+		t.Fatal("expired directory was not removed")
+	}
+	if f, _ := root.Walk("glenda", "keep"); f != keep {
+		t.Fatal("file without expiry was removed")
+	}
+}
+
+// TestExpiryPermission checks that only what a user can walk to can be given
+// a time to live or is listed to them.
+func TestExpiryPermission(t *testing.T) {
+	root := newTestTree(t)
+	e := NewExpiry(root)
+	ctl := e.File(".expiry", "glenda", "glenda")
+	if err := command(t, ctl, "glenda", "ttl /dir/file 1h"); err != nil {
+		t.Fatal(err)
+	}
+
+	// dir is 0750, so other may not walk into it.
+	if err := command(t, ctl, "other", "ttl /dir/file 1s"); !errors.Is(err, fileserver.ErrPermission) {
+		t.Fatalf("ttl of a file in a directory other may not walk: got %v", err)
+	}
+	ctl = e.File(".expiry", "glenda", "glenda")
+	of, err := ctl.Open("other", protocol.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(of)
+	of.Close()
+	if strings.Contains(string(b), "/dir/file") {
+		t.Fatalf("listing shows other what it may not walk to:\n%s", b)
+	}
+	if list := string(readAll(t, ctl)); !strings.Contains(list, "expire /dir/file ") {
+		t.Fatalf("listing lacks the owner's file:\n%s", list)
+	}
+}
+
+// TestExpiryTrash checks that what expires is moved to the trash, a
+// directory as a whole, and stays there.
+func TestExpiryTrash(t *testing.T) {
+	root := newTestTree(t)
+	tr := newTestTrash(t, root, 0)
+	e := NewExpiry(root)
+	ctl := e.File(".expiry", "glenda", "glenda")
+	for _, cmd := range []string{"ttl /dir 1h", "ttl /empty 1h"} {
+		if err := command(t, ctl, "glenda", cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	later := time.Now().Add(2 * time.Hour)
+	if n := e.Reap(later); n != 3 {
+		t.Fatalf("%d removed, expected 3", n)
+	}
+	if n := len(tr.names()); n != 2 {
+		t.Fatalf("%d removals in the trash, expected 2", n)
+	}
+	if n := e.Reap(later); n != 0 {
+		t.Fatalf("%d removed from the trash", n)
+	}
+
+	// Restored, the directory no longer expires.
+	for _, name := range tr.names() {
+		tr.Restore("glenda", name+"/dir", "")
+	}
+	if d, err := root.Walk("glenda", "dir"); err != nil || d == nil {
+		t.Fatalf("walk to restored dir: %v, %v", d, err)
+	}
+	if n := e.Reap(later); n != 0 {
+		t.Fatalf("%d removed after restore", n)
+	}
+}
+
+// TestExpiryClose checks that Run returns once the Expiry is closed, and
+// that nothing is reaped afterwards.
+func TestExpiryClose(t *testing.T) {
+	root := newTestTree(t)
+	e := NewExpiry(root)
+	ctl := e.File(".expiry", "glenda", "glenda")
+	if err := command(t, ctl, "glenda", "ttl /empty 1h"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		e.Run(time.Hour)
+		close(done)
+	}()
+	e.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Close")
+	}
+	if n := e.Reap(time.Now().Add(2 * time.Hour)); n != 0 {
+		t.Fatalf("%d removed after Close", n)
+	}
+}
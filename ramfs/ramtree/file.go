@@ -3,6 +3,7 @@ package ramtree
 import (
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kennylevinsen/g9p/protocol"
@@ -12,15 +13,22 @@ import (
 type RAMOpenFile struct {
 	offset int64
 	f      *RAMFile
+
+	// saved is set once the version the file had when it was opened has
+	// been kept by the history.
+	saved bool
+
+	// written holds the blocks written to, to be deduplicated on close.
+	written map[int64]bool
 }
 
 func (of *RAMOpenFile) Seek(offset int64, whence int) (int64, error) {
 	if of.f == nil {
-		return 0, errors.New("file not open")
+		return 0, fileserver.ErrNotOpen
 	}
 	of.f.RLock()
 	defer of.f.RUnlock()
-	length := int64(len(of.f.content))
+	length := of.f.content.Len()
 	switch whence {
 	case 0:
 	case 1:
@@ -35,10 +43,8 @@ func (of *RAMOpenFile) Seek(offset int64, whence int) (int64, error) {
 		return of.offset, errors.New("negative seek invalid")
 	}
 
-	if offset > int64(len(of.f.content)) {
-		offset = int64(len(of.f.content))
-	}
-
+	// Seeking past the end is fine: reads there return nothing, and writes
+	// fill the hole with zeroes.
 	of.offset = offset
 	of.f.atime = time.Now()
 	return of.offset, nil
@@ -46,57 +52,97 @@ func (of *RAMOpenFile) Seek(offset int64, whence int) (int64, error) {
 
 func (of *RAMOpenFile) Read(p []byte) (int, error) {
 	if of.f == nil {
-		return 0, errors.New("file not open")
+		return 0, fileserver.ErrNotOpen
 	}
 	of.f.RLock()
 	defer of.f.RUnlock()
-	maxRead := int64(len(p))
-	remaining := int64(len(of.f.content)) - of.offset
-	if maxRead > remaining {
-		maxRead = remaining
-	}
-
-	copy(p, of.f.content[of.offset:maxRead+of.offset])
-	of.offset += maxRead
+	n, err := of.f.content.ReadAt(p, of.offset)
+	of.offset += int64(n)
 	of.f.atime = time.Now()
-	return int(maxRead), nil
+	return n, err
 }
 
 func (of *RAMOpenFile) Write(p []byte) (int, error) {
 	if of.f == nil {
-		return 0, errors.New("file not open")
+		return 0, fileserver.ErrNotOpen
 	}
+	of.f.Lock()
+	defer of.f.Unlock()
 
 	// TODO(kl): handle append-only
-	wlen := int64(len(p))
-
-	if wlen+of.offset > int64(len(of.f.content)) {
-		b := make([]byte, wlen+of.offset)
-		copy(b, of.f.content[:of.offset])
-		of.f.content = b
+	size := of.f.content.Len()
+	end := of.offset + int64(len(p))
+	if end < size {
+		end = size
 	}
-
-	copy(of.f.content[of.offset:], p)
-
-	of.offset += wlen
-	of.f.mtime = time.Now()
-	of.f.atime = of.f.mtime
-	of.f.version++
-	return int(wlen), nil
+	if err := of.f.quota.resize(of.f.user, size, end); err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	if !of.saved {
+		if err := of.f.history.save(of.f, now); err != nil {
+			of.f.quota.resize(of.f.user, end, size)
+			return 0, err
+		}
+		of.saved = true
+	}
+	if err := of.f.journal.write(now, of.f.id, of.offset, p); err != nil {
+		of.f.quota.resize(of.f.user, end, size)
+		return 0, err
+	}
+	if err := of.f.writeAt(now, p, of.offset); err != nil {
+		// What the file was grown by is given back.
+		if end > size {
+			of.f.journal.truncate(now, of.f.id, uint64(size))
+			of.f.truncate(uint64(size))
+			of.f.quota.resize(of.f.user, end, size)
+		}
+		return 0, err
+	}
+	of.f.watcher.changed(now, EventWrite, of.f.id)
+	if of.f.dedup != nil && len(p) > 0 {
+		if of.written == nil {
+			of.written = make(map[int64]bool)
+		}
+		for idx := of.offset / chunkSize; idx <= (of.offset+int64(len(p))-1)/chunkSize; idx++ {
+			of.written[idx] = true
+		}
+	}
+	of.offset += int64(len(p))
+	return len(p), nil
 }
 
 func (of *RAMOpenFile) Close() error {
 	of.f.Lock()
 	defer of.f.Unlock()
 	of.f.opens--
+	if of.f.removed && of.f.opens == 0 {
+		of.f.release()
+	} else if len(of.written) > 0 {
+		resident := of.f.content.resident
+		for idx := range of.written {
+			of.f.dedup.store(&of.f.content, idx)
+		}
+		of.f.account(resident)
+	}
 	of.f = nil
 	return nil
 }
 
 type RAMFile struct {
 	sync.RWMutex
-	parent      fileserver.Dir
-	content     []byte
+	*features
+	versions []fileVersion
+	hist     *historyDir
+	lockf    *lockFile
+	expires  time.Time
+	parent   fileserver.Dir
+
+	// dir is the directory holding the file, or nil once it has been
+	// removed.
+	dir atomic.Pointer[RAMTree]
+
+	content     chunks
 	id          uint64
 	name        string
 	user        string
@@ -107,6 +153,16 @@ type RAMFile struct {
 	version     uint32
 	permissions protocol.FileMode
 	opens       uint
+
+	// removed is set once the file is no longer in the tree, so that the
+	// content can be released when the last open is closed.
+	removed bool
+
+	// frozen counts the frozen copies of the content held by dumps and
+	// versions, and stale holds the backing files the content has given
+	// up while they still referred to them.
+	frozen int
+	stale  []*backing
 }
 
 func (f *RAMFile) SetParent(d fileserver.Dir) error {
@@ -130,24 +186,80 @@ func (f *RAMFile) Qid() (protocol.Qid, error) {
 	}, nil
 }
 
-func (f *RAMFile) WriteStat(s protocol.Stat) error {
-	if s.Length != ^uint64(0) {
-		if s.Length > uint64(len(f.content)) {
-			return errors.New("cannot extend length")
-		}
-		f.content = f.content[:s.Length]
+// writeAt writes p at offset, growing the file as needed. The caller must
+// hold the lock.
+func (f *RAMFile) writeAt(now time.Time, p []byte, offset int64) error {
+	resident := f.content.resident
+	err := f.content.WriteAt(p, offset)
+	f.spill.check(&f.content)
+	f.account(resident)
+	f.mtime = now
+	f.atime = now
+	f.version++
+	return err
+}
+
+// truncate sets the length of the file, zero-filling if it grows. The caller
+// must hold the lock.
+func (f *RAMFile) truncate(length uint64) error {
+	resident := f.content.resident
+	err := f.content.Truncate(int64(length))
+	f.account(resident)
+	return err
+}
+
+// account charges the quota for the change in the content held in memory
+// since it was resident bytes. The caller must hold the lock.
+func (f *RAMFile) account(resident int64) {
+	f.quota.reside(f.user, f.content.resident-resident)
+}
+
+// setStat applies a complete stat. The caller must hold the lock.
+func (f *RAMFile) setStat(now time.Time, s protocol.Stat) error {
+	var err error
+	if s.Length != ^uint64(0) && s.Length != uint64(f.content.Len()) {
+		err = f.truncate(s.Length)
 	}
 	f.name = s.Name
 	f.user = s.UID
 	f.group = s.GID
 	f.permissions = s.Mode
-	f.mtime = time.Now()
-	f.atime = f.mtime
+	f.mtime = time.Unix(int64(s.Mtime), 0)
+	f.atime = now
 	f.version++
-	return nil
+	return err
+}
+
+func (f *RAMFile) WriteStat(s protocol.Stat) error {
+	f.Lock()
+	defer f.Unlock()
+	size := f.content.Len()
+	if s.Length != ^uint64(0) {
+		if err := f.quota.resize(f.user, size, int64(s.Length)); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if s.Length != ^uint64(0) && int64(s.Length) != size {
+		if err := f.history.save(f, now); err != nil {
+			f.quota.resize(f.user, int64(s.Length), size)
+			return err
+		}
+	}
+	if err := f.journal.wstat(now, f.id, s); err != nil {
+		if s.Length != ^uint64(0) {
+			f.quota.resize(f.user, int64(s.Length), size)
+		}
+		return err
+	}
+	err := f.setStat(now, s)
+	f.watcher.changed(now, EventWstat, f.id)
+	return err
 }
 
 func (f *RAMFile) Stat() (protocol.Stat, error) {
+	f.RLock()
+	defer f.RUnlock()
 	q, err := f.Qid()
 	if err != nil {
 		return protocol.Stat{}, err
@@ -160,10 +272,10 @@ func (f *RAMFile) Stat() (protocol.Stat, error) {
 		Qid:    q,
 		Mode:   f.permissions,
 		Name:   n,
-		Length: uint64(len(f.content)),
+		Length: uint64(f.content.Len()),
 		UID:    f.user,
-		GID:    f.user,
-		MUID:   f.user,
+		GID:    f.group,
+		MUID:   f.muser,
 		Atime:  uint32(f.atime.Unix()),
 		Mtime:  uint32(f.mtime.Unix()),
 	}, nil
@@ -172,16 +284,31 @@ func (f *RAMFile) Stat() (protocol.Stat, error) {
 func (f *RAMFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
 	owner := f.user == user
 	if !permCheck(owner, f.permissions, mode) {
-		return nil, errors.New("access denied")
+		return nil, fileserver.ErrPermission
 	}
 
-	f.atime = time.Now()
-
 	f.Lock()
 	defer f.Unlock()
+	now := time.Now()
+	if mode&protocol.OTRUNC != 0 {
+		if err := f.history.save(f, now); err != nil {
+			return nil, err
+		}
+		if err := f.journal.truncate(now, f.id, 0); err != nil {
+			return nil, err
+		}
+		f.quota.resize(f.user, f.content.Len(), 0)
+		if err := f.truncate(0); err != nil {
+			return nil, err
+		}
+		f.mtime = now
+		f.version++
+		f.watcher.changed(now, EventWrite, f.id)
+	}
+	f.atime = now
 	f.opens++
 
-	return &RAMOpenFile{f: f}, nil
+	return &RAMOpenFile{f: f, saved: mode&protocol.OTRUNC != 0}, nil
 }
 
 func (f *RAMFile) IsDir() (bool, error) {
@@ -193,14 +320,19 @@ func (f *RAMFile) CanRemove() (bool, error) {
 }
 
 func NewRAMFile(name string, permissions protocol.FileMode, user, group string) *RAMFile {
+	return newRAMFile(nextID(), time.Now(), name, permissions, user, group)
+}
+
+func newRAMFile(id uint64, now time.Time, name string, permissions protocol.FileMode, user, group string) *RAMFile {
 	return &RAMFile{
+		features:    &features{},
 		name:        name,
 		permissions: permissions,
 		user:        user,
 		group:       group,
 		muser:       user,
-		id:          nextID(),
-		atime:       time.Now(),
-		mtime:       time.Now(),
+		id:          id,
+		atime:       now,
+		mtime:       now,
 	}
 }
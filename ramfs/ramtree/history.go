@@ -0,0 +1,338 @@
+package ramtree
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// historySuffix is appended to the name of a file to walk to its history.
+const historySuffix = ".history"
+
+// History keeps the old versions of the files in a tree. A version is kept
+// when a file is first changed after being opened, or when it is truncated
+// or restored, so a file opened and written to many times holds on to what
+// it was before every open. Versions share content with the file and each
+// other, as dumps do.
+//
+// The versions of a file named name can be read from the directory
+// name.history, which is not listed but can be walked to. It holds a file
+// for every version, named by its qid version, and a ctl file: writing
+// "restore 12" to it makes version 12 the content of the file again.
+//
+// Versions are kept in memory only. Quotas charge them to the owner of the
+// file at their length, as they do files, and a change that would keep a
+// version past the limits fails.
+type History struct {
+	versions int
+	age      time.Duration
+}
+
+// NewHistory returns a History keeping the last versions versions of every
+// file, and those replaced less than age ago. Zero means no limit, but at
+// least one of them must be set.
+func NewHistory(versions int, age time.Duration) *History {
+	return &History{versions: versions, age: age}
+}
+
+// SetHistory makes h keep the old versions of every file in the tree.
+func (t *RAMTree) SetHistory(h *History) {
+	t.history = h
+}
+
+// fileVersion is an old version of a file.
+type fileVersion struct {
+	id      uint64
+	version uint32
+	muser   string
+	mtime   time.Time
+	saved   time.Time
+	content *frozenContent
+}
+
+// save keeps the current version of f. The caller must hold the lock of f.
+func (h *History) save(f *RAMFile, now time.Time) error {
+	if h == nil {
+		return nil
+	}
+	if err := f.quota.resize(f.user, 0, f.content.Len()); err != nil {
+		return err
+	}
+	f.versions = append(f.versions, fileVersion{
+		id:      nextID(),
+		version: f.version,
+		muser:   f.muser,
+		mtime:   f.mtime,
+		saved:   now,
+		content: f.freezeContent(),
+	})
+	h.prune(f, now)
+	return nil
+}
+
+// prune forgets the versions of f that are no longer to be kept. The caller
+// must hold the lock of f.
+func (h *History) prune(f *RAMFile, now time.Time) {
+	drop := 0
+	if h.versions > 0 && len(f.versions) > h.versions {
+		drop = len(f.versions) - h.versions
+	}
+	for h.age > 0 && drop < len(f.versions) && now.Sub(f.versions[drop].saved) > h.age {
+		drop++
+	}
+	if drop > 0 {
+		for _, v := range f.versions[:drop] {
+			f.quota.resize(f.user, v.content.Len(), 0)
+			f.thawContent(v.content)
+		}
+		f.versions = append([]fileVersion(nil), f.versions[drop:]...)
+	}
+}
+
+// kept returns the size of the versions kept of f, as charged by quotas.
+// The caller must hold the lock of f.
+func (f *RAMFile) kept() int64 {
+	var n int64
+	for _, v := range f.versions {
+		n += v.content.Len()
+	}
+	return n
+}
+
+// restore makes version the content of f again, keeping the current one.
+func (f *RAMFile) restore(user string, version uint32) error {
+	f.Lock()
+	defer f.Unlock()
+	if !permCheck(f.user == user, f.permissions, protocol.OWRITE) {
+		return fileserver.ErrPermission
+	}
+
+	now := time.Now()
+	if f.history != nil {
+		f.history.prune(f, now)
+	}
+	var v *fileVersion
+	for i := range f.versions {
+		if f.versions[i].version == version {
+			v = &f.versions[i]
+		}
+	}
+	if v == nil {
+		return fileserver.ErrNotExist
+	}
+
+	size, length := f.content.Len(), v.content.Len()
+	if err := f.quota.resize(f.user, size, length); err != nil {
+		return err
+	}
+	v.content.Lock()
+	content := v.content.clone()
+	v.content.Unlock()
+	if err := f.history.save(f, now); err != nil {
+		f.quota.resize(f.user, length, size)
+		return err
+	}
+	if err := f.journalContent(now, &content); err != nil {
+		f.quota.resize(f.user, length, size)
+		return err
+	}
+	resident := f.content.resident
+	// The version just saved holds on to the old backing file.
+	if old := f.content.store; old != nil && old != content.store {
+		f.stale = append(f.stale, old)
+	}
+	f.content = content
+	f.spill.check(&f.content)
+	f.account(resident)
+	f.mtime = now
+	f.atime = now
+	f.version++
+	f.watcher.changed(now, EventWrite, f.id)
+	return nil
+}
+
+// journalContent records that the content of f was replaced by c. The caller
+// must hold the lock of f.
+func (f *RAMFile) journalContent(now time.Time, c *chunks) error {
+	if f.journal == nil {
+		return nil
+	}
+	if err := f.journal.truncate(now, f.id, 0); err != nil {
+		return err
+	}
+	if err := f.journal.truncate(now, f.id, uint64(c.Len())); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for i := range c.blocks {
+		if c.blocks[i] == nil && !c.onDisk(int64(i)) {
+			continue
+		}
+		off := int64(i) * chunkSize
+		n, err := c.ReadAt(buf, off)
+		if err != nil {
+			return err
+		}
+		if err := f.journal.write(now, f.id, off, buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyDir returns the directory holding the versions of f, or nil if f
+// has no history. The caller must hold the lock of f.
+func (f *RAMFile) historyDir() *historyDir {
+	if f.history == nil {
+		return nil
+	}
+	if f.hist == nil {
+		hd := &historyDir{f: f, id: nextID()}
+		hd.ctl = newSynthFile("ctl", 0222, f.user, f.group, func(string) []byte { return nil }, hd.command)
+		f.hist = hd
+	}
+	return f.hist
+}
+
+// historyDir is the directory holding the old versions of a file.
+type historyDir struct {
+	f   *RAMFile
+	id  uint64
+	ctl *synthFile
+}
+
+func (hd *historyDir) command(user string, p []byte) error {
+	args := strings.Fields(string(p))
+	if len(args) != 2 || args[0] != "restore" {
+		return fmt.Errorf("unknown command: %q", bytes.TrimSpace(p))
+	}
+	version, err := strconv.ParseUint(args[1], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid version: %q", args[1])
+	}
+	return hd.f.restore(user, uint32(version))
+}
+
+// files returns the versions of the file, oldest first.
+func (hd *historyDir) files() []fileserver.File {
+	f := hd.f
+	f.Lock()
+	defer f.Unlock()
+	if f.history != nil {
+		f.history.prune(f, time.Now())
+	}
+	files := make([]fileserver.File, 0, len(f.versions))
+	for _, v := range f.versions {
+		files = append(files, &dumpFile{
+			stat: protocol.Stat{
+				Qid: protocol.Qid{
+					Type:    protocol.QTFILE,
+					Version: v.version,
+					Path:    v.id,
+				},
+				Mode:   f.permissions &^ 0222,
+				Name:   strconv.FormatUint(uint64(v.version), 10),
+				Length: uint64(v.content.Len()),
+				UID:    f.user,
+				GID:    f.group,
+				MUID:   v.muser,
+				Atime:  uint32(v.saved.Unix()),
+				Mtime:  uint32(v.mtime.Unix()),
+			},
+			content: v.content,
+		})
+	}
+	return files
+}
+
+func (hd *historyDir) Name() (string, error) {
+	n, _ := hd.f.Name()
+	return n + historySuffix, nil
+}
+
+func (hd *historyDir) Qid() (protocol.Qid, error) {
+	return protocol.Qid{
+		Type: protocol.QTDIR,
+		Path: hd.id,
+	}, nil
+}
+
+// mode lets those who may read the file list and walk the directory.
+func (hd *historyDir) mode() protocol.FileMode {
+	hd.f.RLock()
+	defer hd.f.RUnlock()
+	r := hd.f.permissions & 0444
+	return protocol.DMDIR | r | r>>2
+}
+
+func (hd *historyDir) Stat() (protocol.Stat, error) {
+	st, err := hd.f.Stat()
+	if err != nil {
+		return protocol.Stat{}, err
+	}
+	q, _ := hd.Qid()
+	name, _ := hd.Name()
+	return protocol.Stat{
+		Qid:   q,
+		Mode:  hd.mode(),
+		Name:  name,
+		UID:   st.UID,
+		GID:   st.GID,
+		MUID:  st.MUID,
+		Atime: st.Atime,
+		Mtime: st.Mtime,
+	}, nil
+}
+
+func (hd *historyDir) WriteStat(protocol.Stat) error {
+	return fileserver.ErrPermission
+}
+
+func (hd *historyDir) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if !permCheck(hd.f.user == user, hd.mode(), mode) {
+		return nil, fileserver.ErrPermission
+	}
+	return newDirListing(func() []fileserver.File {
+		return append([]fileserver.File{hd.ctl}, hd.files()...)
+	})
+}
+
+func (hd *historyDir) IsDir() (bool, error) {
+	return true, nil
+}
+
+func (hd *historyDir) CanRemove() (bool, error) {
+	return false, nil
+}
+
+func (hd *historyDir) Walk(user, name string) (fileserver.File, error) {
+	if !permCheck(hd.f.user == user, hd.mode(), protocol.OEXEC) {
+		return nil, fileserver.ErrPermission
+	}
+	if name == "ctl" {
+		return hd.ctl, nil
+	}
+	for _, f := range hd.files() {
+		if n, _ := f.Name(); n == name {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+func (hd *historyDir) Create(user, name string, perms protocol.FileMode) (fileserver.File, error) {
+	return nil, fileserver.ErrPermission
+}
+
+func (hd *historyDir) Rename(user, oldname, newname string) error {
+	return fileserver.ErrPermission
+}
+
+func (hd *historyDir) Remove(user, name string) error {
+	return fileserver.ErrPermission
+}
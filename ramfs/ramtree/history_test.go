@@ -0,0 +1,148 @@
+package ramtree
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func overwrite(t *testing.T, f fileserver.File, s string) {
+	of, err := f.Open("glenda", protocol.OWRITE|protocol.OTRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+	if _, err := of.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetHistory(NewHistory(2, 0))
+	f, err := root.Create("glenda", "config", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	overwrite(t, f, "one")
+	first, _ := f.Qid()
+	overwrite(t, f, "two")
+	overwrite(t, f, "three")
+
+	h, err := root.Walk("glenda", "config.history")
+	if err != nil || h == nil {
+		t.Fatalf("walk to history: %v", err)
+	}
+	hd := h.(fileserver.Dir)
+
+	// The empty file the first overwrite replaced has been dropped, leaving
+	// "one" and "two".
+	names := map[string]string{}
+	for _, v := range h.(*historyDir).files() {
+		n, _ := v.Name()
+		names[n] = string(readAll(t, v))
+	}
+	if len(names) != 2 {
+		t.Fatalf("%d versions kept, expected 2: %v", len(names), names)
+	}
+	v, _ := hd.Walk("glenda", strconv.FormatUint(uint64(first.Version), 10))
+	if v == nil || string(readAll(t, v)) != "one" {
+		t.Fatalf("version %d is not \"one\": %v", first.Version, names)
+	}
+
+	ctl, _ := hd.Walk("glenda", "ctl")
+	of, err := ctl.Open("glenda", protocol.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := of.Write([]byte("restore " + strconv.FormatUint(uint64(first.Version), 10))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := of.Write([]byte("restore 1000")); err == nil {
+		t.Fatal("restoring an unknown version succeeded")
+	}
+	of.Close()
+	if got := string(readAll(t, f)); got != "one" {
+		t.Fatalf("restored content is %q", got)
+	}
+
+	// Restoring keeps what was replaced.
+	found := false
+	for _, v := range h.(*historyDir).files() {
+		found = found || string(readAll(t, v)) == "three"
+	}
+	if !found {
+		t.Fatal("content replaced by restore was not kept")
+	}
+
+	if x, _ := root.Walk("glenda", "nothing.history"); x != nil {
+		t.Fatal("history of a file that does not exist")
+	}
+}
+
+func TestHistoryAge(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetHistory(NewHistory(0, time.Hour))
+	f, _ := root.Create("glenda", "file", 0666)
+	for _, s := range []string{"a", "b", "c"} {
+		overwrite(t, f, s)
+	}
+
+	rf := f.(*RAMFile)
+	rf.Lock()
+	if len(rf.versions) != 3 {
+		t.Fatalf("%d versions kept, expected 3", len(rf.versions))
+	}
+	rf.versions[0].saved = rf.versions[0].saved.Add(-2 * time.Hour)
+	rf.Unlock()
+
+	h, _ := root.Walk("glenda", "file.history")
+	if n := len(h.(*historyDir).files()); n != 2 {
+		t.Fatalf("%d versions kept after one expired, expected 2", n)
+	}
+}
+
+// TestHistoryQuota checks that versions are charged to the owner of the
+// file, and given back when dropped or removed.
+func TestHistoryQuota(t *testing.T) {
+	root, q := newQuotaTree(t, Limits{UserBytes: 100})
+	root.SetHistory(NewHistory(2, 0))
+	f, _ := root.Create("glenda", "file", 0666)
+
+	overwrite(t, f, strings.Repeat("a", 40))
+	overwrite(t, f, strings.Repeat("b", 40))
+	if u := q.Usage(); u.Bytes != 80 {
+		t.Fatalf("usage with one version: %d bytes, expected 80", u.Bytes)
+	}
+	of, err := f.Open("glenda", protocol.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := of.Write([]byte("c")); !errors.Is(err, fileserver.ErrQuota) {
+		t.Fatalf("write keeping a version over the limit: got %v", err)
+	}
+	of.Close()
+
+	// Truncating keeps the 40 bytes, and drops the empty version.
+	st, _ := f.Stat()
+	st.Length = 10
+	if err := f.WriteStat(st); err != nil {
+		t.Fatal(err)
+	}
+	if u := q.Usage(); u.Bytes != 90 {
+		t.Fatalf("usage after truncate: %d bytes, expected 90", u.Bytes)
+	}
+
+	if err := root.Remove("glenda", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if u := q.Usage(); u.Bytes != 0 {
+		t.Fatalf("usage after remove: %d bytes, expected 0", u.Bytes)
+	}
+}
@@ -0,0 +1,646 @@
+package ramtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// The journal is an append-only log of the changes made to a tree since its
+// last snapshot. Changes are written to it before they are applied, so the
+// tree can be rebuilt after a crash by replaying the journal on top of the
+// snapshot.
+//
+// Every record is framed as:
+//
+//	size[4] crc[4] type[1] time[8] payload[size-9]
+//
+// where size counts everything after the crc, and crc is the IEEE CRC-32 of
+// the same bytes. Time is in nanoseconds since the epoch, and files are
+// referred to by their qid path. The payloads are, using the encoding of
+// snapshots:
+//
+//	create   parent[8] path[8] mode[4] name[s] uid[s] gid[s]
+//	write    path[8] offset[8] count[4] data[count]
+//	truncate path[8] length[8]
+//	rename   parent[8] path[8] oldname[s] newname[s]
+//	remove   parent[8] path[8] name[s]
+//	move     parent[8] path[8] name[s] newparent[8] newname[s]
+//	wstat    path[8] mode[4] mtime[4] length[8] name[s] uid[s] gid[s]
+//
+// A record that is cut short or fails its checksum ends the journal, as that
+// is what a crash in the middle of an append leaves behind.
+//
+// Compaction moves the journal aside before the snapshot is taken, so changes
+// made while the snapshot is written go to a new journal. As the snapshot may
+// already contain some of those, replay is made idempotent: every record
+// describes the result of the change rather than the change itself, and
+// records that no longer apply are skipped. Renames, removes and moves name
+// the file they are for, so that they are not applied to another file that
+// has since taken its name.
+const (
+	recCreate uint8 = iota + 1
+	recWrite
+	recTruncate
+	recRename
+	recRemove
+	recWstat
+	recMove
+)
+
+const (
+	recordHeaderSize = 8
+	maxRecordSize    = 1 << 30
+)
+
+// SyncPolicy decides when the journal is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs every record before the change is applied.
+	SyncAlways SyncPolicy = iota
+
+	// SyncPeriodic syncs once every second, so a crash of the machine may
+	// lose the last second of changes.
+	SyncPeriodic
+
+	// SyncNever leaves it to the operating system. Only a crash of the
+	// process itself is survived.
+	SyncNever
+)
+
+const syncInterval = time.Second
+
+var (
+	errJournalClosed = errors.New("journal closed")
+	errBadRecord     = errors.New("malformed journal record")
+)
+
+// Journal records the changes to a RAMTree.
+type Journal struct {
+	root      *RAMTree
+	state     string
+	policy    SyncPolicy
+	threshold int64
+
+	mu    sync.Mutex
+	f     *os.File
+	size  int64
+	dirty bool
+
+	// err is set when an append fails. The journal may then end in a torn
+	// record, so nothing more can be appended until it has been compacted.
+	err error
+
+	// compactMu serialises compactions. rotated is set while the previous
+	// journal is waiting to be folded into a snapshot.
+	compactMu sync.Mutex
+	rotated   bool
+
+	// moves is held shared by moves between directories, and exclusively
+	// while a snapshot is taken, as the snapshot encodes one directory at
+	// a time and could otherwise see the file in neither or in both.
+	moves sync.RWMutex
+
+	compact chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (j *Journal) path() string {
+	return j.state + ".journal"
+}
+
+func (j *Journal) oldPath() string {
+	return j.state + ".journal.old"
+}
+
+// OpenJournal replays the journal kept next to the snapshot at state into
+// root, which should have been loaded from that snapshot, and starts
+// recording the changes made to root. The journal is compacted into a new
+// snapshot once it grows past threshold bytes, unless threshold is 0.
+// Replaying takes no locks, so it is to be done before root is served.
+func OpenJournal(state string, root *RAMTree, policy SyncPolicy, threshold int64) (*Journal, error) {
+	j := &Journal{
+		root:      root,
+		state:     state,
+		policy:    policy,
+		threshold: threshold,
+		compact:   make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+
+	// Fold what was replayed into the snapshot, so that we start out with
+	// an empty journal.
+	if err := SaveSnapshot(root, state); err != nil {
+		return nil, err
+	}
+	os.Remove(j.oldPath())
+
+	f, err := os.OpenFile(j.path(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	syncDir(filepath.Dir(state))
+	j.f = f
+
+	root.journal = j
+
+	j.wg.Add(1)
+	go j.run()
+	return j, nil
+}
+
+func (j *Journal) run() {
+	defer j.wg.Done()
+
+	var tick <-chan time.Time
+	if j.policy == SyncPeriodic {
+		t := time.NewTicker(syncInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			if err := j.Sync(); err != nil {
+				log.Printf("ramtree: unable to sync journal: %v", err)
+			}
+		case <-j.compact:
+			if err := j.Compact(); err != nil {
+				log.Printf("ramtree: unable to compact journal: %v", err)
+			}
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// append writes a record. Being called with the lock of the changed file or
+// directory held keeps the records of each in the order they are applied.
+func (j *Journal) append(typ uint8, now time.Time, payload func(e *encoder)) error {
+	if j == nil {
+		return nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, recordHeaderSize))
+	e := &encoder{w: buf}
+	e.write(typ)
+	e.write(now.UnixNano())
+	payload(e)
+	if e.err != nil {
+		return e.err
+	}
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b[0:], uint32(len(b)-recordHeaderSize))
+	binary.LittleEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[recordHeaderSize:]))
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.err != nil {
+		return j.err
+	}
+	if j.f == nil {
+		return errJournalClosed
+	}
+
+	if _, err := j.f.Write(b); err != nil {
+		j.err = err
+		return err
+	}
+	j.size += int64(len(b))
+	if j.policy == SyncAlways {
+		if err := j.f.Sync(); err != nil {
+			j.err = err
+			return err
+		}
+	} else {
+		j.dirty = true
+	}
+
+	if j.threshold > 0 && j.size >= j.threshold {
+		select {
+		case j.compact <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (j *Journal) create(now time.Time, parent, id uint64, name string, perms protocol.FileMode, user, group string) error {
+	return j.append(recCreate, now, func(e *encoder) {
+		e.write(parent)
+		e.write(id)
+		e.write(uint32(perms))
+		e.string(name)
+		e.string(user)
+		e.string(group)
+	})
+}
+
+func (j *Journal) write(now time.Time, id uint64, offset int64, p []byte) error {
+	return j.append(recWrite, now, func(e *encoder) {
+		e.write(id)
+		e.write(uint64(offset))
+		e.write(uint32(len(p)))
+		e.bytes(p)
+	})
+}
+
+func (j *Journal) truncate(now time.Time, id, length uint64) error {
+	return j.append(recTruncate, now, func(e *encoder) {
+		e.write(id)
+		e.write(length)
+	})
+}
+
+func (j *Journal) rename(now time.Time, parent uint64, f fileserver.File, oldname, newname string) error {
+	id, _ := fileID(f)
+	return j.append(recRename, now, func(e *encoder) {
+		e.write(parent)
+		e.write(id)
+		e.string(oldname)
+		e.string(newname)
+	})
+}
+
+func (j *Journal) remove(now time.Time, parent uint64, f fileserver.File, name string) error {
+	id, _ := fileID(f)
+	return j.append(recRemove, now, func(e *encoder) {
+		e.write(parent)
+		e.write(id)
+		e.string(name)
+	})
+}
+
+func (j *Journal) move(now time.Time, parent uint64, f fileserver.File, name string, newparent uint64, newname string) error {
+	id, _ := fileID(f)
+	return j.append(recMove, now, func(e *encoder) {
+		e.write(parent)
+		e.write(id)
+		e.string(name)
+		e.write(newparent)
+		e.string(newname)
+	})
+}
+
+func (j *Journal) wstat(now time.Time, id uint64, s protocol.Stat) error {
+	return j.append(recWstat, now, func(e *encoder) {
+		e.write(id)
+		e.write(uint32(s.Mode))
+		e.write(s.Mtime)
+		e.write(s.Length)
+		e.string(s.Name)
+		e.string(s.UID)
+		e.string(s.GID)
+	})
+}
+
+// Sync flushes the journal to stable storage.
+func (j *Journal) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil || !j.dirty {
+		return nil
+	}
+	if err := j.f.Sync(); err != nil {
+		if j.err == nil {
+			j.err = err
+		}
+		return err
+	}
+	j.dirty = false
+	return nil
+}
+
+// startMove holds off compaction until endMove, so that a move between
+// directories ends up either wholly in the snapshot or wholly in the journal
+// after it. It must be called before the locks of the directories are taken.
+func (j *Journal) startMove() {
+	if j != nil {
+		j.moves.RLock()
+	}
+}
+
+// endMove ends what startMove started.
+func (j *Journal) endMove() {
+	if j != nil {
+		j.moves.RUnlock()
+	}
+}
+
+// Compact folds the journal into a new snapshot, and starts over with an
+// empty journal. It is done automatically once the journal grows past its
+// threshold.
+func (j *Journal) Compact() error {
+	j.compactMu.Lock()
+	defer j.compactMu.Unlock()
+
+	j.moves.Lock()
+	err := j.rotate()
+	if err == nil {
+		err = SaveSnapshot(j.root, j.state)
+	}
+	j.moves.Unlock()
+	if err != nil {
+		return err
+	}
+
+	j.rotated = false
+	os.Remove(j.oldPath())
+	syncDir(filepath.Dir(j.state))
+	return nil
+}
+
+// rotate moves the journal aside and opens a new one.
+func (j *Journal) rotate() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return errJournalClosed
+	}
+	if j.rotated {
+		// The snapshot failed last time, so the old journal is still
+		// needed, and the current one holds what came after it.
+		return nil
+	}
+
+	if err := j.f.Sync(); err != nil && j.err == nil {
+		return err
+	}
+	if err := os.Rename(j.path(), j.oldPath()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		os.Rename(j.oldPath(), j.path())
+		return err
+	}
+	syncDir(filepath.Dir(j.state))
+
+	j.f.Close()
+	j.f = f
+	j.size = 0
+	j.dirty = false
+	j.err = nil
+	j.rotated = true
+	return nil
+}
+
+// Close syncs and closes the journal. Changes to the tree fail from then on.
+func (j *Journal) Close() error {
+	select {
+	case <-j.done:
+	default:
+		close(j.done)
+	}
+	j.wg.Wait()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Sync()
+	if cerr := j.f.Close(); err == nil {
+		err = cerr
+	}
+	j.f = nil
+	return err
+}
+
+// replay applies the journals left behind, oldest first.
+func (j *Journal) replay() error {
+	index := make(map[uint64]fileserver.File)
+	indexTree(index, j.root)
+
+	for _, p := range []string{j.oldPath(), j.path()} {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = replayJournal(bufio.NewReader(f), index)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+	}
+	return nil
+}
+
+func indexTree(index map[uint64]fileserver.File, f fileserver.File) {
+	switch f := f.(type) {
+	case *RAMTree:
+		index[f.id] = f
+		for _, c := range f.tree {
+			indexTree(index, c)
+		}
+	case *RAMFile:
+		index[f.id] = f
+	}
+}
+
+func unindexTree(index map[uint64]fileserver.File, f fileserver.File) {
+	switch f := f.(type) {
+	case *RAMTree:
+		delete(index, f.id)
+		for _, c := range f.tree {
+			unindexTree(index, c)
+		}
+	case *RAMFile:
+		delete(index, f.id)
+	}
+}
+
+// readRecord returns the next record, io.EOF at the end of the journal, and
+// io.ErrUnexpectedEOF or errBadRecord for a torn record.
+func readRecord(r io.Reader) (uint8, time.Time, *decoder, error) {
+	var hdr [recordHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, time.Time{}, nil, err
+	}
+	size := binary.LittleEndian.Uint32(hdr[0:])
+	if size > maxRecordSize {
+		return 0, time.Time{}, nil, errBadRecord
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, time.Time{}, nil, err
+	}
+	if crc32.ChecksumIEEE(b) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return 0, time.Time{}, nil, errBadRecord
+	}
+
+	d := &decoder{r: bytes.NewReader(b)}
+	var typ uint8
+	var ns int64
+	d.read(&typ)
+	d.read(&ns)
+	if d.err != nil {
+		return 0, time.Time{}, nil, errBadRecord
+	}
+	return typ, time.Unix(0, ns), d, nil
+}
+
+// isFile reports whether f is the file with the qid path id.
+func isFile(f fileserver.File, id uint64) bool {
+	fid, ok := fileID(f)
+	return ok && fid == id
+}
+
+func replayJournal(r io.Reader, index map[uint64]fileserver.File) error {
+	for {
+		typ, now, d, err := readRecord(r)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF, errBadRecord:
+			return nil
+		default:
+			return err
+		}
+
+		applyRecord(index, typ, now, d)
+		if d.err != nil {
+			// The checksum was fine, so this is no crash.
+			return errBadRecord
+		}
+	}
+}
+
+func applyRecord(index map[uint64]fileserver.File, typ uint8, now time.Time, d *decoder) {
+	switch typ {
+	case recCreate:
+		var parent, id uint64
+		var perms uint32
+		d.read(&parent)
+		d.read(&id)
+		d.read(&perms)
+		name, user, group := d.string(), d.string(), d.string()
+		t, ok := index[parent].(*RAMTree)
+		if d.err != nil || !ok || index[id] != nil || t.tree[name] != nil {
+			return
+		}
+		index[id] = t.create(now, id, name, protocol.FileMode(perms), user, group)
+		reserveIDs(id + 1)
+
+	case recWrite:
+		var id, offset uint64
+		var count uint32
+		d.read(&id)
+		d.read(&offset)
+		d.read(&count)
+		data := d.bytes(uint64(count))
+		if f, ok := index[id].(*RAMFile); ok && d.err == nil {
+			f.writeAt(now, data, int64(offset))
+		}
+
+	case recTruncate:
+		var id, length uint64
+		d.read(&id)
+		d.read(&length)
+		if f, ok := index[id].(*RAMFile); ok && d.err == nil {
+			f.truncate(length)
+			f.mtime = now
+			f.atime = now
+			f.version++
+		}
+
+	case recRename:
+		var parent, id uint64
+		d.read(&parent)
+		d.read(&id)
+		oldname, newname := d.string(), d.string()
+		t, ok := index[parent].(*RAMTree)
+		if d.err != nil || !ok || !isFile(t.tree[oldname], id) {
+			return
+		}
+		if f := t.tree[newname]; f != nil {
+			unindexTree(index, f)
+		}
+		f := t.tree[oldname]
+		t.unlink(oldname)
+		t.link(newname, f)
+		t.modified(now)
+		setName(f, newname)
+
+	case recRemove:
+		var parent, id uint64
+		d.read(&parent)
+		d.read(&id)
+		name := d.string()
+		t, ok := index[parent].(*RAMTree)
+		if d.err != nil || !ok || !isFile(t.tree[name], id) {
+			return
+		}
+		unindexTree(index, t.tree[name])
+		t.unlink(name)
+		t.modified(now)
+
+	case recMove:
+		var parent, id, newparent uint64
+		d.read(&parent)
+		d.read(&id)
+		name := d.string()
+		d.read(&newparent)
+		newname := d.string()
+		t, ok := index[parent].(*RAMTree)
+		nt, nok := index[newparent].(*RAMTree)
+		if d.err != nil || !ok || !nok || !isFile(t.tree[name], id) {
+			return
+		}
+		if f := nt.tree[newname]; f != nil {
+			unindexTree(index, f)
+		}
+		f := t.tree[name]
+		t.unlink(name)
+		t.modified(now)
+		nt.link(newname, f)
+		nt.modified(now)
+		setName(f, newname)
+
+	case recWstat:
+		var id uint64
+		var s protocol.Stat
+		d.read(&id)
+		d.read(&s.Mode)
+		d.read(&s.Mtime)
+		d.read(&s.Length)
+		s.Name, s.UID, s.GID = d.string(), d.string(), d.string()
+		if d.err != nil {
+			return
+		}
+		switch f := index[id].(type) {
+		case *RAMFile:
+			f.setStat(now, s)
+		case *RAMTree:
+			f.setStat(now, s)
+		}
+
+	default:
+		d.err = errBadRecord
+	}
+}
@@ -0,0 +1,163 @@
+package ramtree
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// mutate makes one of every kind of change to the tree.
+func mutate(t *testing.T, root *RAMTree) {
+	d, err := root.Create("glenda", "dir", 0777|protocol.DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.(*RAMTree).Create("glenda", "file", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	of, err := f.Open("glenda", protocol.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	of.Write([]byte("hello"))
+	of.Seek(10, 0)
+	of.Write([]byte("world"))
+	of.Close()
+
+	st, _ := f.Stat()
+	st.Length = 12
+	st.Mode = 0640
+	st.Mtime = 1000000000
+	if err := f.WriteStat(st); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.(*RAMTree).Rename("glenda", "file", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	st.Name = "renamed"
+	if err := f.WriteStat(st); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := root.Create("glenda", "gone", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	of, _ = g.Open("glenda", protocol.OWRITE)
+	of.Write([]byte("data"))
+	of.Close()
+	if _, err := g.Open("glenda", protocol.OWRITE|protocol.OTRUNC); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Remove("glenda", "gone"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func openTestJournal(t *testing.T, state string) (*RAMTree, *Journal) {
+	root, err := LoadSnapshot(state)
+	if os.IsNotExist(err) {
+		root = NewRAMTree("/", 0777, "glenda", "glenda")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	j, err := OpenJournal(state, root, SyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root, j
+}
+
+func TestJournalReplay(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state")
+	root, j := openTestJournal(t, state)
+	mutate(t, root)
+
+	// Closing without compacting leaves everything in the journal, like a
+	// crash would.
+	if err := j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, j := openTestJournal(t, state)
+	defer j.Close()
+	compareTrees(t, root, restored, true)
+}
+
+func TestJournalTornRecord(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state")
+	root, j := openTestJournal(t, state)
+	mutate(t, root)
+	j.Close()
+
+	f, err := os.OpenFile(state+".journal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1, 2, 3, 4, recWrite})
+	f.Close()
+
+	restored, j := openTestJournal(t, state)
+	defer j.Close()
+	compareTrees(t, root, restored, true)
+}
+
+func TestJournalInterruptedCompaction(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state")
+	root, j := openTestJournal(t, state)
+	mutate(t, root)
+
+	// Names that are taken again after a rename or remove must keep the new
+	// files when the old journal is replayed on top of the snapshot.
+	for _, step := range []func() error{
+		func() error { _, err := root.Create("glenda", "a", 0666); return err },
+		func() error { return root.Rename("glenda", "a", "b") },
+		func() error { _, err := root.Create("glenda", "a", 0666); return err },
+		func() error { _, err := root.Create("glenda", "c", 0666); return err },
+		func() error { return root.Remove("glenda", "c") },
+		func() error { _, err := root.Create("glenda", "c", 0666); return err },
+	} {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	// Pretend that we crashed right after the snapshot of a compaction, so
+	// the old journal holds changes that are in the snapshot already.
+	if err := os.Rename(state+".journal", state+".journal.old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveSnapshot(root, state); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, j := openTestJournal(t, state)
+	defer j.Close()
+	// Replaying changes that are already in the snapshot bumps versions
+	// again, which clients take as nothing more than a hint to reread.
+	compareTrees(t, root, restored, false)
+}
+
+func TestJournalCompact(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state")
+	root, j := openTestJournal(t, state)
+	mutate(t, root)
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(state + ".journal"); err != nil || fi.Size() != 0 {
+		t.Fatalf("journal not empty after compaction: %v", err)
+	}
+	if _, err := root.Create("glenda", "after", 0666); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	restored, j := openTestJournal(t, state)
+	defer j.Close()
+	compareTrees(t, root, restored, true)
+}
@@ -0,0 +1,82 @@
+package ramtree
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+)
+
+// listNames reads the directory in reads of count bytes.
+func listNames(t *testing.T, of interface {
+	Read([]byte) (int, error)
+}, count int) []string {
+	var data []byte
+	buf := make([]byte, count)
+	for {
+		n, err := of.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		data = append(data, buf[:n]...)
+	}
+
+	var names []string
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var st protocol.Stat
+		if err := st.Decode(r); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, st.Name)
+	}
+	return names
+}
+
+func TestListing(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	var expected []string
+	for _, i := range rand.Perm(200) {
+		name := fmt.Sprintf("f%03d", i)
+		if _, err := root.Create("glenda", name, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		expected = append(expected, fmt.Sprintf("f%03d", i))
+	}
+
+	of, err := root.Open("glenda", protocol.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+
+	// Reads smaller than an entry split it.
+	for _, count := range []int{8192, 100, 7} {
+		of.Seek(0, 0)
+		names := listNames(t, of, count)
+		if fmt.Sprint(names) != fmt.Sprint(expected) {
+			t.Fatalf("read %d at a time: got %v", count, names)
+		}
+	}
+
+	// Entries changed in the middle of a listing do not shift the others.
+	of.Seek(0, 0)
+	size := make([]byte, 2)
+	of.Read(size)
+	of.Read(make([]byte, int(size[0])|int(size[1])<<8))
+	root.Remove("glenda", "f000")
+	root.Remove("glenda", "f100")
+	root.Remove("glenda", "f199")
+	root.Create("glenda", "f050a", 0666)
+	rest := listNames(t, of, 8192)
+	if len(rest) != 198 || rest[0] != "f001" || rest[50] != "f050a" {
+		t.Fatalf("listing after changes: %v", rest)
+	}
+}
@@ -0,0 +1,296 @@
+package ramtree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// lockSuffix is appended to the name of a file to walk to its lock file.
+const lockSuffix = ".lock"
+
+// Locks provides advisory locks on the files of a tree. The lock of a file
+// named name is taken through the file name.lock, which is not listed but
+// can be walked to. It takes one command per write:
+//
+//	lock duration     take the lock, waiting until it is free
+//	trylock duration  take the lock, failing if it is held
+//	unlock            release the lock
+//
+// A lock is held by the open lock file it was taken through, for the lease
+// given by duration, and taking it again through the same open file renews
+// the lease. It is released when the lease runs out, or when the lock file
+// is closed, as it is when its fid is clunked or its connection goes away.
+// A waiting lock is given up if the write is flushed.
+//
+// Reading the lock file reports the holder and when the lease runs out, or
+// nothing if the lock is free:
+//
+//	glenda 2026-10-18T12:00:00Z
+//
+// Taking a lock needs the permission to read the file. Locks are kept in
+// memory only.
+type Locks struct {
+	sync.Mutex
+	held map[uint64]*lockState
+}
+
+// lockState is a lock that is held.
+type lockState struct {
+	holder  *lockOpenFile
+	expires time.Time
+
+	// released is closed when the lock is released.
+	released chan struct{}
+}
+
+// NewLocks returns a Locks with no lock held.
+func NewLocks() *Locks {
+	return &Locks{held: make(map[uint64]*lockState)}
+}
+
+// SetLocks makes l provide the locks of the files in the tree.
+func (t *RAMTree) SetLocks(l *Locks) {
+	t.locks = l
+}
+
+// acquire takes the lock of the file id for of, for lease. If wait is set,
+// it waits for the lock to be released or its lease to run out, or until
+// ctx is done.
+func (l *Locks) acquire(ctx context.Context, id uint64, of *lockOpenFile, lease time.Duration, wait bool) error {
+	for {
+		l.Lock()
+		now := time.Now()
+		l.expire(now)
+		ls := l.held[id]
+		if ls == nil {
+			ls = &lockState{holder: of, released: make(chan struct{})}
+			l.held[id] = ls
+		}
+		if ls.holder == of {
+			ls.expires = now.Add(lease)
+			l.Unlock()
+			return nil
+		}
+		if !wait {
+			l.Unlock()
+			return fileserver.ErrLocked
+		}
+		released, expires := ls.released, ls.expires
+		l.Unlock()
+
+		timer := time.NewTimer(expires.Sub(now))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// expire releases the locks whose lease has run out. The caller must hold
+// the lock of l.
+func (l *Locks) expire(now time.Time) {
+	for id, ls := range l.held {
+		if !now.Before(ls.expires) {
+			close(ls.released)
+			delete(l.held, id)
+		}
+	}
+}
+
+// release releases the lock of the file id if of holds it, reporting
+// whether it did.
+func (l *Locks) release(id uint64, of *lockOpenFile) bool {
+	l.Lock()
+	defer l.Unlock()
+	ls := l.held[id]
+	if ls == nil || ls.holder != of {
+		return false
+	}
+	close(ls.released)
+	delete(l.held, id)
+	return true
+}
+
+// holder returns who holds the lock of the file id, and until when, or an
+// empty user if it is free.
+func (l *Locks) holder(id uint64) (string, time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	l.expire(time.Now())
+	ls := l.held[id]
+	if ls == nil {
+		return "", time.Time{}
+	}
+	return ls.holder.user, ls.expires
+}
+
+// lockFile returns the lock file of f, or nil if f has no locks. The caller
+// must hold the lock of f.
+func (f *RAMFile) lockFile() *lockFile {
+	if f.locks == nil {
+		return nil
+	}
+	if f.lockf == nil {
+		f.lockf = &lockFile{f: f, id: nextID()}
+	}
+	return f.lockf
+}
+
+// lockFile is the file through which the lock of a file is taken.
+type lockFile struct {
+	f  *RAMFile
+	id uint64
+}
+
+func (lf *lockFile) Name() (string, error) {
+	lf.f.RLock()
+	defer lf.f.RUnlock()
+	return lf.f.name + lockSuffix, nil
+}
+
+func (lf *lockFile) Qid() (protocol.Qid, error) {
+	return protocol.Qid{
+		Type: protocol.QTFILE,
+		Path: lf.id,
+	}, nil
+}
+
+// mode allows writing to those that may read the file.
+func (lf *lockFile) mode() protocol.FileMode {
+	lf.f.RLock()
+	defer lf.f.RUnlock()
+	r := lf.f.permissions & 0444
+	return r | r>>1
+}
+
+func (lf *lockFile) Stat() (protocol.Stat, error) {
+	q, _ := lf.Qid()
+	n, _ := lf.Name()
+	mode := lf.mode()
+	lf.f.RLock()
+	defer lf.f.RUnlock()
+	return protocol.Stat{
+		Qid:   q,
+		Mode:  mode,
+		Name:  n,
+		UID:   lf.f.user,
+		GID:   lf.f.group,
+		MUID:  lf.f.user,
+		Atime: uint32(time.Now().Unix()),
+		Mtime: uint32(lf.f.mtime.Unix()),
+	}, nil
+}
+
+func (lf *lockFile) WriteStat(protocol.Stat) error {
+	return fileserver.ErrPermission
+}
+
+func (lf *lockFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	lf.f.RLock()
+	owner := lf.f.user == user
+	locks := lf.f.locks
+	lf.f.RUnlock()
+	if !permCheck(owner, lf.mode(), mode) {
+		return nil, fileserver.ErrPermission
+	}
+	return &lockOpenFile{lf: lf, locks: locks, user: user}, nil
+}
+
+func (lf *lockFile) IsDir() (bool, error) {
+	return false, nil
+}
+
+func (lf *lockFile) CanRemove() (bool, error) {
+	return false, nil
+}
+
+// lockOpenFile is an open lock file, which is what holds a lock.
+type lockOpenFile struct {
+	lf      *lockFile
+	locks   *Locks
+	user    string
+	content []byte
+	offset  int64
+}
+
+func (of *lockOpenFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += of.offset
+	default:
+		return of.offset, errors.New("invalid whence value")
+	}
+	if offset < 0 {
+		return of.offset, errors.New("negative seek invalid")
+	}
+	of.offset = offset
+	return offset, nil
+}
+
+func (of *lockOpenFile) Read(p []byte) (int, error) {
+	if of.offset == 0 {
+		of.content = nil
+		if user, expires := of.locks.holder(of.lf.f.id); user != "" {
+			of.content = []byte(fmt.Sprintf("%s %s\n", user, expires.UTC().Format(time.RFC3339)))
+		}
+	}
+	if of.offset >= int64(len(of.content)) {
+		return 0, nil
+	}
+	n := copy(p, of.content[of.offset:])
+	of.offset += int64(n)
+	return n, nil
+}
+
+func (of *lockOpenFile) Write(p []byte) (int, error) {
+	return of.WriteContext(context.Background(), p)
+}
+
+func (of *lockOpenFile) WriteContext(ctx context.Context, p []byte) (int, error) {
+	args := strings.Fields(string(p))
+	if len(args) == 0 {
+		return 0, fmt.Errorf("empty command")
+	}
+
+	id := of.lf.f.id
+	switch args[0] {
+	case "lock", "trylock":
+		if len(args) != 2 {
+			return 0, fmt.Errorf("usage: %s duration", args[0])
+		}
+		lease, err := time.ParseDuration(args[1])
+		if err != nil || lease <= 0 {
+			return 0, fmt.Errorf("invalid duration: %q", args[1])
+		}
+		if err := of.locks.acquire(ctx, id, of, lease, args[0] == "lock"); err != nil {
+			return 0, err
+		}
+	case "unlock":
+		if len(args) != 1 {
+			return 0, fmt.Errorf("usage: unlock")
+		}
+		if !of.locks.release(id, of) {
+			return 0, errors.New("lock not held")
+		}
+	default:
+		return 0, fmt.Errorf("unknown command: %q", args[0])
+	}
+	return len(p), nil
+}
+
+func (of *lockOpenFile) Close() error {
+	of.locks.release(of.lf.f.id, of)
+	return nil
+}
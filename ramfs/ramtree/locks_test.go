@@ -0,0 +1,179 @@
+package ramtree
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// openLock opens the lock file of name as user.
+func openLock(t *testing.T, root *RAMTree, user, name string) fileserver.OpenFile {
+	lf, err := root.Walk(user, name+lockSuffix)
+	if err != nil || lf == nil {
+		t.Fatalf("walk to lock file: %v, %v", lf, err)
+	}
+	of, err := lf.Open(user, protocol.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return of
+}
+
+func lockCmd(of fileserver.OpenFile, cmd string) error {
+	_, err := of.Write([]byte(cmd))
+	return err
+}
+
+func TestLocks(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetLocks(NewLocks())
+	if _, err := root.Create("glenda", "file", 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := openLock(t, root, "glenda", "file"), openLock(t, root, "other", "file")
+	if err := lockCmd(a, "trylock 1m"); err != nil {
+		t.Fatal(err)
+	}
+	if err := lockCmd(b, "trylock 1m"); !errors.Is(err, fileserver.ErrLocked) {
+		t.Fatalf("trylock of held lock: got %v", err)
+	}
+	if err := lockCmd(b, "unlock"); err == nil {
+		t.Fatal("unlock of lock held by another succeeded")
+	}
+	if got := string(readAll(t, root.tree["file"].(*RAMFile).lockFile())); len(got) < 7 || got[:7] != "glenda " {
+		t.Fatalf("lock file reads %q", got)
+	}
+
+	done := make(chan error)
+	go func() { done <- lockCmd(b, "lock 1m") }()
+	time.Sleep(10 * time.Millisecond)
+	if err := lockCmd(a, "unlock"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("waiting lock: %v", err)
+	}
+
+	// Closing the holder releases the lock.
+	b.Close()
+	if err := lockCmd(a, "trylock 1m"); err != nil {
+		t.Fatalf("trylock after holder closed: %v", err)
+	}
+}
+
+func TestLockLease(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetLocks(NewLocks())
+	root.Create("glenda", "file", 0644)
+
+	a, b := openLock(t, root, "glenda", "file"), openLock(t, root, "glenda", "file")
+	if err := lockCmd(a, "lock 20ms"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := lockCmd(b, "lock 1m"); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Fatal("lock taken before the lease ran out")
+	}
+}
+
+func TestLockCancel(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetLocks(NewLocks())
+	root.Create("glenda", "file", 0644)
+
+	a, b := openLock(t, root, "glenda", "file"), openLock(t, root, "glenda", "file")
+	lockCmd(a, "lock 1m")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := b.(fileserver.ContextWriter).WriteContext(ctx, []byte("lock 1m"))
+		done <- err
+	}()
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("cancelled lock succeeded")
+	}
+}
+
+func TestLockExpired(t *testing.T) {
+	l := NewLocks()
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetLocks(l)
+	root.Create("glenda", "a", 0644)
+	root.Create("glenda", "b", 0644)
+
+	a := openLock(t, root, "glenda", "a")
+	b := openLock(t, root, "glenda", "b")
+	if err := lockCmd(a, "lock 10ms"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := lockCmd(b, "trylock 1m"); err != nil {
+		t.Fatal(err)
+	}
+	l.Lock()
+	n := len(l.held)
+	l.Unlock()
+	if n != 1 {
+		t.Fatalf("%d locks kept, expected 1", n)
+	}
+}
+
+// TestLockClunk waits for a lock through a FileServer, making sure that a
+// stat waiting behind the blocked write does not keep a clunk from giving up
+// the wait.
+func TestLockClunk(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetLocks(NewLocks())
+	root.Create("glenda", "file", 0644)
+	fs := fileserver.NewFileServer(root, nil, 8192, fileserver.Quiet)
+
+	do := func(_ interface{}, err error) {
+		if err != nil {
+			t.Helper()
+			t.Fatal(err)
+		}
+	}
+	do(fs.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: "9P2000"}))
+	do(fs.Attach(&protocol.AttachRequest{Tag: 1, Fid: 0, AuthFid: protocol.NOFID, Username: "glenda"}))
+	for _, fid := range []protocol.Fid{1, 2} {
+		do(fs.Walk(&protocol.WalkRequest{Tag: 1, Fid: 0, NewFid: fid, Names: []string{"file.lock"}}))
+		do(fs.Open(&protocol.OpenRequest{Tag: 1, Fid: fid, Mode: protocol.ORDWR}))
+	}
+	do(fs.Write(&protocol.WriteRequest{Tag: 1, Fid: 1, Data: []byte("lock 1m")}))
+
+	locked := make(chan error, 1)
+	go func() {
+		_, err := fs.Write(&protocol.WriteRequest{Tag: 2, Fid: 2, Data: []byte("lock 1m")})
+		locked <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go fs.Stat(&protocol.StatRequest{Tag: 3, Fid: 2})
+	time.Sleep(100 * time.Millisecond)
+
+	clunked := make(chan error, 1)
+	go func() {
+		_, err := fs.Clunk(&protocol.ClunkRequest{Tag: 4, Fid: 2})
+		clunked <- err
+	}()
+	select {
+	case err := <-clunked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clunk blocked by a stat waiting for a lock")
+	}
+	if err := <-locked; err == nil {
+		t.Fatal("lock taken through a clunked fid")
+	}
+}
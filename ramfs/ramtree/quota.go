@@ -0,0 +1,264 @@
+package ramtree
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Limits restricts how much a tree may hold. Zero means no limit.
+type Limits struct {
+	// Bytes and Files limit the total size of all files, and of the
+	// versions kept of them, and the number of files and directories below
+	// the root.
+	Bytes int64
+	Files int64
+
+	// FileSize is the largest a single file may grow.
+	FileSize int64
+
+	// UserBytes and UserFiles are the limits for every user, counting the
+	// files the user owns.
+	UserBytes int64
+	UserFiles int64
+}
+
+// Usage is what a tree, or a user, is using.
+type Usage struct {
+	Bytes int64
+	Files int64
+
+	// Resident is how much of the content is held in memory, rather than
+	// spilled to disk or left as holes.
+	Resident int64
+}
+
+// over reports whether u would be past limit with bytes more. What is held
+// in memory counts instead of the length of the files where it is more.
+func (u *Usage) over(bytes, limit int64) bool {
+	used := u.Bytes + bytes
+	if u.Resident > used {
+		used = u.Resident
+	}
+	return limit > 0 && used > limit
+}
+
+// Quota keeps track of the usage of a tree, and enforces its limits. Going
+// over the total limits fails with fileserver.ErrNoSpace, going over those
+// of a user with fileserver.ErrQuota, and growing a file too large with
+// fileserver.ErrTooLarge.
+//
+// File sizes are counted as their length, holes included, or as what is held
+// in memory for them if that is more.
+type Quota struct {
+	sync.Mutex
+	limits Limits
+	total  Usage
+	users  map[string]*Usage
+}
+
+// NewQuota returns a Quota enforcing limits.
+func NewQuota(limits Limits) *Quota {
+	return &Quota{
+		limits: limits,
+		users:  make(map[string]*Usage),
+	}
+}
+
+func (q *Quota) user(name string) *Usage {
+	u, ok := q.users[name]
+	if !ok {
+		u = &Usage{}
+		q.users[name] = u
+	}
+	return u
+}
+
+// create charges user for a new file or directory.
+func (q *Quota) create(user string) error {
+	if q == nil {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	u := q.user(user)
+	if q.limits.Files > 0 && q.total.Files+1 > q.limits.Files {
+		return fileserver.ErrNoSpace
+	}
+	if q.limits.UserFiles > 0 && u.Files+1 > q.limits.UserFiles {
+		return fileserver.ErrQuota
+	}
+	q.total.Files++
+	u.Files++
+	return nil
+}
+
+// charge charges user for a directory the tree makes itself, which is not
+// held to the limits.
+func (q *Quota) charge(user string) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.total.Files++
+	q.user(user).Files++
+}
+
+// remove releases a file or directory of size bytes, resident of which are
+// in memory, owned by user.
+func (q *Quota) remove(user string, size, resident int64) {
+	if q == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	u := q.user(user)
+	q.total.Files--
+	q.total.Bytes -= size
+	q.total.Resident -= resident
+	u.Files--
+	u.Bytes -= size
+	u.Resident -= resident
+	if u.Files == 0 && u.Bytes == 0 {
+		delete(q.users, user)
+	}
+}
+
+// resize charges user for a file growing from oldsize to newsize, or
+// releases what it shrinks by.
+func (q *Quota) resize(user string, oldsize, newsize int64) error {
+	if q == nil || oldsize == newsize {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	delta := newsize - oldsize
+	u := q.user(user)
+	if delta > 0 {
+		if q.limits.FileSize > 0 && newsize > q.limits.FileSize {
+			return fileserver.ErrTooLarge
+		}
+		if q.total.over(delta, q.limits.Bytes) {
+			return fileserver.ErrNoSpace
+		}
+		if u.over(delta, q.limits.UserBytes) {
+			return fileserver.ErrQuota
+		}
+	}
+	q.total.Bytes += delta
+	u.Bytes += delta
+	return nil
+}
+
+// reside records that the content of a file owned by user held in memory
+// changed by delta bytes.
+func (q *Quota) reside(user string, delta int64) {
+	if q == nil || delta == 0 {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.total.Resident += delta
+	q.user(user).Resident += delta
+}
+
+// Usage returns the usage of the whole tree.
+func (q *Quota) Usage() Usage {
+	q.Lock()
+	defer q.Unlock()
+	return q.total
+}
+
+// UserUsage returns the usage of every user that owns files.
+func (q *Quota) UserUsage() map[string]Usage {
+	q.Lock()
+	defer q.Unlock()
+	m := make(map[string]Usage, len(q.users))
+	for name, u := range q.users {
+		m[name] = *u
+	}
+	return m
+}
+
+// String formats the usage and limits, a line for the tree followed by one
+// for each user:
+//
+//	total bytes 1234 10485760 files 12 1000 resident 1234
+//	user glenda bytes 1234 0 files 12 0
+//
+// where each figure but the resident bytes is followed by its limit, or 0
+// if there is none.
+func (q *Quota) String() string {
+	q.Lock()
+	defer q.Unlock()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "total bytes %d %d files %d %d resident %d\n", q.total.Bytes, q.limits.Bytes, q.total.Files, q.limits.Files, q.total.Resident)
+
+	names := make([]string, 0, len(q.users))
+	for name := range q.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		u := q.users[name]
+		fmt.Fprintf(&buf, "user %s bytes %d %d files %d %d\n", name, u.Bytes, q.limits.UserBytes, u.Files, q.limits.UserFiles)
+	}
+	return buf.String()
+}
+
+// File returns a read-only file reporting the usage, as formatted by
+// String. It can be added to a tree with RAMTree.Add.
+func (q *Quota) File(name, user, group string) fileserver.File {
+	return newSynthFile(name, 0444, user, group, func(string) []byte {
+		return []byte(q.String())
+	}, nil)
+}
+
+// SetQuota makes q keep track of the tree, which must be a root, counting
+// what it already holds. Limits are not enforced on what is already there.
+func (t *RAMTree) SetQuota(q *Quota) {
+	q.Lock()
+	defer q.Unlock()
+	t.quota = q
+	walkTree(t, func(f fileserver.File) {
+		switch f := f.(type) {
+		case *RAMTree:
+			if f != t {
+				f.RLock()
+				q.user(f.user).Files++
+				q.total.Files++
+				f.RUnlock()
+			}
+		case *RAMFile:
+			f.RLock()
+			u := q.user(f.user)
+			u.Files++
+			u.Bytes += f.content.Len() + f.kept()
+			u.Resident += f.content.resident
+			q.total.Files++
+			q.total.Bytes += f.content.Len() + f.kept()
+			q.total.Resident += f.content.resident
+			f.RUnlock()
+		}
+	})
+}
+
+// releaseQuota releases what a removed file or directory was charged.
+func releaseQuota(q *Quota, f fileserver.File) {
+	switch f := f.(type) {
+	case *RAMTree:
+		q.remove(f.user, 0, 0)
+	case *RAMFile:
+		f.RLock()
+		defer f.RUnlock()
+		q.remove(f.user, f.content.Len()+f.kept(), f.content.resident)
+	}
+}
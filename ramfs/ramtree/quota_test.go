@@ -0,0 +1,170 @@
+package ramtree
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func newQuotaTree(t *testing.T, l Limits) (*RAMTree, *Quota) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	q := NewQuota(l)
+	root.SetQuota(q)
+	return root, q
+}
+
+func writeFile(t *testing.T, f fileserver.File, offset int64, n int) error {
+	of, err := f.Open("glenda", protocol.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+	of.Seek(offset, 0)
+	_, err = of.Write(make([]byte, n))
+	return err
+}
+
+func TestQuotaFiles(t *testing.T) {
+	root, q := newQuotaTree(t, Limits{Files: 3, UserFiles: 2})
+
+	for _, name := range []string{"a", "b"} {
+		if _, err := root.Create("glenda", name, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := root.Create("glenda", "c", 0666); !errors.Is(err, fileserver.ErrQuota) {
+		t.Fatalf("create over user limit: got %v", err)
+	}
+	if _, err := root.Create("other", "c", 0777|protocol.DMDIR); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Create("other", "d", 0666); !errors.Is(err, fileserver.ErrNoSpace) {
+		t.Fatalf("create over total limit: got %v", err)
+	}
+
+	if err := root.Remove("glenda", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.Create("glenda", "d", 0666); err != nil {
+		t.Fatalf("create after remove: %v", err)
+	}
+	if u := q.Usage(); u.Files != 3 {
+		t.Fatalf("usage is %d files, expected 3", u.Files)
+	}
+}
+
+func TestQuotaBytes(t *testing.T) {
+	root, q := newQuotaTree(t, Limits{Bytes: 1000, FileSize: 600, UserBytes: 800})
+
+	a, _ := root.Create("glenda", "a", 0666)
+	b, _ := root.Create("glenda", "b", 0666)
+	c, _ := root.Create("other", "c", 0666)
+
+	if err := writeFile(t, a, 0, 601); !errors.Is(err, fileserver.ErrTooLarge) {
+		t.Fatalf("write over file size limit: got %v", err)
+	}
+	if err := writeFile(t, a, 100, 500); err != nil {
+		t.Fatal(err)
+	}
+	// Overwriting costs nothing.
+	if err := writeFile(t, a, 0, 600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(t, b, 0, 201); !errors.Is(err, fileserver.ErrQuota) {
+		t.Fatalf("write over user limit: got %v", err)
+	}
+	if err := writeFile(t, c, 0, 401); !errors.Is(err, fileserver.ErrNoSpace) {
+		t.Fatalf("write over total limit: got %v", err)
+	}
+
+	st, _ := a.Stat()
+	st.Length = 100
+	if err := a.WriteStat(st); err != nil {
+		t.Fatal(err)
+	}
+	if u := q.Usage(); u.Resident != u.Bytes {
+		t.Fatalf("%d bytes resident after truncate, expected %d", u.Resident, u.Bytes)
+	}
+	if err := writeFile(t, c, 0, 400); err != nil {
+		t.Fatalf("write after truncate: %v", err)
+	}
+	st.Length = 700
+	if err := a.WriteStat(st); !errors.Is(err, fileserver.ErrTooLarge) {
+		t.Fatalf("extend over file size limit: got %v", err)
+	}
+
+	if _, err := a.Open("glenda", protocol.OWRITE|protocol.OTRUNC); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Remove("other", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if u := q.Usage(); u.Bytes != 0 {
+		t.Fatalf("usage is %d bytes after truncate and remove, expected 0", u.Bytes)
+	}
+}
+
+// TestQuotaFailedWrite checks that a write that fails gives back what it
+// was charged.
+func TestQuotaFailedWrite(t *testing.T) {
+	root, q := newQuotaTree(t, Limits{})
+	root.SetSpill(newTestSpill(t, 0))
+	f, _ := root.Create("glenda", "a", 0666)
+	if err := writeFile(t, f, 0, 2*chunkSize); err != nil {
+		t.Fatal(err)
+	}
+	rf := f.(*RAMFile)
+	if rf.content.store == nil {
+		t.Fatal("file was not spilled")
+	}
+	rf.content.store.f.Close()
+
+	if err := writeFile(t, f, 2*chunkSize, 100); err == nil {
+		t.Fatal("write to closed backing file succeeded")
+	}
+	if u := q.Usage(); u.Bytes != 2*chunkSize || rf.content.Len() != 2*chunkSize {
+		t.Fatalf("usage after failed write: %+v, file is %d bytes", u, rf.content.Len())
+	}
+}
+
+func TestQuotaExisting(t *testing.T) {
+	root := newTestTree(t)
+	q := NewQuota(Limits{})
+	root.SetQuota(q)
+
+	if u := q.Usage(); u.Files != 3 || u.Bytes != int64(len("hello, world")) {
+		t.Fatalf("usage of existing tree: %+v", u)
+	}
+	if u := q.UserUsage()["glenda"]; u.Files != 3 {
+		t.Fatalf("user usage of existing tree: %+v", u)
+	}
+}
+
+func TestQuotaFile(t *testing.T) {
+	root, q := newQuotaTree(t, Limits{Bytes: 100})
+	f, _ := root.Create("glenda", "a", 0666)
+	writeFile(t, f, 0, 10)
+	if err := root.Add("usage", q.File("usage", "glenda", "glenda")); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := root.Walk("glenda", "usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	of, err := u.Open("glenda", protocol.OREAD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(of)
+	expected := "total bytes 10 100 files 1 0 resident 10\nuser glenda bytes 10 0 files 1 0\n"
+	if string(b) != expected {
+		t.Fatalf("usage file: got %q, expected %q", b, expected)
+	}
+	if _, err := u.Open("glenda", protocol.OWRITE); err == nil {
+		t.Fatal("usage file opened for writing")
+	}
+}
@@ -0,0 +1,353 @@
+package ramtree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// A snapshot holds a complete tree. All integers are little endian, and
+// strings are a 16-bit length followed by that many bytes, as in 9P. It
+// starts with a header:
+//
+//	magic[8]  "RAMTREE1"
+//	nextid[8] the next qid path to hand out
+//
+// followed by the root directory. Every file or directory is stored as:
+//
+//	type[1]     0 for files, 1 for directories
+//	path[8]     qid path
+//	version[4]  qid version
+//	mode[4]     permissions, without DMDIR
+//	atime[8]    access time, in nanoseconds since the epoch
+//	mtime[8]    modification time, in nanoseconds since the epoch
+//	name[s] uid[s] gid[s] muid[s]
+//
+// Files are followed by their content, with holes written out as zeroes:
+//
+//	length[8] data[length]
+//
+// and directories by their entries:
+//
+//	count[4] entry...
+const snapshotMagic = "RAMTREE1"
+
+const (
+	snapshotFile = 0
+	snapshotDir  = 1
+)
+
+var errBadSnapshot = errors.New("malformed snapshot")
+
+// encoder writes the fields of snapshots and journal records, remembering
+// the first error.
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) write(v interface{}) {
+	if e.err == nil {
+		e.err = binary.Write(e.w, binary.LittleEndian, v)
+	}
+}
+
+func (e *encoder) string(s string) {
+	if len(s) > 0xFFFF {
+		e.err = errBadSnapshot
+		return
+	}
+	e.write(uint16(len(s)))
+	e.bytes([]byte(s))
+}
+
+func (e *encoder) bytes(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) header(typ uint8, id uint64, version uint32, mode protocol.FileMode, atime, mtime time.Time, name, user, group, muser string) {
+	e.write(typ)
+	e.write(id)
+	e.write(version)
+	e.write(uint32(mode &^ protocol.DMDIR))
+	e.write(atime.UnixNano())
+	e.write(mtime.UnixNano())
+	e.string(name)
+	e.string(user)
+	e.string(group)
+	e.string(muser)
+}
+
+// file encodes f, which is the entry name of its directory.
+func (e *encoder) file(f fileserver.File, name string) {
+	switch f := f.(type) {
+	case *RAMTree:
+		e.tree(f, name)
+	case *RAMFile:
+		f.RLock()
+		defer f.RUnlock()
+		e.header(snapshotFile, f.id, f.version, f.permissions, f.atime, f.mtime, name, f.user, f.group, f.muser)
+		e.write(uint64(f.content.Len()))
+		if e.err == nil {
+			_, e.err = f.content.WriteTo(e.w)
+		}
+	}
+}
+
+// stored reports whether f is kept in snapshots. Other kinds of files are
+// provided by the program serving the tree, and recreated by it.
+func stored(f fileserver.File) bool {
+	switch f.(type) {
+	case *RAMTree, *RAMFile:
+		return true
+	}
+	return false
+}
+
+func (e *encoder) tree(t *RAMTree, name string) {
+	t.RLock()
+	defer t.RUnlock()
+	e.header(snapshotDir, t.id, t.version, t.permissions, t.atime, t.mtime, name, t.user, t.group, t.muser)
+	var n uint32
+	for _, f := range t.tree {
+		if stored(f) {
+			n++
+		}
+	}
+	e.write(n)
+	for _, name := range t.names {
+		if f := t.tree[name]; stored(f) {
+			e.file(f, name)
+		}
+	}
+}
+
+// Snapshot writes the tree to w in the snapshot format. Every file and
+// directory is locked while it is written, but the tree as a whole is not,
+// so changes made while the snapshot is taken may or may not be included.
+func (t *RAMTree) Snapshot(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	e := &encoder{w: bw}
+	e.bytes([]byte(snapshotMagic))
+	e.write(peekID())
+	t.RLock()
+	name := t.name
+	t.RUnlock()
+	e.tree(t, name)
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+// decoder reads what encoder writes.
+type decoder struct {
+	r   io.Reader
+	err error
+
+	// next is one past the highest qid path seen.
+	next uint64
+
+	// features is shared by the files and directories decoded.
+	features *features
+}
+
+func (d *decoder) read(v interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.LittleEndian, v)
+	}
+}
+
+func (d *decoder) string() string {
+	var l uint16
+	d.read(&l)
+	return string(d.bytes(uint64(l)))
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if d.err != nil || n == 0 {
+		return nil
+	}
+	// The length comes from the file, so it is not trusted with an
+	// allocation before the data has actually been seen.
+	b, err := io.ReadAll(io.LimitReader(d.r, int64(n)))
+	if err == nil && uint64(len(b)) != n {
+		err = io.ErrUnexpectedEOF
+	}
+	d.err = err
+	return b
+}
+
+func (d *decoder) time() time.Time {
+	var ns int64
+	d.read(&ns)
+	return time.Unix(0, ns)
+}
+
+func (d *decoder) file() fileserver.File {
+	var (
+		typ     uint8
+		id      uint64
+		version uint32
+		mode    uint32
+	)
+	d.read(&typ)
+	d.read(&id)
+	d.read(&version)
+	d.read(&mode)
+	atime := d.time()
+	mtime := d.time()
+	name := d.string()
+	user := d.string()
+	group := d.string()
+	muser := d.string()
+	if d.err != nil {
+		return nil
+	}
+	if id >= d.next {
+		d.next = id + 1
+	}
+
+	switch typ {
+	case snapshotFile:
+		var length uint64
+		d.read(&length)
+		f := &RAMFile{
+			features:    d.features,
+			id:          id,
+			name:        name,
+			user:        user,
+			group:       group,
+			muser:       muser,
+			atime:       atime,
+			mtime:       mtime,
+			version:     version,
+			permissions: protocol.FileMode(mode),
+		}
+		if d.err == nil {
+			d.err = f.content.load(d.r, int64(length))
+		}
+		return f
+	case snapshotDir:
+		t := &RAMTree{
+			features:    d.features,
+			tree:        make(map[string]fileserver.File),
+			id:          id,
+			name:        name,
+			user:        user,
+			group:       group,
+			muser:       muser,
+			version:     version,
+			atime:       atime,
+			mtime:       mtime,
+			permissions: protocol.FileMode(mode),
+		}
+		var count uint32
+		d.read(&count)
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			f := d.file()
+			if d.err != nil {
+				break
+			}
+			n, _ := f.Name()
+			if _, ok := t.tree[n]; ok || !validName(n) {
+				d.err = errBadSnapshot
+				break
+			}
+			t.link(n, f)
+		}
+		return t
+	default:
+		d.err = errBadSnapshot
+		return nil
+	}
+}
+
+// Restore reads a tree written by Snapshot. The qid paths are kept, and
+// files created afterwards are given paths that do not collide with them.
+func Restore(r io.Reader) (*RAMTree, error) {
+	d := &decoder{r: bufio.NewReader(r), features: &features{}}
+	if magic := d.bytes(uint64(len(snapshotMagic))); d.err == nil && string(magic) != snapshotMagic {
+		return nil, errBadSnapshot
+	}
+
+	var next uint64
+	d.read(&next)
+	f := d.file()
+	if d.err == io.EOF || d.err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%v: %v", errBadSnapshot, d.err)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	t, ok := f.(*RAMTree)
+	if !ok {
+		return nil, errBadSnapshot
+	}
+
+	// Files created while the snapshot was taken may have been included
+	// despite having paths above the one stored in the header.
+	if d.next > next {
+		next = d.next
+	}
+	reserveIDs(next)
+	return t, nil
+}
+
+// SaveSnapshot writes a snapshot of the tree to the file at path. The
+// snapshot is written to a temporary file that replaces the old one once it
+// is safely on disk, so a crash never leaves a partial snapshot behind.
+func SaveSnapshot(t *RAMTree, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	err = t.Snapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// syncDir makes renames and removals in the directory durable.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// LoadSnapshot restores the tree saved to the file at path.
+func LoadSnapshot(path string) (*RAMTree, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Restore(f)
+}
@@ -0,0 +1,165 @@
+package ramtree
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func newTestTree(t *testing.T) *RAMTree {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	d, err := root.Create("glenda", "dir", 0750|protocol.DMDIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.(*RAMTree).Create("glenda", "file", 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	of, err := f.Open("glenda", protocol.OWRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	of.Write([]byte("hello, world"))
+	of.Close()
+	if _, err := root.Create("glenda", "empty", 0600); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// compareTrees fails the test if the two trees differ. Qid versions only
+// have to be at least as high if exactVersions is false.
+func compareTrees(t *testing.T, a, b fileserver.File, exactVersions bool) {
+	sa, err := a.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sb, err := b.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exactVersions && sb.Qid.Version >= sa.Qid.Version {
+		sb.Qid.Version = sa.Qid.Version
+	}
+	if sa != sb {
+		t.Fatalf("stat differs: %+v and %+v", sa, sb)
+	}
+
+	switch a := a.(type) {
+	case *RAMFile:
+		var ca, cb bytes.Buffer
+		a.content.WriteTo(&ca)
+		b.(*RAMFile).content.WriteTo(&cb)
+		if !bytes.Equal(ca.Bytes(), cb.Bytes()) {
+			t.Fatalf("%s: content differs", sa.Name)
+		}
+	case *RAMTree:
+		bt := b.(*RAMTree)
+		if len(a.tree) != len(bt.tree) {
+			t.Fatalf("%s: %d and %d entries", sa.Name, len(a.tree), len(bt.tree))
+		}
+		for name, f := range a.tree {
+			g, ok := bt.tree[name]
+			if !ok {
+				t.Fatalf("%s: %s missing", sa.Name, name)
+			}
+			compareTrees(t, f, g, exactVersions)
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	root := newTestTree(t)
+
+	var buf bytes.Buffer
+	if err := root.Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+
+	// Pretend that we restart, with IDs starting over.
+	globalIDLock.Lock()
+	globalID = 0
+	globalIDLock.Unlock()
+
+	restored, err := Restore(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	compareTrees(t, root, restored, true)
+
+	f, err := restored.Create("glenda", "new", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, _ := f.Qid()
+	for _, name := range []string{"dir", "empty"} {
+		if q2, _ := restored.tree[name].Qid(); q2.Path >= q.Path {
+			t.Errorf("new file got qid path %d, not above restored %d", q.Path, q2.Path)
+		}
+	}
+}
+
+// TestSnapshotRename makes sure that entries are restored under the names
+// they have in their directories.
+func TestSnapshotRename(t *testing.T) {
+	root := newTestTree(t)
+	if err := root.Rename("glenda", "dir", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Add("alias", NewRAMFile("original", 0644, "glenda", "glenda")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := root.Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	restored, err := Restore(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	for _, name := range []string{"renamed", "alias"} {
+		f := restored.tree[name]
+		if f == nil {
+			t.Fatalf("%s not restored", name)
+		}
+		if n, _ := f.Name(); n != name {
+			t.Errorf("%s restored with the name %s", name, n)
+		}
+	}
+}
+
+func TestSnapshotFile(t *testing.T) {
+	root := newTestTree(t)
+	path := filepath.Join(t.TempDir(), "state")
+
+	if err := SaveSnapshot(root, path); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	restored, err := LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	compareTrees(t, root, restored, true)
+}
+
+func TestRestoreMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	if err := newTestTree(t).Snapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+
+	for i := 0; i < len(b); i++ {
+		if _, err := Restore(bytes.NewReader(b[:i])); err == nil {
+			t.Fatalf("restore of snapshot truncated to %d bytes succeeded", i)
+		}
+	}
+	if _, err := Restore(bytes.NewReader(append([]byte("RAMTREE2"), b[8:]...))); err == nil {
+		t.Fatal("restore with bad magic succeeded")
+	}
+}
@@ -0,0 +1,140 @@
+package ramtree
+
+import (
+	"os"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// Spill moves the content of files that grow past a threshold out of
+// memory, into temporary files on disk. Clients see no difference, but
+// reads and writes of such files go to disk.
+//
+// Every spilled file gets a backing file of its own in a directory created
+// for the Spill. Backing files are removed from the directory as soon as
+// they are created, so the space they take is given back when the file is
+// removed from the tree, or when the process exits, however it does. Close
+// removes the directory and whatever could not be removed early.
+//
+// Content that shrinks below the threshold again stays on disk, unless it is
+// truncated to nothing. Snapshots, journals and dumps hold the content as
+// usual.
+type Spill struct {
+	dir       string
+	threshold int64
+}
+
+// NewSpill returns a Spill that moves files larger than threshold bytes to
+// a new directory in dir, or in the default directory for temporary files
+// if dir is empty.
+func NewSpill(dir string, threshold int64) (*Spill, error) {
+	d, err := os.MkdirTemp(dir, "ramfs-spill")
+	if err != nil {
+		return nil, err
+	}
+	return &Spill{dir: d, threshold: threshold}, nil
+}
+
+// Close removes the backing files. The tree must no longer be in use.
+func (s *Spill) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+func (s *Spill) create() (*backing, error) {
+	f, err := os.CreateTemp(s.dir, "file")
+	if err != nil {
+		return nil, err
+	}
+	// Where open files cannot be removed, Close takes care of it.
+	os.Remove(f.Name())
+	return &backing{f: f}, nil
+}
+
+// check spills c if it has grown past the threshold. A failure to spill
+// leaves the rest of the content in memory, to be tried again when it next
+// grows.
+func (s *Spill) check(c *chunks) {
+	if s == nil || c.Len() <= s.threshold || c.resident == 0 {
+		return
+	}
+	c.spill(s)
+}
+
+// SetSpill makes s keep the content of the files in the tree, moving those
+// that are already too large to disk.
+func (t *RAMTree) SetSpill(s *Spill) {
+	t.spill = s
+	walkTree(t, func(f fileserver.File) {
+		if f, ok := f.(*RAMFile); ok {
+			f.Lock()
+			resident := f.content.resident
+			s.check(&f.content)
+			f.account(resident)
+			f.Unlock()
+		}
+	})
+}
+
+// backing is the file holding the spilled blocks of a file, in slots of
+// chunkSize bytes. It is changed only by the live content of the file, with
+// its lock held, while frozen copies of the content may read from it.
+type backing struct {
+	f    *os.File
+	end  int64
+	free []int64
+
+	// frozen is set while frozen copies refer to the file, which is then
+	// closed once they have all been given back rather than when the file
+	// is removed.
+	frozen bool
+}
+
+// alloc returns the offset of an unused slot.
+func (b *backing) alloc() int64 {
+	if n := len(b.free); n > 0 {
+		slot := b.free[n-1]
+		b.free = b.free[:n-1]
+		return slot
+	}
+	slot := b.end
+	b.end += chunkSize
+	return slot
+}
+
+// release makes a slot available for reuse.
+func (b *backing) release(slot int64) {
+	b.free = append(b.free, slot)
+}
+
+func (b *backing) close() {
+	b.f.Close()
+}
+
+// discard releases the content of a file that has been removed from the
+// tree, once it is no longer open.
+func discard(f fileserver.File) {
+	rf, ok := f.(*RAMFile)
+	if !ok {
+		return
+	}
+	rf.Lock()
+	defer rf.Unlock()
+	rf.removed = true
+	if rf.opens == 0 {
+		rf.release()
+	}
+}
+
+// release gives up the content and the versions of a removed file. A backing
+// file that frozen copies still refer to is kept until they are given back.
+// The caller must hold the lock.
+func (f *RAMFile) release() {
+	for _, v := range f.versions {
+		f.thawContent(v.content)
+	}
+	f.versions = nil
+	if f.content.store != nil && f.content.store.frozen {
+		f.stale = append(f.stale, f.content.store)
+	}
+	f.content.release()
+}
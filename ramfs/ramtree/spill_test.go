@@ -0,0 +1,150 @@
+package ramtree
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func newTestSpill(t *testing.T, threshold int64) *Spill {
+	s, err := NewSpill(t.TempDir(), threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestChunksSpilled(t *testing.T) {
+	var c chunks
+	if err := c.spill(newTestSpill(t, 0)); err != nil {
+		t.Fatal(err)
+	}
+	testChunks(t, &c)
+	if c.resident != 0 {
+		t.Fatalf("%d bytes of spilled content in memory", c.resident)
+	}
+}
+
+func TestSpill(t *testing.T) {
+	root, q := newQuotaTree(t, Limits{})
+	root.SetSpill(newTestSpill(t, 2*chunkSize))
+
+	f, err := root.Create("glenda", "big", 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, 3*chunkSize)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	of, _ := f.Open("glenda", protocol.OWRITE)
+	of.Write(content[:chunkSize])
+	if u := q.Usage(); u.Resident != chunkSize {
+		t.Fatalf("%d bytes resident before spilling", u.Resident)
+	}
+	of.Write(content[chunkSize:])
+	of.Close()
+
+	rf := f.(*RAMFile)
+	if rf.content.store == nil {
+		t.Fatal("file larger than the threshold was not spilled")
+	}
+	if u := q.Usage(); u.Resident != 0 || u.Bytes != int64(len(content)) {
+		t.Fatalf("usage after spilling: %+v", u)
+	}
+	if got := readAll(t, f); !bytes.Equal(got, content) {
+		t.Fatal("spilled content differs")
+	}
+	var buf bytes.Buffer
+	if err := root.Snapshot(&buf); err != nil {
+		t.Fatalf("snapshot of spilled file: %v", err)
+	}
+
+	backing := rf.content.store.f
+	if err := root.Remove("glenda", "big"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backing.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("backing file not closed on remove: %v", err)
+	}
+}
+
+func TestSpillDump(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetSpill(newTestSpill(t, 0))
+	f, _ := root.Create("glenda", "file", 0666)
+	of, _ := f.Open("glenda", protocol.OWRITE)
+	of.Write(bytes.Repeat([]byte("a"), 2*chunkSize))
+
+	d := NewDump(root, "dump", "glenda", "glenda")
+	name, err := d.Take()
+	if err != nil {
+		t.Fatal(err)
+	}
+	of.Seek(0, 0)
+	of.Write([]byte("b"))
+	of.Close()
+
+	dd, _ := d.Walk("glenda", name)
+	df, _ := dd.(fileserver.Dir).Walk("glenda", "file")
+	if got := readAll(t, df); !bytes.Equal(got, bytes.Repeat([]byte("a"), 2*chunkSize)) {
+		t.Fatal("dumped content of spilled file changed")
+	}
+	if got := readAll(t, f); got[0] != 'b' || got[1] != 'a' {
+		t.Fatalf("file content starts with %q", got[:2])
+	}
+
+	// The dump still refers to the backing file, until it is removed.
+	backing := f.(*RAMFile).content.store.f
+	root.Remove("glenda", "file")
+	if got := readAll(t, df); len(got) != 2*chunkSize {
+		t.Fatalf("dumped file reads %d bytes after remove", len(got))
+	}
+	if err := d.Remove("glenda", name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backing.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("backing file not closed on removing the dump: %v", err)
+	}
+}
+
+// TestSpillHistory checks that a backing file given up by a file is kept
+// while versions refer to it, and closed once they are dropped.
+func TestSpillHistory(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	root.SetHistory(NewHistory(1, 0))
+	root.SetSpill(newTestSpill(t, chunkSize))
+	f, _ := root.Create("glenda", "file", 0666)
+	rf := f.(*RAMFile)
+	overwrite(t, f, "small")
+	overwrite(t, f, strings.Repeat("b", 2*chunkSize))
+	backing := rf.content.store.f
+	v := rf.versions[0].version
+
+	// Restoring the small version brings the file back into memory.
+	h, _ := root.Walk("glenda", "file.history")
+	ctl, _ := h.(fileserver.Dir).Walk("glenda", "ctl")
+	of, _ := ctl.Open("glenda", protocol.OWRITE)
+	if _, err := of.Write([]byte("restore " + strconv.FormatUint(uint64(v), 10))); err != nil {
+		t.Fatal(err)
+	}
+	of.Close()
+	if rf.content.store != nil {
+		t.Fatal("restored small version is spilled")
+	}
+	if _, err := backing.Stat(); err != nil {
+		t.Fatalf("backing file held by a version: %v", err)
+	}
+
+	root.Remove("glenda", "file")
+	if _, err := backing.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Fatalf("backing file not closed on remove: %v", err)
+	}
+}
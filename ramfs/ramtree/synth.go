@@ -0,0 +1,203 @@
+package ramtree
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// synthFile is a file whose content is generated when it is opened, and
+// whose writes are handed to a function, like the status and control files
+// of Plan 9 devices. It is not stored in snapshots.
+type synthFile struct {
+	id          uint64
+	name        string
+	user        string
+	group       string
+	permissions protocol.FileMode
+	mtime       time.Time
+
+	// read returns the content of the file, as read by user. write, if not
+	// nil, is given every write to the file.
+	read  func(user string) []byte
+	write func(user string, p []byte) error
+}
+
+func newSynthFile(name string, permissions protocol.FileMode, user, group string, read func(string) []byte, write func(string, []byte) error) *synthFile {
+	return &synthFile{
+		id:          nextID(),
+		name:        name,
+		user:        user,
+		group:       group,
+		permissions: permissions,
+		mtime:       time.Now(),
+		read:        read,
+		write:       write,
+	}
+}
+
+func (f *synthFile) Name() (string, error) {
+	return f.name, nil
+}
+
+func (f *synthFile) Qid() (protocol.Qid, error) {
+	return protocol.Qid{
+		Type: protocol.QTFILE,
+		Path: f.id,
+	}, nil
+}
+
+func (f *synthFile) Stat() (protocol.Stat, error) {
+	q, _ := f.Qid()
+	return protocol.Stat{
+		Qid:   q,
+		Mode:  f.permissions,
+		Name:  f.name,
+		UID:   f.user,
+		GID:   f.group,
+		MUID:  f.user,
+		Atime: uint32(time.Now().Unix()),
+		Mtime: uint32(f.mtime.Unix()),
+	}, nil
+}
+
+func (f *synthFile) WriteStat(protocol.Stat) error {
+	return fileserver.ErrPermission
+}
+
+func (f *synthFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if !permCheck(f.user == user, f.permissions, mode) {
+		return nil, fileserver.ErrPermission
+	}
+	if mode&3 != protocol.OREAD && f.write == nil {
+		return nil, fileserver.ErrPermission
+	}
+
+	of := &synthOpenFile{f: f, user: user}
+	if mode&3 != protocol.OWRITE {
+		of.content = f.read(user)
+	}
+	return of, nil
+}
+
+func (f *synthFile) IsDir() (bool, error) {
+	return false, nil
+}
+
+func (f *synthFile) CanRemove() (bool, error) {
+	return true, nil
+}
+
+type synthOpenFile struct {
+	f       *synthFile
+	user    string
+	content []byte
+	offset  int64
+}
+
+func (of *synthOpenFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += of.offset
+	case 2:
+		offset += int64(len(of.content))
+	default:
+		return of.offset, errors.New("invalid whence value")
+	}
+	if offset < 0 {
+		return of.offset, errors.New("negative seek invalid")
+	}
+	of.offset = offset
+	return offset, nil
+}
+
+func (of *synthOpenFile) Read(p []byte) (int, error) {
+	if of.offset >= int64(len(of.content)) {
+		return 0, io.EOF
+	}
+	n := copy(p, of.content[of.offset:])
+	of.offset += int64(n)
+	return n, nil
+}
+
+func (of *synthOpenFile) Write(p []byte) (int, error) {
+	if err := of.f.write(of.user, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (of *synthOpenFile) Close() error {
+	return nil
+}
+
+// dirListing is an open synthetic directory, reading as the stats of its
+// entries. The entries are listed again whenever it is rewound.
+type dirListing struct {
+	list   func() []fileserver.File
+	buffer []byte
+	offset int64
+}
+
+func newDirListing(list func() []fileserver.File) (*dirListing, error) {
+	dl := &dirListing{list: list}
+	if err := dl.update(); err != nil {
+		return nil, err
+	}
+	return dl, nil
+}
+
+func (dl *dirListing) update() error {
+	buf := new(bytes.Buffer)
+	for _, f := range dl.list() {
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		st.Encode(buf)
+	}
+	dl.buffer = buf.Bytes()
+	return nil
+}
+
+func (dl *dirListing) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += dl.offset
+	default:
+		return dl.offset, errors.New("invalid whence value")
+	}
+	if offset != 0 && offset != dl.offset {
+		return dl.offset, errors.New("seek to other than 0 on dir illegal")
+	}
+	if offset == 0 {
+		if err := dl.update(); err != nil {
+			return dl.offset, err
+		}
+	}
+	dl.offset = offset
+	return offset, nil
+}
+
+func (dl *dirListing) Read(p []byte) (int, error) {
+	if dl.offset >= int64(len(dl.buffer)) {
+		return 0, io.EOF
+	}
+	n := copy(p, dl.buffer[dl.offset:])
+	dl.offset += int64(n)
+	return n, nil
+}
+
+func (dl *dirListing) Write(p []byte) (int, error) {
+	return 0, fileserver.ErrIsDir
+}
+
+func (dl *dirListing) Close() error {
+	return nil
+}
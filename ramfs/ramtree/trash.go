@@ -0,0 +1,545 @@
+package ramtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// TrashTimeFormat is the layout of the names of the directories holding what
+// has been removed.
+const TrashTimeFormat = "2006-01-02T15:04:05.000"
+
+// Trash keeps what is removed from a tree for a while, so that a mistaken
+// remove can be undone. A removed file or directory is moved to
+//
+//	/.trash/<time>/<path>
+//
+// where time is when it was removed, in TrashTimeFormat, and path is where
+// it was. The directories leading up to it are made with the owners and
+// permissions of the ones it was removed from, so what could not be read
+// before cannot be read in the trash. Removing something that is in the
+// trash removes it for good.
+//
+// The trash directory holds a ctl file, which takes one command per write:
+//
+//	restore path [newpath]  move path in the trash back to where it was, or to newpath
+//	purge [name]            remove everything in the trash, or only name
+//
+// where path starts at the trash directory, such as
+// 2026-10-18T12:00:00.000/usr/glenda/notes. As 9P renames stay within a
+// directory, restoring is how a file is renamed out of the trash. It takes
+// the permission to write to both directories, and fails if the file is in
+// the way. Purging everything takes being the owner of the trash directory,
+// and purging one removal that or having removed it. Reading the ctl file
+// lists what is in the trash:
+//
+//	2026-10-18T12:00:00.000 /usr/glenda/notes
+//
+// What is in the trash is stored and counted against the quota like the
+// rest of the tree, until it is purged or its retention is up.
+type Trash struct {
+	// mu serialises the moves in and out of the trash.
+	mu sync.Mutex
+
+	root      *RAMTree
+	dir       *RAMTree
+	retention time.Duration
+}
+
+// NewTrash returns a Trash for the tree at root, keeping what is removed for
+// retention, or until it is purged if retention is 0. The trash directory,
+// name in root, is made unless it is already there.
+func NewTrash(root *RAMTree, name string, retention time.Duration) (*Trash, error) {
+	root.Lock()
+	dir, ok := root.tree[name].(*RAMTree)
+	if !ok {
+		if root.tree[name] != nil {
+			root.Unlock()
+			return nil, fileserver.ErrExist
+		}
+		var err error
+		dir, err = root.mkdir(time.Now(), name, 0555, root.user, root.group)
+		if err != nil {
+			root.Unlock()
+			return nil, err
+		}
+	}
+	root.Unlock()
+
+	tr := &Trash{root: root, dir: dir, retention: retention}
+	ctl := newSynthFile("ctl", 0666, root.user, root.group, func(string) []byte { return tr.list() }, tr.command)
+	if err := dir.Add("ctl", ctl); err != nil {
+		return nil, err
+	}
+	return tr, nil
+}
+
+// SetTrash makes removes from the tree go to tr.
+func (t *RAMTree) SetTrash(tr *Trash) {
+	t.trash = tr
+}
+
+// mkdir makes the directory name for the trash. It is recorded in the
+// journal and counted against the quota, but not held to its limits, so
+// that removing never fails for lack of space. The caller must hold the
+// lock.
+func (t *RAMTree) mkdir(now time.Time, name string, perms protocol.FileMode, user, group string) (*RAMTree, error) {
+	id := nextID()
+	perms |= protocol.DMDIR
+	if err := t.journal.create(now, t.id, id, name, perms, user, group); err != nil {
+		return nil, err
+	}
+	t.quota.charge(user)
+	d := t.create(now, id, name, perms, user, group).(*RAMTree)
+	t.watcher.created(now, t.id, id, name)
+	return d, nil
+}
+
+// move moves the entry name of t to dst as newname. The caller must have
+// started the move in the journal and hold the locks of both.
+func (t *RAMTree) move(now time.Time, name string, dst *RAMTree, newname string) error {
+	f := t.tree[name]
+	if err := t.journal.move(now, t.id, f, name, dst.id, newname); err != nil {
+		return err
+	}
+	t.unlink(name)
+	t.modified(now)
+	dst.link(newname, f)
+	dst.modified(now)
+	setName(f, newname)
+	if id, ok := fileID(f); ok {
+		t.watcher.moved(now, id, dst.id, newname)
+	}
+	return nil
+}
+
+// find returns the directories from the root down to t, leaving out the
+// root, by following the links from t up. It reports false if t is not in
+// the tree, or is in the trash.
+func (tr *Trash) find(t *RAMTree) ([]*RAMTree, bool) {
+	var dirs []*RAMTree
+	for d := t; d != tr.root; d = d.dir.Load() {
+		if d == nil || d == tr.dir {
+			return nil, false
+		}
+		dirs = append(dirs, d)
+	}
+	for i, j := 0, len(dirs)-1; i < j; i, j = i+1, j-1 {
+		dirs[i], dirs[j] = dirs[j], dirs[i]
+	}
+	return dirs, true
+}
+
+// holds reports whether t is the trash directory or below it, where removing
+// is for good.
+func (tr *Trash) holds(t *RAMTree) bool {
+	for d := t; d != nil; d = d.dir.Load() {
+		if d == tr.dir {
+			return true
+		}
+	}
+	return false
+}
+
+// put moves the entry name of t to the trash, on behalf of user.
+func (tr *Trash) put(user string, t *RAMTree, name string) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	t.RLock()
+	f, ok := t.tree[name]
+	allowed := permCheck(t.user == user, t.permissions, protocol.OWRITE)
+	t.RUnlock()
+	if !allowed {
+		return fileserver.ErrPermission
+	}
+	if !ok {
+		return fileserver.ErrNotExist
+	}
+	if f == tr.dir {
+		return fileserver.ErrPermission
+	}
+	if !stored(f) {
+		// What the program serving the tree provides is not kept.
+		return t.remove(name, f)
+	}
+	rem, err := f.CanRemove()
+	if err != nil {
+		return err
+	}
+	if !rem {
+		return fileserver.ErrNotEmpty
+	}
+	return tr.keep(user, t, name, f)
+}
+
+// expire moves f, the entry name of t, to the trash on behalf of its owner,
+// as its time to live is up. Unlike removing, this takes directories that are
+// not empty. It no longer expires, should it be restored.
+func (tr *Trash) expire(t *RAMTree, name string, f fileserver.File) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tr.keep(st.UID, t, name, f); err != nil {
+		return err
+	}
+	setExpiry(f, time.Time{})
+	return nil
+}
+
+// keep moves f, the entry name of t, to the trash on behalf of user. The
+// caller must hold mu.
+func (tr *Trash) keep(user string, t *RAMTree, name string, f fileserver.File) error {
+	dirs, ok := tr.find(t)
+	if !ok {
+		return fileserver.ErrNotExist
+	}
+
+	now := time.Now()
+	dst, err := tr.prepare(now, user, dirs)
+	if err != nil {
+		return err
+	}
+	t.journal.startMove()
+	defer t.journal.endMove()
+	t.Lock()
+	defer t.Unlock()
+	dst.Lock()
+	defer dst.Unlock()
+	if t.tree[name] != f {
+		return fileserver.ErrNotExist
+	}
+	return t.move(now, name, dst, name)
+}
+
+// prepare makes the directory for something removed now by user from the
+// last of dirs, and the ones leading up to it.
+func (tr *Trash) prepare(now time.Time, user string, dirs []*RAMTree) (*RAMTree, error) {
+	tr.dir.Lock()
+	stamp := now.UTC().Format(TrashTimeFormat)
+	name := stamp
+	for i := 2; tr.dir.tree[name] != nil; i++ {
+		name = fmt.Sprintf("%s.%d", stamp, i)
+	}
+	dst, err := tr.dir.mkdir(now, name, 0755, user, tr.dir.group)
+	tr.dir.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range dirs {
+		d.RLock()
+		name, perms, user, group := d.name, d.permissions, d.user, d.group
+		d.RUnlock()
+		dst.Lock()
+		next, err := dst.mkdir(now, name, perms, user, group)
+		dst.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		dst = next
+	}
+	return dst, nil
+}
+
+// remove removes the entry name, f, of t for good, along with everything
+// below it.
+func (t *RAMTree) remove(name string, f fileserver.File) error {
+	t.Lock()
+	defer t.Unlock()
+	if t.tree[name] != f {
+		return fileserver.ErrNotExist
+	}
+	now := time.Now()
+	if err := t.journal.remove(now, t.id, f, name); err != nil {
+		return err
+	}
+	var ids []uint64
+	walkTree(f, func(c fileserver.File) {
+		if t.quota != nil {
+			releaseQuota(t.quota, c)
+		}
+		discard(c)
+		if id, ok := fileID(c); ok {
+			ids = append(ids, id)
+		}
+	})
+	t.unlink(name)
+	t.modified(now)
+	for i := len(ids) - 1; i >= 0; i-- {
+		t.watcher.removed(now, ids[i])
+	}
+	return nil
+}
+
+// lookupParent returns the directory that path, which starts at dir, is in,
+// and the name of the entry. The directory is nil if it does not exist.
+func lookupParent(dir *RAMTree, path string) (*RAMTree, string) {
+	names := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	if len(names) == 0 {
+		return nil, ""
+	}
+	for _, name := range names[:len(names)-1] {
+		dir.RLock()
+		next, ok := dir.tree[name].(*RAMTree)
+		dir.RUnlock()
+		if !ok {
+			return nil, ""
+		}
+		dir = next
+	}
+	return dir, names[len(names)-1]
+}
+
+// Restore moves path in the trash back to where it was removed from, or to
+// newpath if it is not empty, on behalf of user. The directories left empty
+// in the trash are removed.
+func (tr *Trash) Restore(user, path, newpath string) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	src, name := lookupParent(tr.dir, path)
+	if src == nil || src == tr.dir {
+		return fileserver.ErrNotExist
+	}
+	if newpath == "" {
+		// Leave out the time of removal.
+		newpath = strings.TrimLeft(path, "/")
+		if i := strings.Index(newpath, "/"); i >= 0 {
+			newpath = newpath[i:]
+		}
+	}
+	dst, newname := lookupParent(tr.root, newpath)
+	if dst == nil {
+		return fileserver.ErrNotExist
+	}
+	if !validName(newname) {
+		return fileserver.ErrBadName
+	}
+	if _, ok := tr.find(dst); !ok {
+		return fileserver.ErrNotExist
+	}
+
+	if err := tr.restore(user, src, name, dst, newname); err != nil {
+		return err
+	}
+	tr.prune(path)
+	return nil
+}
+
+// restore moves the entry name of src in the trash to dst as newname.
+func (tr *Trash) restore(user string, src *RAMTree, name string, dst *RAMTree, newname string) error {
+	src.journal.startMove()
+	defer src.journal.endMove()
+	src.Lock()
+	defer src.Unlock()
+	dst.Lock()
+	defer dst.Unlock()
+	f, ok := src.tree[name]
+	if !ok || !stored(f) {
+		return fileserver.ErrNotExist
+	}
+	if !permCheck(src.user == user, src.permissions, protocol.OWRITE) || !permCheck(dst.user == user, dst.permissions, protocol.OWRITE) {
+		return fileserver.ErrPermission
+	}
+	if dst.tree[newname] != nil {
+		return fileserver.ErrExist
+	}
+	return src.move(time.Now(), name, dst, newname)
+}
+
+// prune removes the directories of path in the trash that have been left
+// empty, deepest first. The caller must hold tr.mu.
+func (tr *Trash) prune(path string) {
+	names := strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+	for i := len(names) - 1; i > 0; i-- {
+		parent, name := lookupParent(tr.dir, strings.Join(names[:i], "/"))
+		if parent == nil {
+			continue
+		}
+		parent.RLock()
+		d, ok := parent.tree[name].(*RAMTree)
+		parent.RUnlock()
+		if !ok {
+			continue
+		}
+		if empty, _ := d.CanRemove(); !empty || parent.remove(name, d) != nil {
+			return
+		}
+	}
+}
+
+// Purge removes everything in the trash for good.
+func (tr *Trash) Purge() {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, name := range tr.names() {
+		tr.dir.RLock()
+		f := tr.dir.tree[name]
+		tr.dir.RUnlock()
+		if f != nil {
+			tr.dir.remove(name, f)
+		}
+	}
+}
+
+// names returns the names of the removals in the trash, oldest first.
+func (tr *Trash) names() []string {
+	tr.dir.RLock()
+	defer tr.dir.RUnlock()
+	var names []string
+	for _, name := range tr.dir.names {
+		if _, ok := tr.dir.tree[name].(*RAMTree); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// removedAt returns when the removal name in the trash was made.
+func removedAt(name string) (time.Time, bool) {
+	if len(name) > len(TrashTimeFormat) {
+		name = name[:len(TrashTimeFormat)]
+	}
+	t, err := time.Parse(TrashTimeFormat, name)
+	return t, err == nil
+}
+
+// Run removes what has been in the trash for longer than the retention every
+// interval. It does not return.
+func (tr *Trash) Run(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		tr.Reap(now)
+	}
+}
+
+// Reap removes what has been in the trash for longer than the retention by
+// now, returning how many removals it purged.
+func (tr *Trash) Reap(now time.Time) int {
+	if tr.retention <= 0 {
+		return 0
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	n := 0
+	for _, name := range tr.names() {
+		at, ok := removedAt(name)
+		if !ok || now.Before(at.Add(tr.retention)) {
+			continue
+		}
+		tr.dir.RLock()
+		f := tr.dir.tree[name]
+		tr.dir.RUnlock()
+		if f != nil && tr.dir.remove(name, f) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (tr *Trash) command(user string, p []byte) error {
+	args := strings.Fields(string(p))
+	if len(args) == 0 {
+		return errors.New("empty command")
+	}
+
+	switch args[0] {
+	case "restore":
+		if len(args) < 2 || len(args) > 3 {
+			return errors.New("usage: restore path [newpath]")
+		}
+		newpath := ""
+		if len(args) == 3 {
+			newpath = args[2]
+		}
+		return tr.Restore(user, args[1], newpath)
+	case "purge":
+		switch len(args) {
+		case 1:
+			tr.dir.RLock()
+			owner := tr.dir.user
+			tr.dir.RUnlock()
+			if user != owner {
+				return fileserver.ErrPermission
+			}
+			tr.Purge()
+		case 2:
+			return tr.purge(user, args[1])
+		default:
+			return errors.New("usage: purge [name]")
+		}
+	default:
+		return fmt.Errorf("unknown command: %q", bytes.TrimSpace(p))
+	}
+	return nil
+}
+
+// purge removes the removal name from the trash for good, if user made it
+// or owns the trash.
+func (tr *Trash) purge(user, name string) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.dir.RLock()
+	d, ok := tr.dir.tree[name].(*RAMTree)
+	owner := tr.dir.user
+	tr.dir.RUnlock()
+	if !ok {
+		return fileserver.ErrNotExist
+	}
+	d.RLock()
+	remover := d.user
+	d.RUnlock()
+	if user != owner && user != remover {
+		return fileserver.ErrPermission
+	}
+	return tr.dir.remove(name, d)
+}
+
+// list formats what is in the trash, oldest first: every file, and every
+// empty directory, below a removal.
+func (tr *Trash) list() []byte {
+	var lines []string
+	var walk func(removal, path string, f fileserver.File)
+	walk = func(removal, path string, f fileserver.File) {
+		t, ok := f.(*RAMTree)
+		if !ok {
+			if stored(f) {
+				lines = append(lines, fmt.Sprintf("%s %s\n", removal, path))
+			}
+			return
+		}
+		t.RLock()
+		names := append([]string(nil), t.names...)
+		children := make(map[string]fileserver.File, len(t.tree))
+		for name, c := range t.tree {
+			children[name] = c
+		}
+		t.RUnlock()
+		if len(names) == 0 && path != "" {
+			lines = append(lines, fmt.Sprintf("%s %s\n", removal, path))
+		}
+		for _, name := range names {
+			walk(removal, path+"/"+name, children[name])
+		}
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, name := range tr.names() {
+		tr.dir.RLock()
+		f := tr.dir.tree[name]
+		tr.dir.RUnlock()
+		walk(name, "", f)
+	}
+	return []byte(strings.Join(lines, ""))
+}
@@ -0,0 +1,202 @@
+package ramtree
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func newTestTrash(t *testing.T, root *RAMTree, retention time.Duration) *Trash {
+	tr, err := NewTrash(root, ".trash", retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root.SetTrash(tr)
+	return tr
+}
+
+func TestTrash(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	tr := newTestTrash(t, root, time.Hour)
+	ctl, _ := tr.dir.Walk("glenda", "ctl")
+
+	d, _ := root.Create("glenda", "dir", 0750|protocol.DMDIR)
+	f, _ := d.(fileserver.Dir).Create("glenda", "notes", 0640)
+	of, _ := f.Open("glenda", protocol.OWRITE)
+	of.Write([]byte("hello"))
+	of.Close()
+
+	if err := d.(fileserver.Dir).Remove("glenda", "notes"); err != nil {
+		t.Fatal(err)
+	}
+	if g, _ := d.(fileserver.Dir).Walk("glenda", "notes"); g != nil {
+		t.Fatal("removed file still in place")
+	}
+	if err := root.Remove("glenda", ".trash"); err == nil {
+		t.Fatal("removing the trash succeeded")
+	}
+
+	names := tr.names()
+	if len(names) != 1 {
+		t.Fatalf("%d removals in the trash, expected 1", len(names))
+	}
+	list := string(readAll(t, ctl))
+	if want := names[0] + " /dir/notes\n"; list != want {
+		t.Fatalf("trash lists %q, expected %q", list, want)
+	}
+	mirror, _ := lookupParent(tr.dir, names[0]+"/dir/notes")
+	if st, _ := mirror.Stat(); st.Mode&0777 != 0750 || st.UID != "glenda" {
+		t.Fatalf("directory in the trash has mode %o and owner %s", st.Mode, st.UID)
+	}
+	if string(readAll(t, mirror.tree["notes"])) != "hello" {
+		t.Fatal("content lost in the trash")
+	}
+
+	if err := command(t, ctl, "nobody", "restore "+names[0]+"/dir/notes"); err != fileserver.ErrPermission {
+		t.Fatalf("restore by another user: %v", err)
+	}
+	if err := command(t, ctl, "glenda", "restore "+names[0]+"/dir/notes"); err != nil {
+		t.Fatal(err)
+	}
+	if g, _ := d.(fileserver.Dir).Walk("glenda", "notes"); g != f {
+		t.Fatal("file not restored")
+	}
+	if len(tr.names()) != 0 {
+		t.Fatal("emptied removal left in the trash")
+	}
+
+	// What is restored goes to the trash again when removed, under the path
+	// it has by then, and what is removed from the trash is gone.
+	if err := root.Rename("glenda", "dir", "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.(fileserver.Dir).Remove("glenda", "notes"); err != nil {
+		t.Fatal(err)
+	}
+	names = tr.names()
+	mirror, _ = lookupParent(tr.dir, names[0]+"/renamed/notes")
+	if mirror == nil {
+		t.Fatalf("trash lists %q after a rename", readAll(t, ctl))
+	}
+	if err := mirror.Remove("glenda", "notes"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mirror.tree) != 0 || len(tr.names()) != 1 {
+		t.Fatal("file removed from the trash went to the trash")
+	}
+
+	root.Create("glenda", "a", 0666)
+	root.Remove("glenda", "a")
+	if err := command(t, ctl, "nobody", "purge"); err != fileserver.ErrPermission {
+		t.Fatalf("purge by another user: %v", err)
+	}
+	if n := tr.Reap(time.Now().Add(2 * time.Hour)); n != 2 {
+		t.Fatalf("%d removals reaped, expected 2", n)
+	}
+
+	root.Create("glenda", "b", 0666)
+	root.Remove("glenda", "b")
+	if err := command(t, ctl, "glenda", "purge"); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.names()) != 0 {
+		t.Fatal("purged removal left in the trash")
+	}
+}
+
+func TestTrashJournal(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state")
+	root, j := openTestJournal(t, state)
+	tr := newTestTrash(t, root, 0)
+
+	d, _ := root.Create("glenda", "dir", 0777|protocol.DMDIR)
+	d.(fileserver.Dir).Create("glenda", "kept", 0666)
+	d.(fileserver.Dir).Create("glenda", "restored", 0666)
+	if err := d.(fileserver.Dir).Remove("glenda", "kept"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.(fileserver.Dir).Remove("glenda", "restored"); err != nil {
+		t.Fatal(err)
+	}
+	names := tr.names()
+	if err := tr.Restore("glenda", names[1]+"/dir/restored", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	restored, j := openTestJournal(t, state)
+	defer j.Close()
+	compareTrees(t, root.tree["dir"], restored.tree["dir"], true)
+	compareTrees(t, root.tree["moved"], restored.tree["moved"], true)
+	rtr := newTestTrash(t, restored, 0)
+	if got := rtr.names(); len(got) != 1 || got[0] != names[0] {
+		t.Fatalf("trash holds %v after replay, expected %v", got, names[:1])
+	}
+	compareTrees(t, tr.dir.tree[names[0]], rtr.dir.tree[names[0]], true)
+	if !strings.HasPrefix(string(rtr.list()), names[0]+" /dir/kept") {
+		t.Fatalf("trash lists %q after replay", rtr.list())
+	}
+}
+
+func TestTrashCompact(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state")
+	root, j := openTestJournal(t, state)
+	tr := newTestTrash(t, root, 0)
+
+	busy, _ := root.Create("glenda", "busy", 0777|protocol.DMDIR)
+	d, _ := root.Create("glenda", "dir", 0777|protocol.DMDIR)
+	d.(fileserver.Dir).Create("glenda", "kept", 0666)
+	d.(fileserver.Dir).Create("glenda", "restored", 0666)
+
+	// The snapshot takes the trash, and is then held up at busy, which
+	// comes before dir, while fn moves files between the two.
+	compacting := func(fn func()) {
+		busy.(*RAMTree).Lock()
+		compacted := make(chan error, 1)
+		go func() { compacted <- j.Compact() }()
+		time.Sleep(20 * time.Millisecond)
+		done := make(chan struct{})
+		go func() {
+			fn()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(20 * time.Millisecond):
+		}
+		busy.(*RAMTree).Unlock()
+		<-done
+		if err := <-compacted; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	compacting(func() {
+		if err := d.(fileserver.Dir).Remove("glenda", "kept"); err != nil {
+			t.Error(err)
+		}
+		if err := d.(fileserver.Dir).Remove("glenda", "restored"); err != nil {
+			t.Error(err)
+		}
+	})
+	names := tr.names()
+	compacting(func() {
+		if err := tr.Restore("glenda", names[1]+"/dir/restored", ""); err != nil {
+			t.Error(err)
+		}
+	})
+	j.Close()
+
+	restored, j := openTestJournal(t, state)
+	defer j.Close()
+	compareTrees(t, root.tree["dir"], restored.tree["dir"], true)
+	rtr := newTestTrash(t, restored, 0)
+	if got := rtr.names(); len(got) != 1 || got[0] != names[0] {
+		t.Fatalf("trash holds %v after replay, expected %v", got, names[:1])
+	}
+	compareTrees(t, tr.dir.tree[names[0]], rtr.dir.tree[names[0]], true)
+}
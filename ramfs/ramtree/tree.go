@@ -3,47 +3,38 @@ package ramtree
 import (
 	"bytes"
 	"errors"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kennylevinsen/g9p/protocol"
 	"github.com/kennylevinsen/g9ptools/fileserver"
 )
 
+// RAMOpenTree reads the entries of a directory in order of their names,
+// encoding them as they are read.
 type RAMOpenTree struct {
-	t      *RAMTree
-	buffer []byte
-	offset int64
-}
+	t *RAMTree
 
-func (ot *RAMOpenTree) update() error {
-	ot.t.RLock()
-	defer ot.t.RUnlock()
-	buf := new(bytes.Buffer)
-	for _, i := range ot.t.tree {
-		y, err := i.Stat()
-		if err != nil {
-			return err
-		}
-		y.Encode(buf)
-	}
-	ot.buffer = buf.Bytes()
-	return nil
+	// last is the name of the last entry read, or empty at the start.
+	// pending is what did not fit of it.
+	last    string
+	pending []byte
+	offset  int64
 }
 
 func (ot *RAMOpenTree) Seek(offset int64, whence int) (int64, error) {
 	if ot.t == nil {
-		return 0, errors.New("file not open")
+		return 0, fileserver.ErrNotOpen
 	}
 	ot.t.RLock()
 	defer ot.t.RUnlock()
-	length := int64(len(ot.buffer))
 	switch whence {
 	case 0:
 	case 1:
 		offset = ot.offset + offset
-	case 2:
-		offset = length + offset
 	default:
 		return ot.offset, errors.New("invalid whence value")
 	}
@@ -56,33 +47,57 @@ func (ot *RAMOpenTree) Seek(offset int64, whence int) (int64, error) {
 		return ot.offset, errors.New("seek to other than 0 on dir illegal")
 	}
 
-	ot.offset = offset
-	err := ot.update()
-	if err != nil {
-		return 0, err
+	if offset == 0 {
+		ot.last = ""
+		ot.pending = nil
 	}
+	ot.offset = offset
 	ot.t.atime = time.Now()
 	return ot.offset, nil
 }
 
 func (ot *RAMOpenTree) Read(p []byte) (int, error) {
 	if ot.t == nil {
-		return 0, errors.New("file not open")
+		return 0, fileserver.ErrNotOpen
 	}
 	ot.t.RLock()
 	defer ot.t.RUnlock()
-	rlen := int64(len(p))
-	if rlen > int64(len(ot.buffer))-ot.offset {
-		rlen = int64(len(ot.buffer)) - ot.offset
+
+	n := copy(p, ot.pending)
+	ot.pending = ot.pending[n:]
+	for n < len(p) {
+		// Entries are found by name rather than position, so that those
+		// created or removed in the meantime do not shift the rest.
+		names := ot.t.names
+		i := sort.SearchStrings(names, ot.last)
+		if i < len(names) && names[i] == ot.last {
+			i++
+		}
+		if i == len(names) {
+			break
+		}
+
+		st, err := ot.t.tree[names[i]].Stat()
+		if err != nil {
+			if n > 0 {
+				break
+			}
+			return 0, err
+		}
+		var buf bytes.Buffer
+		st.Encode(&buf)
+		ot.last = names[i]
+		m := copy(p[n:], buf.Bytes())
+		ot.pending = buf.Bytes()[m:]
+		n += m
 	}
-	copy(p, ot.buffer[ot.offset:rlen+ot.offset])
-	ot.offset += rlen
+	ot.offset += int64(n)
 	ot.t.atime = time.Now()
-	return int(rlen), nil
+	return n, nil
 }
 
 func (ot *RAMOpenTree) Write(p []byte) (int, error) {
-	return 0, errors.New("cannot write to directory")
+	return 0, fileserver.ErrIsDir
 }
 
 func (ot *RAMOpenTree) Close() error {
@@ -93,10 +108,33 @@ func (ot *RAMOpenTree) Close() error {
 	return nil
 }
 
+// features holds what is kept for a whole tree. The root owns it, and
+// everything below points to the same one, so that setting a feature on the
+// root sets it for all of the tree.
+type features struct {
+	journal *Journal
+	quota   *Quota
+	history *History
+	spill   *Spill
+	dedup   *Dedup
+	locks   *Locks
+	trash   *Trash
+	watcher *Watcher
+}
+
 type RAMTree struct {
 	sync.RWMutex
-	parent      fileserver.Dir
+	*features
+	expires time.Time
+	ttl     time.Duration
+	parent  fileserver.Dir
+
+	// dir is the directory holding the tree, or nil for a root or once it
+	// has been removed.
+	dir atomic.Pointer[RAMTree]
+
 	tree        map[string]fileserver.File
+	names       []string
 	id          uint64
 	name        string
 	user        string
@@ -138,19 +176,37 @@ func (t *RAMTree) Name() (string, error) {
 	return t.name, nil
 }
 
-func (t *RAMTree) WriteStat(s protocol.Stat) error {
-	t.Lock()
-	defer t.Unlock()
+// setStat applies a complete stat. The caller must hold the lock.
+func (t *RAMTree) setStat(now time.Time, s protocol.Stat) {
 	t.name = s.Name
 	t.user = s.UID
 	t.group = s.GID
 	t.permissions = s.Mode
-	t.atime = time.Now()
-	t.mtime = time.Now()
+	t.atime = now
+	t.mtime = time.Unix(int64(s.Mtime), 0)
 	t.version++
+}
+
+func (t *RAMTree) WriteStat(s protocol.Stat) error {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	if err := t.journal.wstat(now, t.id, s); err != nil {
+		return err
+	}
+	t.setStat(now, s)
+	t.watcher.changed(now, EventWstat, t.id)
 	return nil
 }
 
+// modified updates the times and version after a change to the entries. The
+// caller must hold the lock.
+func (t *RAMTree) modified(now time.Time) {
+	t.mtime = now
+	t.atime = now
+	t.version++
+}
+
 func (t *RAMTree) Stat() (protocol.Stat, error) {
 	t.RLock()
 	defer t.RUnlock()
@@ -180,7 +236,7 @@ func (t *RAMTree) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile
 	owner := t.user == user
 
 	if !permCheck(owner, t.permissions, mode) {
-		return nil, errors.New("access denied")
+		return nil, fileserver.ErrPermission
 	}
 
 	t.atime = time.Now()
@@ -189,6 +245,8 @@ func (t *RAMTree) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile
 }
 
 func (t *RAMTree) CanRemove() (bool, error) {
+	t.RLock()
+	defer t.RUnlock()
 	return len(t.tree) == 0, nil
 }
 
@@ -197,42 +255,110 @@ func (t *RAMTree) Create(user, name string, perms protocol.FileMode) (fileserver
 	defer t.Unlock()
 	owner := t.user == user
 	if !permCheck(owner, t.permissions, protocol.OWRITE) {
-		return nil, errors.New("access denied")
+		return nil, fileserver.ErrPermission
 	}
 
 	_, ok := t.tree[name]
 	if ok {
-		return nil, errors.New("file already exists")
+		return nil, fileserver.ErrExist
 	}
 
-	var d fileserver.File
 	if perms&protocol.DMDIR != 0 {
 		perms = perms & (^protocol.FileMode(0777) | (t.permissions & 0777))
-		d = NewRAMTree(name, perms, t.user, t.group)
 	} else {
 		perms = perms & (^protocol.FileMode(0666) | (t.permissions & 0666))
-		d = NewRAMFile(name, perms, t.user, t.group)
 	}
 
-	t.tree[name] = d
+	if err := t.quota.create(user); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	id := nextID()
+	if err := t.journal.create(now, t.id, id, name, perms, user, t.group); err != nil {
+		t.quota.remove(user, 0, 0)
+		return nil, err
+	}
+	f := t.create(now, id, name, perms, user, t.group)
+	t.watcher.created(now, t.id, id, name)
+	return f, nil
+}
 
-	t.mtime = time.Now()
-	t.atime = t.mtime
-	t.version++
-	return d, nil
+// create adds a new file or directory. The caller must hold the lock.
+func (t *RAMTree) create(now time.Time, id uint64, name string, perms protocol.FileMode, user, group string) fileserver.File {
+	var d fileserver.File
+	if perms&protocol.DMDIR != 0 {
+		nt := newRAMTree(id, now, name, perms, user, group)
+		nt.features = t.features
+		nt.ttl = t.ttl
+		if t.ttl > 0 {
+			nt.expires = now.Add(t.ttl)
+		}
+		d = nt
+	} else {
+		nf := newRAMFile(id, now, name, perms, user, group)
+		nf.features = t.features
+		if t.ttl > 0 {
+			nf.expires = now.Add(t.ttl)
+		}
+		d = nf
+	}
+
+	t.link(name, d)
+	t.modified(now)
+	return d
 }
 
+// link adds f to the entries as name, keeping the names sorted, and makes it
+// share the features of t. The caller must hold the lock.
+func (t *RAMTree) link(name string, f fileserver.File) {
+	t.tree[name] = f
+	switch f := f.(type) {
+	case *RAMTree:
+		f.dir.Store(t)
+		if f.features != t.features {
+			share(f, t.features)
+		}
+	case *RAMFile:
+		f.dir.Store(t)
+		if f.features != t.features {
+			share(f, t.features)
+		}
+	}
+	i := sort.SearchStrings(t.names, name)
+	if i < len(t.names) && t.names[i] == name {
+		return
+	}
+	t.names = append(t.names, "")
+	copy(t.names[i+1:], t.names[i:])
+	t.names[i] = name
+}
+
+// unlink removes the entry name. The caller must hold the lock.
+func (t *RAMTree) unlink(name string) {
+	switch f := t.tree[name].(type) {
+	case *RAMTree:
+		f.dir.Store(nil)
+	case *RAMFile:
+		f.dir.Store(nil)
+	}
+	delete(t.tree, name)
+	i := sort.SearchStrings(t.names, name)
+	if i < len(t.names) && t.names[i] == name {
+		t.names = append(t.names[:i], t.names[i+1:]...)
+	}
+}
+
+// Add inserts an existing file. It is not recorded in the journal, so it is
+// meant for setting up a tree before it is served.
 func (t *RAMTree) Add(name string, f fileserver.File) error {
 	t.Lock()
 	defer t.Unlock()
 	_, ok := t.tree[name]
 	if ok {
-		return errors.New("file already exists")
+		return fileserver.ErrExist
 	}
-	t.tree[name] = f
-	t.mtime = time.Now()
-	t.atime = t.mtime
-	t.version++
+	t.link(name, f)
+	t.modified(time.Now())
 	return nil
 }
 
@@ -241,29 +367,43 @@ func (t *RAMTree) Rename(user, oldname, newname string) error {
 	defer t.Unlock()
 	_, ok := t.tree[oldname]
 	if !ok {
-		return errors.New("file not found")
+		return fileserver.ErrNotExist
 	}
 	_, ok = t.tree[newname]
 	if ok {
-		return errors.New("file already exists")
+		return fileserver.ErrExist
 	}
 
 	owner := t.user == user
 	if !permCheck(owner, t.permissions, protocol.OWRITE) {
-		return errors.New("access denied")
+		return fileserver.ErrPermission
 	}
 
-	t.tree[newname] = t.tree[oldname]
-	delete(t.tree, oldname)
+	now := time.Now()
+	f := t.tree[oldname]
+	if err := t.journal.rename(now, t.id, f, oldname, newname); err != nil {
+		return err
+	}
+	t.unlink(oldname)
+	t.link(newname, f)
+	t.modified(now)
+	setName(f, newname)
+	if id, ok := fileID(f); ok {
+		t.watcher.renamed(now, id, newname)
+	}
 	return nil
 }
 
 func (t *RAMTree) Remove(user, name string) error {
+	if t.trash != nil && !t.trash.holds(t) {
+		return t.trash.put(user, t, name)
+	}
+
 	t.Lock()
 	defer t.Unlock()
 	owner := t.user == user
 	if !permCheck(owner, t.permissions, protocol.OWRITE) {
-		return errors.New("access denied")
+		return fileserver.ErrPermission
 	}
 
 	if f, ok := t.tree[name]; ok {
@@ -272,16 +412,25 @@ func (t *RAMTree) Remove(user, name string) error {
 			return err
 		}
 		if !rem {
-			return errors.New("file could not be removed")
+			return fileserver.ErrNotEmpty
+		}
+		now := time.Now()
+		if err := t.journal.remove(now, t.id, f, name); err != nil {
+			return err
+		}
+		if t.quota != nil {
+			releaseQuota(t.quota, f)
+		}
+		discard(f)
+		t.unlink(name)
+		t.modified(now)
+		if id, ok := fileID(f); ok {
+			t.watcher.removed(now, id)
 		}
-		delete(t.tree, name)
-		t.mtime = time.Now()
-		t.atime = t.mtime
-		t.version++
 		return nil
 	}
 
-	return errors.New("no such file")
+	return fileserver.ErrNotExist
 }
 
 func (t *RAMTree) Walk(user string, name string) (fileserver.File, error) {
@@ -289,13 +438,29 @@ func (t *RAMTree) Walk(user string, name string) (fileserver.File, error) {
 	defer t.Unlock()
 	owner := t.user == user
 	if !permCheck(owner, t.permissions, protocol.OEXEC) {
-		return nil, errors.New("access denied")
+		return nil, fileserver.ErrPermission
 	}
 
 	t.atime = time.Now()
-	for i := range t.tree {
-		if i == name {
-			return t.tree[i], nil
+	if f, ok := t.tree[name]; ok {
+		return f, nil
+	}
+	if base := strings.TrimSuffix(name, historySuffix); base != name {
+		if f, ok := t.tree[base].(*RAMFile); ok {
+			f.Lock()
+			defer f.Unlock()
+			if hd := f.historyDir(); hd != nil {
+				return hd, nil
+			}
+		}
+	}
+	if base := strings.TrimSuffix(name, lockSuffix); base != name {
+		if f, ok := t.tree[base].(*RAMFile); ok {
+			f.Lock()
+			defer f.Unlock()
+			if lf := f.lockFile(); lf != nil {
+				return lf, nil
+			}
 		}
 	}
 	return nil, nil
@@ -306,15 +471,20 @@ func (t *RAMTree) IsDir() (bool, error) {
 }
 
 func NewRAMTree(name string, permissions protocol.FileMode, user, group string) *RAMTree {
+	return newRAMTree(nextID(), time.Now(), name, permissions, user, group)
+}
+
+func newRAMTree(id uint64, now time.Time, name string, permissions protocol.FileMode, user, group string) *RAMTree {
 	return &RAMTree{
+		features:    &features{},
 		name:        name,
 		tree:        make(map[string]fileserver.File),
 		permissions: permissions,
 		user:        user,
 		group:       group,
 		muser:       user,
-		id:          nextID(),
-		atime:       time.Now(),
-		mtime:       time.Now(),
+		id:          id,
+		atime:       now,
+		mtime:       now,
 	}
 }
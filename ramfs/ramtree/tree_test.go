@@ -0,0 +1,19 @@
+package ramtree
+
+import (
+	"testing"
+
+	"github.com/kennylevinsen/g9ptools/fileserver"
+	"github.com/kennylevinsen/g9ptools/fileserver/fstest"
+)
+
+func TestConformance(t *testing.T) {
+	s := &fstest.Suite{
+		NewRoot: func(t *testing.T) fileserver.Dir {
+			return NewRAMTree("/", 0777, "glenda", "glenda")
+		},
+		User:  "glenda",
+		Other: "nobody",
+	}
+	s.Run(t)
+}
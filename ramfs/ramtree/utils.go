@@ -1,9 +1,11 @@
 package ramtree
 
 import (
+	"strings"
 	"sync"
 
 	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
 )
 
 var (
@@ -19,6 +21,26 @@ func nextID() uint64 {
 	return id
 }
 
+// peekID returns the ID that nextID will hand out next.
+func peekID() uint64 {
+	globalIDLock.Lock()
+	defer globalIDLock.Unlock()
+	return globalID
+}
+
+// reserveIDs makes sure that nextID never again hands out an ID below next.
+func reserveIDs(next uint64) {
+	globalIDLock.Lock()
+	defer globalIDLock.Unlock()
+	if globalID < next {
+		globalID = next
+	}
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
 func permCheck(owner bool, permissions protocol.FileMode, mode protocol.OpenMode) bool {
 	var offset uint8
 	if owner {
@@ -38,3 +60,65 @@ func permCheck(owner bool, permissions protocol.FileMode, mode protocol.OpenMode
 		return false
 	}
 }
+
+// walkTree calls fn for f, and everything below it if it is a RAMTree.
+func walkTree(f fileserver.File, fn func(fileserver.File)) {
+	fn(f)
+	t, ok := f.(*RAMTree)
+	if !ok {
+		return
+	}
+
+	t.RLock()
+	children := make([]fileserver.File, 0, len(t.tree))
+	for _, c := range t.tree {
+		children = append(children, c)
+	}
+	t.RUnlock()
+
+	for _, c := range children {
+		walkTree(c, fn)
+	}
+}
+
+// setName sets the name of f, which has been linked into a directory as
+// name.
+func setName(f fileserver.File, name string) {
+	switch f := f.(type) {
+	case *RAMTree:
+		f.Lock()
+		f.name = name
+		f.Unlock()
+	case *RAMFile:
+		f.Lock()
+		f.name = name
+		f.Unlock()
+	}
+}
+
+// share makes f, and everything below it, use ft.
+func share(f fileserver.File, ft *features) {
+	walkTree(f, func(f fileserver.File) {
+		switch f := f.(type) {
+		case *RAMTree:
+			f.Lock()
+			f.features = ft
+			f.Unlock()
+		case *RAMFile:
+			f.Lock()
+			f.features = ft
+			f.Unlock()
+		}
+	})
+}
+
+// fileID returns the qid path of f, if it is a RAMTree or RAMFile.
+func fileID(f fileserver.File) (uint64, bool) {
+	switch f := f.(type) {
+	case *RAMTree:
+		return f.id, true
+	case *RAMFile:
+		return f.id, true
+	}
+	return 0, false
+}
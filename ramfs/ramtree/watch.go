@@ -0,0 +1,434 @@
+package ramtree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+// EventType is the kind of change an Event reports.
+type EventType int
+
+const (
+	EventCreate EventType = iota
+	EventWrite
+	EventRemove
+	EventRename
+	EventWstat
+
+	// EventOverflow takes the place of events that were dropped because
+	// the subscriber did not keep up. What happened in the meantime can
+	// only be learnt by looking at the tree again.
+	EventOverflow
+)
+
+var eventTypes = [...]string{"create", "write", "remove", "rename", "wstat", "overflow"}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventTypes) {
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+	return eventTypes[t]
+}
+
+// Event is a change made to a tree.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Path is that of the file changed, starting at the root. For renames,
+	// OldPath is the path it had before.
+	Path    string
+	OldPath string
+}
+
+// String formats the event as a line of the event file:
+//
+//	create /a/b
+//	rename /a/b /a/c
+//
+// where renames give the old path before the new one, and overflows have no
+// path.
+func (e Event) String() string {
+	switch e.Type {
+	case EventRename:
+		return fmt.Sprintf("%v %s %s", e.Type, e.OldPath, e.Path)
+	case EventOverflow:
+		return e.Type.String()
+	default:
+		return fmt.Sprintf("%v %s", e.Type, e.Path)
+	}
+}
+
+// eventBuffer is how many events a subscription of an event file holds
+// before it overflows.
+const eventBuffer = 256
+
+// Watcher publishes the changes made to a tree to its subscribers. Events
+// are never waited for: a subscriber that does not keep up loses events, and
+// is sent an EventOverflow in their place.
+type Watcher struct {
+	mu    sync.Mutex
+	root  uint64
+	nodes map[uint64]watchNode
+	subs  map[*Subscription]bool
+}
+
+// watchNode is where a file is, so that its path can be found without
+// locking the tree.
+type watchNode struct {
+	parent uint64
+	name   string
+}
+
+// NewWatcher returns a Watcher with no subscribers.
+func NewWatcher() *Watcher {
+	return &Watcher{
+		nodes: make(map[uint64]watchNode),
+		subs:  make(map[*Subscription]bool),
+	}
+}
+
+// SetWatcher makes w publish the changes made to the tree, which must be a
+// root. Changes made by replaying a journal are not published.
+func (t *RAMTree) SetWatcher(w *Watcher) {
+	w.mu.Lock()
+	w.root = t.id
+	w.mu.Unlock()
+	t.watcher = w
+
+	walkTree(t, func(f fileserver.File) {
+		dir, ok := f.(*RAMTree)
+		if !ok {
+			return
+		}
+		dir.RLock()
+		for name, c := range dir.tree {
+			if id, ok := fileID(c); ok {
+				w.add(dir.id, id, name)
+			}
+		}
+		dir.RUnlock()
+	})
+}
+
+func (w *Watcher) add(parent, id uint64, name string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nodes[id] = watchNode{parent: parent, name: name}
+}
+
+// path returns the path of the file with the given id. The caller must hold
+// the lock.
+func (w *Watcher) path(id uint64) string {
+	var names []string
+	for id != w.root {
+		n, ok := w.nodes[id]
+		if !ok {
+			break
+		}
+		names = append(names, n.name)
+		id = n.parent
+	}
+	var buf bytes.Buffer
+	for i := len(names) - 1; i >= 0; i-- {
+		buf.WriteByte('/')
+		buf.WriteString(names[i])
+	}
+	if buf.Len() == 0 {
+		return "/"
+	}
+	return buf.String()
+}
+
+// publish sends e to the subscribers watching its path. The caller must hold
+// the lock.
+func (w *Watcher) publish(e Event) {
+	for s := range w.subs {
+		if s.matches(e) {
+			s.send(e)
+		}
+	}
+}
+
+// created publishes the creation of a file, and starts keeping track of it.
+func (w *Watcher) created(now time.Time, parent, id uint64, name string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nodes[id] = watchNode{parent: parent, name: name}
+	w.publish(Event{Type: EventCreate, Time: now, Path: w.path(id)})
+}
+
+// changed publishes a write to, or wstat of, a file.
+func (w *Watcher) changed(now time.Time, typ EventType, id uint64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.publish(Event{Type: typ, Time: now, Path: w.path(id)})
+}
+
+// removed publishes the removal of a file, and stops keeping track of it.
+func (w *Watcher) removed(now time.Time, id uint64) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.publish(Event{Type: EventRemove, Time: now, Path: w.path(id)})
+	delete(w.nodes, id)
+}
+
+// renamed publishes a file being given a new name in the same directory.
+func (w *Watcher) renamed(now time.Time, id uint64, name string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, ok := w.nodes[id]
+	if !ok {
+		return
+	}
+	old := w.path(id)
+	n.name = name
+	w.nodes[id] = n
+	w.publish(Event{Type: EventRename, Time: now, Path: w.path(id), OldPath: old})
+}
+
+// moved publishes a file being moved to the directory parent as name, which
+// is reported as a rename.
+func (w *Watcher) moved(now time.Time, id, parent uint64, name string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, ok := w.nodes[id]
+	if !ok {
+		return
+	}
+	old := w.path(id)
+	n.parent = parent
+	n.name = name
+	w.nodes[id] = n
+	w.publish(Event{Type: EventRename, Time: now, Path: w.path(id), OldPath: old})
+}
+
+// Subscription receives the events below a path.
+type Subscription struct {
+	// C delivers the events. It is closed by Close.
+	C <-chan Event
+
+	w        *Watcher
+	c        chan Event
+	path     string
+	overflow bool
+}
+
+// Subscribe returns a subscription to the changes made to path and
+// everything below it, holding up to buffer events the subscriber has yet to
+// receive.
+func (w *Watcher) Subscribe(path string, buffer int) *Subscription {
+	c := make(chan Event, buffer)
+	s := &Subscription{C: c, w: w, c: c, path: path}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subs[s] = true
+	return s
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	if s.w.subs[s] {
+		delete(s.w.subs, s)
+		close(s.c)
+	}
+}
+
+// setPath makes the subscription watch path instead, dropping the events
+// not yet received.
+func (s *Subscription) setPath(path string) {
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	if !s.w.subs[s] {
+		return
+	}
+	s.path = path
+	s.overflow = false
+	for {
+		select {
+		case <-s.c:
+		default:
+			return
+		}
+	}
+}
+
+func (s *Subscription) watches(path string) bool {
+	return s.path == "/" || path == s.path || strings.HasPrefix(path, s.path+"/")
+}
+
+// matches reports whether e is below the path watched. The caller must hold
+// the lock of the watcher.
+func (s *Subscription) matches(e Event) bool {
+	return s.watches(e.Path) || e.Type == EventRename && s.watches(e.OldPath)
+}
+
+// wants reports whether e is one the subscription is to deliver.
+func (s *Subscription) wants(e Event) bool {
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	return e.Type == EventOverflow || s.matches(e)
+}
+
+// send delivers e unless the subscriber has fallen behind. The caller must
+// hold the lock of the watcher.
+func (s *Subscription) send(e Event) {
+	if s.overflow {
+		select {
+		case s.c <- Event{Type: EventOverflow, Time: e.Time}:
+			s.overflow = false
+		default:
+			return
+		}
+	}
+	select {
+	case s.c <- e:
+	default:
+		s.overflow = true
+	}
+}
+
+// File returns an event file. Reading it blocks until something changes,
+// and returns the events as lines formatted by Event.String, never splitting
+// one unless it does not fit in a read by itself. Events are reported for the
+// whole tree, or for the subtree whose path, starting at the root, is
+// written to the open file before reading. Every open of the file has its
+// own subscription.
+//
+// As the events tell the paths of what changes, whether or not they could be
+// walked to, only user may open the file.
+func (w *Watcher) File(name, user, group string) fileserver.File {
+	return &eventFile{
+		synthFile: newSynthFile(name, 0600, user, group, nil, nil),
+		w:         w,
+	}
+}
+
+type eventFile struct {
+	*synthFile
+	w *Watcher
+}
+
+func (f *eventFile) Open(user string, mode protocol.OpenMode) (fileserver.OpenFile, error) {
+	if !permCheck(f.user == user, f.permissions, mode) {
+		return nil, fileserver.ErrPermission
+	}
+	if mode&protocol.OTRUNC != 0 {
+		return nil, fileserver.ErrPermission
+	}
+	return &eventOpenFile{sub: f.w.Subscribe("/", eventBuffer)}, nil
+}
+
+type eventOpenFile struct {
+	sub *Subscription
+
+	// mu guards pending.
+	mu      sync.Mutex
+	pending []byte
+}
+
+// Seek is accepted but ignored, as the events are a stream.
+func (of *eventOpenFile) Seek(offset int64, whence int) (int64, error) {
+	return offset, nil
+}
+
+func (of *eventOpenFile) Read(p []byte) (int, error) {
+	return of.ReadContext(context.Background(), p)
+}
+
+func (of *eventOpenFile) ReadContext(ctx context.Context, p []byte) (int, error) {
+	of.mu.Lock()
+	defer of.mu.Unlock()
+	for len(of.pending) == 0 {
+		// The lock is let go while waiting, so that a new path can be
+		// set meanwhile. An event received for the old one is dropped.
+		of.mu.Unlock()
+		var e Event
+		var ok bool
+		select {
+		case e, ok = <-of.sub.C:
+		case <-ctx.Done():
+			of.mu.Lock()
+			return 0, ctx.Err()
+		}
+		of.mu.Lock()
+		if !ok {
+			return 0, io.EOF
+		}
+		if of.sub.wants(e) {
+			of.pending = []byte(e.String() + "\n")
+		}
+	}
+
+	// Whatever else is already waiting is returned along with it, as long
+	// as whole lines fit.
+fill:
+	for len(of.pending) < len(p) {
+		select {
+		case e, ok := <-of.sub.C:
+			if !ok {
+				break fill
+			}
+			line := e.String() + "\n"
+			if len(of.pending)+len(line) > len(p) {
+				n := copy(p, of.pending)
+				of.pending = []byte(line)
+				return n, nil
+			}
+			of.pending = append(of.pending, line...)
+		default:
+			break fill
+		}
+	}
+
+	n := copy(p, of.pending)
+	of.pending = of.pending[n:]
+	return n, nil
+}
+
+// Write sets the path events are reported for, dropping those not yet read.
+func (of *eventOpenFile) Write(p []byte) (int, error) {
+	path := strings.TrimSpace(string(p))
+	if !strings.HasPrefix(path, "/") {
+		return 0, errors.New("path not absolute")
+	}
+	if path != "/" {
+		path = strings.TrimSuffix(path, "/")
+	}
+	of.mu.Lock()
+	defer of.mu.Unlock()
+	of.sub.setPath(path)
+	of.pending = nil
+	return len(p), nil
+}
+
+func (of *eventOpenFile) Close() error {
+	of.sub.Close()
+	return nil
+}
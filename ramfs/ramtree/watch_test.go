@@ -0,0 +1,231 @@
+package ramtree
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/kennylevinsen/g9p/protocol"
+	"github.com/kennylevinsen/g9ptools/fileserver"
+)
+
+func nextEvent(t *testing.T, s *Subscription) Event {
+	select {
+	case e := <-s.C:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+		return Event{}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	a, _ := root.Create("glenda", "a", 0777|protocol.DMDIR)
+	w := NewWatcher()
+	root.SetWatcher(w)
+
+	all := w.Subscribe("/", 16)
+	sub := w.Subscribe("/a", 16)
+	defer all.Close()
+	defer sub.Close()
+
+	f, _ := a.(fileserver.Dir).Create("glenda", "f", 0666)
+	writeFile(t, f, 0, 10)
+	a.(fileserver.Dir).Rename("glenda", "f", "g")
+	f.WriteStat(protocol.Stat{Length: ^uint64(0), Mode: 0600, Atime: ^uint32(0), Mtime: ^uint32(0)})
+	a.(fileserver.Dir).Remove("glenda", "g")
+	root.Create("glenda", "b", 0666)
+
+	expect := []string{"create /a/f", "write /a/f", "rename /a/f /a/g", "wstat /a/g", "remove /a/g"}
+	for _, s := range expect {
+		if e := nextEvent(t, sub); e.String() != s {
+			t.Fatalf("got %q, expected %q", e, s)
+		}
+	}
+	for _, s := range append(expect, "create /b") {
+		if e := nextEvent(t, all); e.String() != s {
+			t.Fatalf("got %q, expected %q", e, s)
+		}
+	}
+	select {
+	case e := <-sub.C:
+		t.Fatalf("event outside the subtree: %v", e)
+	default:
+	}
+}
+
+func TestWatchOverflow(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	w := NewWatcher()
+	root.SetWatcher(w)
+	s := w.Subscribe("/", 2)
+	defer s.Close()
+
+	f, _ := root.Create("glenda", "f", 0666)
+	for i := 0; i < 4; i++ {
+		writeFile(t, f, 0, 1)
+	}
+	<-s.C
+	<-s.C
+	writeFile(t, f, 0, 1)
+
+	for _, typ := range []EventType{EventOverflow, EventWrite} {
+		if e := nextEvent(t, s); e.Type != typ {
+			t.Fatalf("got %v, expected %v", e.Type, typ)
+		}
+	}
+}
+
+// TestEventFilePath sets the path of an open event file while a read of it
+// is blocked, which must keep the read going with the events of the new path.
+func TestEventFilePath(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	a, _ := root.Create("glenda", "a", 0777|protocol.DMDIR)
+	w := NewWatcher()
+	root.SetWatcher(w)
+	of, err := w.File(".events", "glenda", "glenda").Open("glenda", protocol.ORDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer of.Close()
+
+	type result struct {
+		s   string
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		p := make([]byte, 256)
+		n, err := of.Read(p)
+		done <- result{string(p[:n]), err}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	if _, err := of.Write([]byte("/a")); err != nil {
+		t.Fatal(err)
+	}
+	root.Create("glenda", "b", 0666)
+	a.(fileserver.Dir).Create("glenda", "f", 0666)
+
+	select {
+	case r := <-done:
+		if r.err != nil || r.s != "create /a/f\n" {
+			t.Fatalf("read %q, %v, expected the creation of /a/f", r.s, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read not ended by an event")
+	}
+}
+
+// TestEventFile reads the event file through a FileServer, making sure that
+// a blocked read does not hold up other requests and is ended by a flush or
+// a clunk.
+func TestEventFile(t *testing.T) {
+	root := NewRAMTree("/", 0777, "glenda", "glenda")
+	w := NewWatcher()
+	root.SetWatcher(w)
+	ef := w.File(".events", "glenda", "glenda")
+	root.Add(".events", ef)
+	if _, err := ef.Open("other", protocol.OREAD); !errors.Is(err, fileserver.ErrPermission) {
+		t.Fatalf("event file opened by another user: %v", err)
+	}
+	fs := fileserver.NewFileServer(root, nil, 8192, fileserver.Quiet)
+
+	do := func(err error) {
+		if err != nil {
+			t.Helper()
+			t.Fatal(err)
+		}
+	}
+	_, err := fs.Version(&protocol.VersionRequest{Tag: protocol.NOTAG, MaxSize: 8192, Version: "9P2000"})
+	do(err)
+	_, err = fs.Attach(&protocol.AttachRequest{Tag: 1, Fid: 0, AuthFid: protocol.NOFID, Username: "glenda"})
+	do(err)
+	_, err = fs.Walk(&protocol.WalkRequest{Tag: 1, Fid: 0, NewFid: 1, Names: []string{".events"}})
+	do(err)
+	_, err = fs.Open(&protocol.OpenRequest{Tag: 1, Fid: 1, Mode: protocol.ORDWR})
+	do(err)
+	_, err = fs.Write(&protocol.WriteRequest{Tag: 1, Fid: 1, Data: []byte("/dir\n")})
+	do(err)
+
+	type result struct {
+		resp *protocol.ReadResponse
+		err  error
+	}
+	read := func(tag protocol.Tag) chan result {
+		c := make(chan result, 1)
+		go func() {
+			resp, err := fs.Read(&protocol.ReadRequest{Tag: tag, Fid: 1, Count: 8192})
+			c <- result{resp, err}
+		}()
+		return c
+	}
+
+	// The directory is created over 9P while the read is blocked.
+	c := read(2)
+	_, err = fs.Walk(&protocol.WalkRequest{Tag: 3, Fid: 0, NewFid: 2})
+	do(err)
+	_, err = fs.Create(&protocol.CreateRequest{Tag: 3, Fid: 2, Name: "dir", Permissions: 0777 | protocol.DMDIR, Mode: protocol.OREAD})
+	do(err)
+	res := <-c
+	do(res.err)
+	if string(res.resp.Data) != "create /dir\n" {
+		t.Fatalf("read %q", res.resp.Data)
+	}
+
+	// The flush must not overtake the read it is for, which the requests
+	// being handled side by side would allow.
+	c = read(4)
+	time.Sleep(100 * time.Millisecond)
+	_, err = fs.Flush(&protocol.FlushRequest{Tag: 5, OldTag: 4})
+	do(err)
+	select {
+	case res := <-c:
+		if res.err == nil {
+			t.Fatal("flushed read succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flushed read still blocked")
+	}
+
+	// A stat waiting behind a blocked read must not keep a clunk, or the
+	// end of the connection, from cancelling the read.
+	stat := func(tag protocol.Tag, fid protocol.Fid) {
+		go fs.Stat(&protocol.StatRequest{Tag: tag, Fid: fid})
+		time.Sleep(100 * time.Millisecond)
+	}
+	within := func(what string, fn func() error) {
+		done := make(chan error, 1)
+		go func() { done <- fn() }()
+		select {
+		case err := <-done:
+			do(err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s blocked by a stat waiting for a read", what)
+		}
+	}
+
+	c = read(6)
+	time.Sleep(100 * time.Millisecond)
+	stat(7, 1)
+	within("clunk", func() error {
+		_, err := fs.Clunk(&protocol.ClunkRequest{Tag: 8, Fid: 1})
+		return err
+	})
+	if res := <-c; res.err == nil {
+		t.Fatal("read of clunked fid succeeded")
+	}
+
+	_, err = fs.Walk(&protocol.WalkRequest{Tag: 9, Fid: 0, NewFid: 1, Names: []string{".events"}})
+	do(err)
+	_, err = fs.Open(&protocol.OpenRequest{Tag: 9, Fid: 1, Mode: protocol.OREAD})
+	do(err)
+	c = read(10)
+	time.Sleep(100 * time.Millisecond)
+	stat(11, 1)
+	within("close", fs.Close)
+	if res := <-c; res.err == nil {
+		t.Fatal("read on closed connection succeeded")
+	}
+}
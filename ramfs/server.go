@@ -1,41 +1,316 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/kennylevinsen/g9p"
 	"github.com/kennylevinsen/g9ptools/fileserver"
 	"github.com/kennylevinsen/g9ptools/ramfs/ramtree"
 )
 
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [options]\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [options] service UID GID address\n\n", os.Args[0])
+	fmt.Fprintf(out, "Serves trees held in memory over 9P, one for every service. Every option\n")
+	fmt.Fprintf(out, "but -config, -listen, -msize, -peercred, -service, -tls-* and -verbosity\n")
+	fmt.Fprintf(out, "applies to every service, and may be set for one of them in the config\n")
+	fmt.Fprintf(out, "file:\n\n")
+	fmt.Fprintf(out, "\tlisten ns!ramfs\n\tpeercred\n\tmax-bytes 1073741824\n\n\tservice tmp\n\t\ttrash .trash\n\n")
+	fmt.Fprintf(out, "\tservice home\n\t\tstate /var/lib/ramfs/home\n\t\tlocks\n\n")
+	fmt.Fprintf(out, "The command line takes precedence over the settings before the first\n")
+	fmt.Fprintf(out, "service, and the settings of a service over both.\n\n")
+	flag.PrintDefaults()
+}
+
+// service is a tree being served.
+type service struct {
+	name    string
+	root    *ramtree.RAMTree
+	journal *ramtree.Journal
+	state   string
+	spill   *ramtree.Spill
+	expiry  *ramtree.Expiry
+}
+
 func main() {
-	if len(os.Args) < 5 {
-		fmt.Printf("Too few arguments\n")
-		fmt.Printf("%s service UID GID address\n", os.Args[0])
-		fmt.Printf("UID and GID are the user/group that owns /\n")
-		return
+	flag.Usage = usage
+	cfg, err := parseConfig(flag.CommandLine, os.Args[1:])
+	switch {
+	case err == flag.ErrHelp:
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(flag.CommandLine.Output(), "%s: %v\n\n", os.Args[0], err)
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	service := os.Args[1]
-	user := os.Args[2]
-	group := os.Args[3]
-	addr := os.Args[4]
+	roots := make(map[string]fileserver.Dir)
+	var services []*service
+	for _, sc := range cfg.services {
+		s := startService(sc.name, sc.opts)
+		services = append(services, s)
+		roots[s.name] = s.root
+	}
+
+	h := func() *fileserver.FileServer {
+		return fileserver.NewFileServer(nil, roots, uint32(cfg.msize), cfg.chat)
+	}
 
+	var tlsConfig *tls.Config
+	if cfg.tlsCert != "" {
+		var err error
+		tlsConfig, err = fileserver.TLSConfig(cfg.tlsCert, cfg.tlsKey, cfg.tlsClientCA)
+		if err != nil {
+			log.Fatalf("Unable to set up TLS: %v", err)
+		}
+	}
+
+	var listeners []net.Listener
+	for _, addr := range cfg.listen {
+		l, serve, err := listen(addr, cfg, tlsConfig)
+		if err != nil {
+			log.Fatalf("Unable to listen on %s: %v", addr, err)
+		}
+		listeners = append(listeners, l)
+
+		log.Printf("Starting ramfs at %s", addr)
+		go func() {
+			err := serve(l, h)
+			if !errors.Is(err, net.ErrClosed) {
+				log.Fatalf("Unable to serve: %v", err)
+			}
+		}()
+	}
+	go shutdown(services, listeners)
+
+	// shutdown ends the process.
+	select {}
+}
+
+// listen listens on addr, returning how connections to it are to be served.
+// TCP connections use TLS if tlsConfig is not nil, and attach as the user
+// named by the client certificate if the client must present one. Unix
+// domain sockets attach as the user on the other end with -peercred.
+func listen(addr string, cfg *config, tlsConfig *tls.Config) (net.Listener, func(net.Listener, func() *fileserver.FileServer) error, error) {
+	l, err := fileserver.Listen(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch l.(type) {
+	case *net.TCPListener:
+		if tlsConfig == nil {
+			break
+		}
+		l = tls.NewListener(l, tlsConfig)
+		if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+			return l, fileserver.ServePeerCred, nil
+		}
+	case *net.UnixListener:
+		if cfg.peerCred {
+			return l, fileserver.ServePeerCred, nil
+		}
+	}
+	return l, fileserver.ServeListener, nil
+}
+
+// startService sets up the tree of the service name as given by opts.
+func startService(name string, opts options) *service {
+	s := &service{name: name, state: opts.state}
+	fatalf := func(format string, args ...interface{}) {
+		log.Fatalf("%s: %s", name, fmt.Sprintf(format, args...))
+	}
+	logf := func(format string, args ...interface{}) {
+		log.Printf("%s: %s", name, fmt.Sprintf(format, args...))
+	}
+
+	user, group := opts.user, opts.group
 	root := ramtree.NewRAMTree("/", 0777, user, group)
-	l, err := net.Listen("tcp", addr)
+	restored := false
+	if opts.state != "" {
+		t, err := ramtree.LoadSnapshot(opts.state)
+		switch {
+		case err == nil:
+			logf("Restored tree from %s", opts.state)
+			root = t
+			restored = true
+		case os.IsNotExist(err):
+			logf("No state in %s, starting with an empty tree", opts.state)
+		default:
+			fatalf("Unable to restore tree: %v", err)
+		}
+	}
+	s.root = root
+
+	if opts.seed != "" && !restored {
+		if err := importArchive(root, opts.seed); err != nil {
+			fatalf("Unable to seed tree: %v", err)
+		}
+		logf("Seeded tree from %s", opts.seed)
+	}
+
+	if opts.state != "" {
+		var err error
+		s.journal, err = ramtree.OpenJournal(opts.state, root, syncPolicies[opts.syncPolicy], opts.journalSize)
+		if err != nil {
+			fatalf("Unable to open journal: %v", err)
+		}
+		if opts.interval > 0 {
+			go persist(s.journal, opts.interval)
+		}
+	}
+
+	q := ramtree.NewQuota(opts.limits)
+	root.SetQuota(q)
+	if opts.usageFile != "" {
+		if err := root.Add(opts.usageFile, q.File(opts.usageFile, user, group)); err != nil {
+			logf("Unable to add usage file: %v", err)
+		}
+	}
+
+	if opts.spillThreshold > 0 {
+		var err error
+		s.spill, err = ramtree.NewSpill(opts.spillDir, opts.spillThreshold)
+		if err != nil {
+			fatalf("Unable to create spill directory: %v", err)
+		}
+		root.SetSpill(s.spill)
+	}
+
+	if opts.trashDir != "" {
+		tr, err := ramtree.NewTrash(root, opts.trashDir, opts.trashRetention)
+		if err != nil {
+			fatalf("Unable to set up trash: %v", err)
+		}
+		root.SetTrash(tr)
+		go tr.Run(opts.reapInterval)
+	}
+
+	if opts.locks {
+		root.SetLocks(ramtree.NewLocks())
+	}
+
+	if opts.dedup {
+		d := ramtree.NewDedup()
+		root.SetDedup(d)
+		if opts.dedupFile != "" {
+			if err := root.Add(opts.dedupFile, d.File(opts.dedupFile, user, group)); err != nil {
+				logf("Unable to add dedup file: %v", err)
+			}
+		}
+	}
+
+	if opts.archiveFile != "" {
+		if err := root.Add(opts.archiveFile, root.ArchiveFile(opts.archiveFile, user, group)); err != nil {
+			logf("Unable to add archive file: %v", err)
+		}
+	}
+
+	if opts.historyVersions > 0 || opts.historyAge > 0 {
+		root.SetHistory(ramtree.NewHistory(opts.historyVersions, opts.historyAge))
+	}
+
+	if opts.eventFile != "" {
+		w := ramtree.NewWatcher()
+		root.SetWatcher(w)
+		if err := root.Add(opts.eventFile, w.File(opts.eventFile, user, group)); err != nil {
+			logf("Unable to add event file: %v", err)
+		}
+	}
+
+	if opts.expiryFile != "" {
+		s.expiry = ramtree.NewExpiry(root)
+		if err := root.Add(opts.expiryFile, s.expiry.File(opts.expiryFile, user, group)); err != nil {
+			logf("Unable to add expiry file: %v", err)
+		}
+		go s.expiry.Run(opts.reapInterval)
+	}
+
+	if opts.dumpDir != "" {
+		d := ramtree.NewDump(root, opts.dumpDir, user, group)
+		if err := root.Add(opts.dumpDir, d); err != nil {
+			logf("Unable to add dump directory: %v", err)
+		}
+		if opts.dumpInterval > 0 {
+			go func() {
+				for range time.Tick(opts.dumpInterval) {
+					if _, err := d.Take(); err != nil {
+						logf("Unable to dump tree: %v", err)
+					}
+				}
+			}()
+		}
+	}
+
+	return s
+}
+
+// importArchive fills the tree from the tar file at path.
+func importArchive(root *ramtree.RAMTree, path string) error {
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatalf("Unable to listen: %v", err)
+		return err
 	}
+	defer f.Close()
+	return root.Import(f)
+}
 
-	h := func() g9p.Handler {
-		m := make(map[string]fileserver.Dir)
-		m[service] = root
-		return fileserver.NewFileServer(nil, m, 10*1024*1024, fileserver.Debug)
+// persist folds the journal into a snapshot of the tree every interval.
+func persist(j *ramtree.Journal, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := j.Compact(); err != nil {
+			log.Printf("Unable to save tree: %v", err)
+		}
 	}
+}
 
-	log.Printf("Starting ramfs at %s", addr)
-	g9p.ServeListener(l, h)
+// shutdown waits for the process to be asked to terminate, and then stops
+// listening, saves the trees that are journaled, and removes what has been
+// spilled.
+func shutdown(services []*service, listeners []net.Listener) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sig
+	log.Printf("Received %v, exiting", s)
+
+	for _, l := range listeners {
+		// This removes Unix domain sockets.
+		l.Close()
+	}
+
+	failed := false
+	for _, s := range services {
+		if s.expiry != nil {
+			s.expiry.Close()
+		}
+		if s.journal != nil {
+			log.Printf("%s: Saving tree to %s", s.name, s.state)
+			err := s.journal.Compact()
+			if cerr := s.journal.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				// The journal still holds what the snapshot lacks.
+				log.Printf("%s: Unable to save tree: %v", s.name, err)
+				failed = true
+			}
+		}
+		if s.spill != nil {
+			if err := s.spill.Close(); err != nil {
+				log.Printf("%s: Unable to remove spilled content: %v", s.name, err)
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
 }